@@ -0,0 +1,139 @@
+package doubleratchet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// AESGCMCrypto is an implementation of Crypto which encrypts messages with AES-256-GCM.
+// Key pairs and KDFs are the same as in DefaultCrypto.
+type AESGCMCrypto struct {
+	DefaultCrypto
+}
+
+var aesGCMSuite = aeadSuite{
+	suite:     CryptoSuiteAESGCM,
+	nonceSize: 12,
+	info:      "AES-256-GCM",
+	new: func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	},
+}
+
+// Suite returns CryptoSuiteAESGCM. Instances embedding a customized DefaultCrypto return
+// CryptoSuiteUnknown, see DefaultCrypto.Suite.
+func (c AESGCMCrypto) Suite() CryptoSuite {
+	if c.DefaultCrypto.Suite() != CryptoSuiteDefault {
+		return CryptoSuiteUnknown
+	}
+	return CryptoSuiteAESGCM
+}
+
+// Encrypt seals plaintext with the key and nonce derived from mk. The ciphertext starts with
+// the suite identifier.
+func (c AESGCMCrypto) Encrypt(mk Key, plaintext, ad []byte) ([]byte, error) {
+	return aesGCMSuite.seal(mk, plaintext, ad)
+}
+
+// Decrypt returns the AEAD decryption of ciphertext with message key mk.
+func (c AESGCMCrypto) Decrypt(mk Key, ciphertext, ad []byte) ([]byte, error) {
+	return aesGCMSuite.open(mk, ciphertext, ad)
+}
+
+// XChaCha20Poly1305Crypto is an implementation of Crypto which encrypts messages with XChaCha20-Poly1305.
+// Key pairs and KDFs are the same as in DefaultCrypto.
+type XChaCha20Poly1305Crypto struct {
+	DefaultCrypto
+}
+
+var xChaCha20Poly1305Suite = aeadSuite{
+	suite:     CryptoSuiteXChaCha20Poly1305,
+	nonceSize: chacha20poly1305.NonceSizeX,
+	info:      "XChaCha20-Poly1305",
+	new:       chacha20poly1305.NewX,
+}
+
+// Suite returns CryptoSuiteXChaCha20Poly1305. Instances embedding a customized DefaultCrypto return
+// CryptoSuiteUnknown, see DefaultCrypto.Suite.
+func (c XChaCha20Poly1305Crypto) Suite() CryptoSuite {
+	if c.DefaultCrypto.Suite() != CryptoSuiteDefault {
+		return CryptoSuiteUnknown
+	}
+	return CryptoSuiteXChaCha20Poly1305
+}
+
+// Encrypt seals plaintext with the key and nonce derived from mk. The ciphertext starts with
+// the suite identifier.
+func (c XChaCha20Poly1305Crypto) Encrypt(mk Key, plaintext, ad []byte) ([]byte, error) {
+	return xChaCha20Poly1305Suite.seal(mk, plaintext, ad)
+}
+
+// Decrypt returns the AEAD decryption of ciphertext with message key mk.
+func (c XChaCha20Poly1305Crypto) Decrypt(mk Key, ciphertext, ad []byte) ([]byte, error) {
+	return xChaCha20Poly1305Suite.open(mk, ciphertext, ad)
+}
+
+// aeadSuite seals messages with an AEAD keyed by a 32-byte key. The key and the nonce are derived
+// from the message key with HKDF, every message key is used only once so the nonce is never reused.
+type aeadSuite struct {
+	suite     CryptoSuite
+	nonceSize int
+	info      string
+	new       func(key []byte) (cipher.AEAD, error)
+}
+
+func (a aeadSuite) aead(mk Key) (cipher.AEAD, []byte, error) {
+	var (
+		r   = hkdf.New(sha256.New, mk, make([]byte, 32), []byte(a.info))
+		buf = make([]byte, 32+a.nonceSize)
+	)
+
+	// The only error here is an entropy limit which won't be reached for such a short buffer.
+	_, _ = io.ReadFull(r, buf)
+
+	aead, err := a.new(buf[:32])
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't create %s cipher: %w", a.info, err)
+	}
+	return aead, buf[32:], nil
+}
+
+func (a aeadSuite) seal(mk Key, plaintext, ad []byte) ([]byte, error) {
+	aead, nonce, err := a.aead(mk)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal([]byte{byte(a.suite)}, nonce, plaintext, ad), nil
+}
+
+func (a aeadSuite) open(mk Key, ciphertext, ad []byte) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, fmt.Errorf("%w: ciphertext is too short", ErrAuthFailed)
+	}
+	if cs := CryptoSuite(ciphertext[0]); cs != a.suite {
+		return nil, fmt.Errorf("%w: ciphertext of %s, expected %s", ErrSuiteMismatch, cs, a.suite)
+	}
+
+	aead, nonce, err := a.aead(mk)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext)-1 < aead.Overhead() {
+		return nil, fmt.Errorf("%w: ciphertext is too short", ErrAuthFailed)
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext[1:], ad)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return plaintext, nil
+}
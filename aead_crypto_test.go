@@ -0,0 +1,134 @@
+package doubleratchet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var aeadCryptos = map[string]Crypto{
+	"AES-256-GCM":        AESGCMCrypto{},
+	"XChaCha20-Poly1305": XChaCha20Poly1305Crypto{},
+}
+
+func TestAEADCrypto_EncryptDecrypt(t *testing.T) {
+	for name, c := range aeadCryptos {
+		t.Run(name, func(t *testing.T) {
+			// Arrange.
+			ad := []byte("associated data")
+
+			// Act.
+			ct, err := c.Encrypt(sk, []byte("1337"), ad)
+			require.NoError(t, err)
+			pt, err := c.Decrypt(sk, ct, ad)
+
+			// Assert.
+			require.NoError(t, err)
+			require.Equal(t, []byte("1337"), pt)
+			require.EqualValues(t, suiteOf(c), ct[0])
+		})
+	}
+}
+
+func TestAEADCrypto_Decrypt_Tampered(t *testing.T) {
+	for name, c := range aeadCryptos {
+		t.Run(name, func(t *testing.T) {
+			// Arrange.
+			ct, err := c.Encrypt(sk, []byte("1337"), nil)
+			require.NoError(t, err)
+
+			cases := map[string]struct {
+				mk, ct, ad []byte
+			}{
+				"ciphertext":     {sk, append(append([]byte{}, ct[:len(ct)-1]...), ct[len(ct)-1]^1), nil},
+				"associatedData": {sk, ct, []byte("ad")},
+				"key":            {append(Key{}, sk[1:]...), ct, nil},
+				"short":          {sk, ct[:5], nil},
+				"empty":          {sk, nil, nil},
+			}
+			for name, tc := range cases {
+				// Act.
+				_, err := c.Decrypt(tc.mk, tc.ct, tc.ad)
+
+				// Assert.
+				require.True(t, errors.Is(err, ErrAuthFailed), "%s: %v", name, err)
+			}
+		})
+	}
+}
+
+func TestAEADCrypto_Decrypt_SuiteMismatch(t *testing.T) {
+	// Arrange.
+	ct, err := AESGCMCrypto{}.Encrypt(sk, []byte("1337"), nil)
+	require.NoError(t, err)
+
+	// Act.
+	_, err = XChaCha20Poly1305Crypto{}.Decrypt(sk, ct, nil)
+
+	// Assert.
+	require.True(t, errors.Is(err, ErrSuiteMismatch), err)
+}
+
+func TestAEADCrypto_Suite_Customized(t *testing.T) {
+	// Arrange.
+	custom := AESGCMCrypto{mustNewCrypto(t, WithKdfRKInfo("MyApp root"))}
+	state, err := newState(sk, WithCrypto(custom))
+	require.NoError(t, err)
+	data, err := state.MarshalBinary()
+	require.NoError(t, err)
+
+	// Act.
+	var decoded State
+	err = decoded.UnmarshalBinary(data)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Nil(t, decoded.Crypto)
+	require.Equal(t, CryptoSuiteUnknown, custom.Suite())
+	require.Equal(t, CryptoSuiteUnknown, XChaCha20Poly1305Crypto{custom.DefaultCrypto}.Suite())
+	require.Equal(t, CryptoSuiteAESGCM, AESGCMCrypto{}.Suite())
+}
+
+func TestAEADCrypto_Session(t *testing.T) {
+	for name, c := range aeadCryptos {
+		t.Run(name, func(t *testing.T) {
+			// Arrange.
+			bobPair, err := c.GenerateDH()
+			require.NoError(t, err)
+			bob, err := New([]byte("bob"), sk, bobPair, nil, WithCrypto(c))
+			require.NoError(t, err)
+			alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithCrypto(c))
+			require.NoError(t, err)
+
+			// Act.
+			m, err := alice.RatchetEncrypt([]byte("Hi Bob!"), nil)
+			require.NoError(t, err)
+			d, err := bob.RatchetDecrypt(m, nil)
+
+			// Assert.
+			require.NoError(t, err)
+			require.Equal(t, []byte("Hi Bob!"), d)
+		})
+	}
+}
+
+func TestAEADCrypto_StateEncoding(t *testing.T) {
+	for name, c := range aeadCryptos {
+		t.Run(name, func(t *testing.T) {
+			// Arrange.
+			state, err := newState(sk, WithCrypto(c))
+			require.NoError(t, err)
+			data, err := state.MarshalBinary()
+			require.NoError(t, err)
+
+			// Act.
+			var decoded State
+			err = decoded.UnmarshalBinary(data)
+
+			// Assert.
+			require.NoError(t, err)
+			require.Equal(t, c, decoded.Crypto)
+		})
+	}
+}
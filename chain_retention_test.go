@@ -0,0 +1,73 @@
+package doubleratchet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSession_Step(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil)
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+	exchange(t, alice, bob, 1)
+	step := bob.(*sessionState).Step
+
+	// Act.
+	exchange(t, alice, bob, 2)
+	exchange(t, bob, alice, 1)
+	exchange(t, alice, bob, 1)
+
+	// Assert.
+	require.Equal(t, step+1, bob.(*sessionState).Step)
+}
+
+func TestSession_MaxKeepSteps(t *testing.T) {
+	for name, ks := range map[string]KeysStorage{
+		"chain storage": &KeysStorageInMemory{},
+		"keys storage":  keysStorageOnly{&KeysStorageInMemory{}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Arrange.
+			bob, err := New([]byte("bob"), sk, bobPair, nil, WithKeysStorage(ks), WithMaxKeepSteps(2))
+			require.NoError(t, err)
+			alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+			require.NoError(t, err)
+
+			skipped, err := alice.RatchetEncrypt([]byte("skipped"), nil)
+			require.NoError(t, err)
+			exchange(t, alice, bob, 1)
+
+			// Act.
+			for i := 0; i < 2; i++ {
+				exchange(t, bob, alice, 1)
+				exchange(t, alice, bob, 1)
+			}
+			_, kept, err := ks.Get(skipped.Header.DH, 0)
+			require.NoError(t, err)
+
+			exchange(t, bob, alice, 1)
+			exchange(t, alice, bob, 1)
+
+			// Assert.
+			require.True(t, kept)
+			_, ok, err := ks.Get(skipped.Header.DH, 0)
+			require.NoError(t, err)
+			require.False(t, ok)
+			require.Len(t, bob.(*sessionState).SkippedChains, 3)
+
+			_, err = bob.RatchetDecrypt(skipped, nil)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestWithMaxKeepSteps_Negative(t *testing.T) {
+	// Act.
+	_, err := New([]byte("bob"), sk, bobPair, nil, WithMaxKeepSteps(-1))
+
+	// Assert.
+	require.Error(t, err)
+}
@@ -0,0 +1,227 @@
+package doubleratchet
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	stressGoroutines = 8
+	stressMessages   = 25
+)
+
+// stress runs fn from stressGoroutines goroutines stressMessages times each.
+func stress(t *testing.T, fn func(g, i int) error) {
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, stressGoroutines*stressMessages)
+	)
+	for g := 0; g < stressGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < stressMessages; i++ {
+				if err := fn(g, i); err != nil {
+					errs <- err
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func TestSession_ConcurrentEncryptDecrypt(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = New([]byte("bob"), sk, bobPair, nil)
+		alice, _ = NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+		msgs     = make([][]Message, stressGoroutines)
+		mu       sync.Mutex
+	)
+
+	// Act.
+	stress(t, func(g, i int) error {
+		m, err := alice.RatchetEncrypt([]byte(fmt.Sprintf("%d-%d", g, i)), nil)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		msgs[g] = append(msgs[g], m)
+		mu.Unlock()
+		return nil
+	})
+
+	// Assert.
+	stress(t, func(g, i int) error {
+		d, err := bob.RatchetDecrypt(msgs[g][i], nil)
+		if err != nil {
+			return err
+		}
+		if string(d) != fmt.Sprintf("%d-%d", g, i) {
+			return fmt.Errorf("unexpected plaintext %q", d)
+		}
+		return nil
+	})
+}
+
+func TestSession_ConcurrentPingPong(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = New([]byte("bob"), sk, bobPair, nil)
+		alice, _ = NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	)
+
+	// Act and assert.
+	stress(t, func(g, i int) error {
+		from, to := alice, bob
+		if g%2 == 1 {
+			from, to = bob, alice
+		}
+		m, err := from.RatchetEncrypt([]byte("ping"), nil)
+		if err != nil {
+			return err
+		}
+		// Messages may be reordered with ones of other goroutines and even with
+		// the previous chains, which is fine as long as the keys are kept.
+		_, err = to.RatchetDecrypt(m, nil)
+		return err
+	})
+}
+
+func TestSessionHE_ConcurrentEncryptDecrypt(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil)
+		alice, _ = NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+		msgs     = make([][]MessageHE, stressGoroutines)
+		mu       sync.Mutex
+	)
+
+	// Act.
+	stress(t, func(g, i int) error {
+		m, err := alice.RatchetEncrypt([]byte(fmt.Sprintf("%d-%d", g, i)), nil)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		msgs[g] = append(msgs[g], m)
+		mu.Unlock()
+		return nil
+	})
+
+	// Assert.
+	stress(t, func(g, i int) error {
+		d, err := bob.RatchetDecrypt(msgs[g][i], nil)
+		if err != nil {
+			return err
+		}
+		if string(d) != fmt.Sprintf("%d-%d", g, i) {
+			return fmt.Errorf("unexpected plaintext %q", d)
+		}
+		return nil
+	})
+}
+
+func TestSession_ConcurrentDeleteMkDecrypt(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = New([]byte("bob"), sk, bobPair, nil)
+		alice, _ = NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+		msgs     = make([][]Message, stressGoroutines)
+	)
+	for g := range msgs {
+		for i := 0; i < stressMessages; i++ {
+			m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+			require.NoError(t, err)
+			msgs[g] = append(msgs[g], m)
+		}
+	}
+
+	// Act and assert.
+	stress(t, func(g, i int) error {
+		m := msgs[g][i]
+		if g%2 == 0 {
+			return bob.DeleteMk(m.Header.DH, m.Header.N)
+		}
+		_, err := bob.RatchetDecrypt(m, nil)
+		return err
+	})
+}
+
+func TestSession_ConcurrentConfirmDecrypt(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = New([]byte("bob"), sk, bobPair, nil)
+		alice, _ = NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+		msgs     = make([][]Message, stressGoroutines)
+	)
+	for g := range msgs {
+		for i := 0; i < stressMessages; i++ {
+			m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+			require.NoError(t, err)
+			msgs[g] = append(msgs[g], m)
+		}
+	}
+
+	// Act and assert.
+	stress(t, func(g, i int) error {
+		m := msgs[g][i]
+		switch g % 4 {
+		case 0:
+			return bob.Confirm(m.Header)
+		case 1:
+			return bob.ConfirmAll()
+		case 2:
+			_, err := bob.Pending()
+			return err
+		}
+		_, _, err := bob.RatchetDecryptPrepare(m, nil)
+		if err != nil {
+			return err
+		}
+		_, err = bob.RatchetDecrypt(m, nil)
+		return err
+	})
+}
+
+func TestKeysStorageInMemory_Concurrent(t *testing.T) {
+	// Arrange.
+	ks := &KeysStorageInMemory{}
+
+	// Act.
+	stress(t, func(g, i int) error {
+		pubKey := Key{byte(g)}
+		if err := ks.Put([]byte("session"), pubKey, uint(i), Key{byte(i)}, uint(g*stressMessages+i), time.Now()); err != nil {
+			return err
+		}
+		if _, _, err := ks.Get(pubKey, uint(i)); err != nil {
+			return err
+		}
+		if _, err := ks.All(); err != nil {
+			return err
+		}
+		if err := ks.TruncateMks([]byte("session"), 100); err != nil {
+			return err
+		}
+		return ks.DeleteOldMks([]byte("session"), 10)
+	})
+
+	// Assert.
+	all, err := ks.All()
+	require.NoError(t, err)
+
+	n := 0
+	for _, keys := range all {
+		n += len(keys)
+	}
+	require.True(t, n <= 100)
+}
@@ -0,0 +1,131 @@
+package doubleratchet
+
+import (
+	"fmt"
+	"time"
+)
+
+// KeyState tells skipped message keys apart from keys of decrypted messages.
+type KeyState uint8
+
+const (
+	// KeySkipped is the key of a skipped message which hasn't been received yet.
+	KeySkipped KeyState = iota
+
+	// KeyPending is the key of a decrypted message kept until the message is confirmed.
+	KeyPending
+)
+
+// PendingMessage identifies a decrypted message awaiting confirmation.
+type PendingMessage struct {
+	DH Key
+	N  uint32
+}
+
+// PendingKeysStorage is a KeysStorage which keeps keys of decrypted messages awaiting confirmation
+// apart from skipped ones. Sessions require it for ConfirmAll, Pending and WithMaxKeepPending,
+// other storages keep both kinds of keys together.
+type PendingKeysStorage interface {
+	KeysStorage
+
+	// PutPending saves the key of the decrypted message, replacing the skipped one if any.
+	// The replaced key keeps its creation time, so that it doesn't outlive SkippedKeyTTL.
+	PutPending(sessionID []byte, k Key, msgNum uint, mk Key, keySeqNum uint, createdAt time.Time) error
+
+	// DeletePending ensures there's no key awaiting confirmation under the specified key and msgNum.
+	// Skipped keys are left intact.
+	DeletePending(k Key, msgNum uint) error
+
+	// DeleteOldKeys deletes keys of the given state up to the specified sequence number for a session.
+	DeleteOldKeys(sessionID []byte, state KeyState, deleteUntilSeqKey uint) error
+
+	// Pending returns decrypted messages of a session awaiting confirmation, the oldest first.
+	Pending(sessionID []byte) ([]PendingMessage, error)
+}
+
+// errNoPendingKeys is returned by confirmation methods of sessions which keys storage
+// doesn't implement PendingKeysStorage.
+var errNoPendingKeys = fmt.Errorf("keys storage doesn't implement PendingKeysStorage")
+
+// deleteOldKeys deletes skipped keys older than MaxKeep and keys awaiting confirmation
+// older than MaxKeepPending, if set, or MaxKeep otherwise.
+func (s *State) deleteOldKeys(sessionID []byte) error {
+	ps, ok := s.MkSkipped.(PendingKeysStorage)
+	if !ok {
+		if s.KeysCount >= s.MaxKeep {
+			return s.MkSkipped.DeleteOldMks(sessionID, s.KeysCount-s.MaxKeep)
+		}
+		return nil
+	}
+
+	maxKeepPending := s.MaxKeepPending
+	if maxKeepPending == 0 {
+		maxKeepPending = s.MaxKeep
+	}
+	for _, keep := range []struct {
+		state   KeyState
+		maxKeep uint
+	}{{KeySkipped, s.MaxKeep}, {KeyPending, maxKeepPending}} {
+		if s.KeysCount < keep.maxKeep {
+			continue
+		}
+		if err := ps.DeleteOldKeys(sessionID, keep.state, s.KeysCount-keep.maxKeep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Confirm deletes the key kept for the decrypted message with the given header. Skipped keys
+// are left intact if the storage implements PendingKeysStorage.
+func (s *sessionState) Confirm(h MessageHeader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.sync()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if ps, ok := s.MkSkipped.(PendingKeysStorage); ok {
+		return ps.DeletePending(h.DH, uint(h.N))
+	}
+	return s.MkSkipped.DeleteMk(h.DH, uint(h.N))
+}
+
+// ConfirmAll deletes keys of all the decrypted messages awaiting confirmation.
+func (s *sessionState) ConfirmAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.sync()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	ps, ok := s.MkSkipped.(PendingKeysStorage)
+	if !ok {
+		return errNoPendingKeys
+	}
+	return ps.DeleteOldKeys(s.id, KeyPending, ^uint(0))
+}
+
+// Pending returns decrypted messages awaiting confirmation, the oldest first.
+func (s *sessionState) Pending() ([]PendingMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.sync()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	ps, ok := s.MkSkipped.(PendingKeysStorage)
+	if !ok {
+		return nil, errNoPendingKeys
+	}
+	return ps.Pending(s.id)
+}
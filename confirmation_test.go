@@ -0,0 +1,143 @@
+package doubleratchet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// keysStorageOnly hides PendingKeysStorage methods of the wrapped storage.
+type keysStorageOnly struct {
+	KeysStorage
+}
+
+func TestSession_Pending(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil)
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	m1, err := alice.RatchetEncrypt([]byte("1"), nil)
+	require.NoError(t, err)
+	m2, err := alice.RatchetEncrypt([]byte("2"), nil)
+	require.NoError(t, err)
+	m3, err := alice.RatchetEncrypt([]byte("3"), nil)
+	require.NoError(t, err)
+
+	// Act.
+	_, err = bob.RatchetDecrypt(m3, nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m1, nil)
+	require.NoError(t, err)
+	pending, err := bob.Pending()
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []PendingMessage{{DH: m3.Header.DH, N: 2}, {DH: m1.Header.DH, N: 0}}, pending)
+
+	// The key of m2 is still skipped.
+	require.NoError(t, bob.Confirm(m2.Header))
+	d, err := bob.RatchetDecrypt(m2, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), d)
+}
+
+func TestSession_Confirm(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil)
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+
+	// Act.
+	err = bob.Confirm(m.Header)
+
+	// Assert.
+	require.NoError(t, err)
+	pending, err := bob.Pending()
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	_, err = bob.RatchetDecrypt(m, nil)
+	require.ErrorIs(t, err, ErrMessageKeyDeleted)
+}
+
+func TestSession_ConfirmAll(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil)
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+	exchange(t, alice, bob, 2)
+	exchange(t, bob, alice, 1)
+	exchange(t, alice, bob, 2)
+
+	// Act.
+	err = bob.ConfirmAll()
+
+	// Assert.
+	require.NoError(t, err)
+	pending, err := bob.Pending()
+	require.NoError(t, err)
+	require.Empty(t, pending)
+	all, err := bob.(*sessionState).MkSkipped.All()
+	require.NoError(t, err)
+	for _, keys := range all {
+		require.Empty(t, keys)
+	}
+}
+
+func TestSession_MaxKeepPending(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithMaxKeepPending(2))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	skipped, err := alice.RatchetEncrypt([]byte("skipped"), nil)
+	require.NoError(t, err)
+
+	// Act.
+	exchange(t, alice, bob, 5)
+
+	// Assert.
+	pending, err := bob.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.EqualValues(t, 5, pending[0].N)
+
+	d, err := bob.RatchetDecrypt(skipped, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("skipped"), d)
+}
+
+func TestSession_Confirm_KeysStorageWithoutPending(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithKeysStorage(keysStorageOnly{&KeysStorageInMemory{}}))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+
+	// Act.
+	err = bob.Confirm(m.Header)
+
+	// Assert.
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m, nil)
+	require.ErrorIs(t, err, ErrMessageKeyDeleted)
+
+	_, err = bob.Pending()
+	require.Error(t, err)
+	require.Error(t, bob.ConfirmAll())
+}
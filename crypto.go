@@ -1,6 +1,9 @@
 package doubleratchet
 
-import "encoding/hex"
+import (
+	"encoding/hex"
+	"fmt"
+)
 
 // Crypto is a cryptography supplement for the library.
 type Crypto interface {
@@ -21,6 +24,107 @@ type Crypto interface {
 	KDFer
 }
 
+// CryptoSuite identifies a set of cryptographic primitives implemented by Crypto.
+type CryptoSuite uint8
+
+const (
+	// CryptoSuiteUnknown is reported for Crypto implementations which don't identify themselves.
+	CryptoSuiteUnknown CryptoSuite = iota
+
+	// CryptoSuiteDefault identifies DefaultCrypto.
+	CryptoSuiteDefault
+
+	// CryptoSuiteAESGCM identifies AESGCMCrypto.
+	CryptoSuiteAESGCM
+
+	// CryptoSuiteXChaCha20Poly1305 identifies XChaCha20Poly1305Crypto.
+	CryptoSuiteXChaCha20Poly1305
+
+	// CryptoSuiteSignal identifies SignalCrypto.
+	CryptoSuiteSignal
+
+	// CryptoSuiteX448 identifies X448Crypto.
+	CryptoSuiteX448
+)
+
+func (cs CryptoSuite) String() string {
+	switch cs {
+	case CryptoSuiteDefault:
+		return "AES-256-CTR+HMAC-SHA-256"
+	case CryptoSuiteAESGCM:
+		return "AES-256-GCM"
+	case CryptoSuiteXChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	case CryptoSuiteSignal:
+		return "Signal"
+	case CryptoSuiteX448:
+		return "X448"
+	}
+	return fmt.Sprintf("suite %d", uint8(cs))
+}
+
+// SuiteIdentifier is implemented by Crypto implementations which can be identified,
+// for example, when a State is serialized.
+type SuiteIdentifier interface {
+	// Suite returns the identifier of the cryptographic primitives.
+	Suite() CryptoSuite
+}
+
+// suiteOf returns the identifier of c or CryptoSuiteUnknown.
+func suiteOf(c Crypto) CryptoSuite {
+	if si, ok := c.(SuiteIdentifier); ok {
+		return si.Suite()
+	}
+	return CryptoSuiteUnknown
+}
+
+// cryptoForSuite returns a built-in Crypto implementation for cs or nil if there's none.
+func cryptoForSuite(cs CryptoSuite) Crypto {
+	switch cs {
+	case CryptoSuiteDefault:
+		return DefaultCrypto{}
+	case CryptoSuiteAESGCM:
+		return AESGCMCrypto{}
+	case CryptoSuiteXChaCha20Poly1305:
+		return XChaCha20Poly1305Crypto{}
+	case CryptoSuiteSignal:
+		return SignalCrypto{}
+	case CryptoSuiteX448:
+		return X448Crypto{}
+	}
+	return nil
+}
+
+// HeaderAuthenticator is implemented by Crypto implementations which authenticate message headers
+// in their own format. Otherwise the encoded header is appended to the associated data.
+type HeaderAuthenticator interface {
+	// AssociatedData returns the associated data for the message with the header h.
+	AssociatedData(ad []byte, h MessageHeader) []byte
+}
+
+// associatedData returns the associated data for the message with the header h encrypted with c.
+func associatedData(c Crypto, ad []byte, h MessageHeader) []byte {
+	if ha, ok := c.(HeaderAuthenticator); ok {
+		return ha.AssociatedData(ad, h)
+	}
+	return append(ad, h.Encode()...)
+}
+
+// receivedAuthenticator is implemented by Crypto implementations which authenticate messages
+// as they were serialized by the sender rather than a re-encoding of the header.
+type receivedAuthenticator interface {
+	// decryptReceived is Decrypt with the MAC computed over ad followed by the received message.
+	decryptReceived(mk Key, authCiphertext, ad, received []byte) ([]byte, error)
+}
+
+// decryptMessage decrypts m with the message key mk using c.
+func decryptMessage(c Crypto, mk Key, m Message, ad []byte) ([]byte, error) {
+	if ra, ok := c.(receivedAuthenticator); ok && m.received != nil {
+		return ra.decryptReceived(mk, m.Ciphertext, ad, m.received)
+	}
+	return c.Decrypt(mk, m.Ciphertext, associatedData(c, ad, m.Header))
+}
+
 // DHPair is a general interface for DH pairs representation.
 type DHPair interface {
 	PrivateKey() Key
@@ -1,29 +1,143 @@
 package doubleratchet
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
+	"hash"
 	"io"
 
+	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/hkdf"
 )
 
+const (
+	defaultKdfRKInfo          = "rsZUpEuXUqqwXBvSy3EcievAh4cMj6QL"
+	defaultEncryptionKeysInfo = "pcwSByyx2CRdryCffXJwy7xgVZWtW5Sh"
+)
+
 // DefaultCrypto is an implementation of Crypto with cryptographic primitives recommended
 // by the Double Ratchet Algorithm specification. However, some details are different,
 // see function comments for details.
-type DefaultCrypto struct{}
+//
+// The zero value uses the library's own KDF info strings and SHA-256, use NewCrypto
+// to customize them.
+type DefaultCrypto struct {
+	kdfRKInfo          string
+	encryptionKeysInfo string
+	hash               Hash
+}
+
+// Hash identifies the hash function used by the KDFs and the MAC of DefaultCrypto.
+type Hash uint8
+
+const (
+	// HashSHA256 is SHA-256, the default.
+	HashSHA256 Hash = iota
+
+	// HashSHA512 is SHA-512.
+	HashSHA512
+
+	// HashBLAKE2b is BLAKE2b-512.
+	HashBLAKE2b
+)
+
+// cryptoOption is a NewCrypto option.
+type cryptoOption func(*DefaultCrypto) error
+
+// WithKdfRKInfo specifies the HKDF info string of KdfRK. Applications should use their own one
+// to separate their KDF domain from the others.
+// nolint: golint
+func WithKdfRKInfo(info string) cryptoOption {
+	return func(c *DefaultCrypto) error {
+		if info == "" {
+			return fmt.Errorf("info must not be empty")
+		}
+		c.kdfRKInfo = info
+		return nil
+	}
+}
+
+// WithEncryptionKeysInfo specifies the HKDF info string used to derive encryption keys
+// out of message keys.
+// nolint: golint
+func WithEncryptionKeysInfo(info string) cryptoOption {
+	return func(c *DefaultCrypto) error {
+		if info == "" {
+			return fmt.Errorf("info must not be empty")
+		}
+		c.encryptionKeysInfo = info
+		return nil
+	}
+}
+
+// WithHash specifies the hash function of the KDFs and the MAC.
+// nolint: golint
+func WithHash(h Hash) cryptoOption {
+	return func(c *DefaultCrypto) error {
+		if h > HashBLAKE2b {
+			return fmt.Errorf("unknown hash %d", h)
+		}
+		c.hash = h
+		return nil
+	}
+}
+
+// NewCrypto creates DefaultCrypto with the options applied. Without options the result
+// is equal to DefaultCrypto{}.
+func NewCrypto(opts ...cryptoOption) (DefaultCrypto, error) {
+	var c DefaultCrypto
+	for i := range opts {
+		if err := opts[i](&c); err != nil {
+			return DefaultCrypto{}, fmt.Errorf("failed to apply option: %w", err)
+		}
+	}
+	if c.kdfRKInfo == defaultKdfRKInfo {
+		c.kdfRKInfo = ""
+	}
+	if c.encryptionKeysInfo == defaultEncryptionKeysInfo {
+		c.encryptionKeysInfo = ""
+	}
+	return c, nil
+}
+
+// Suite returns CryptoSuiteDefault. Customized instances return CryptoSuiteUnknown as they can't
+// be restored out of the identifier alone and must be passed to Load with WithCrypto.
+func (c DefaultCrypto) Suite() CryptoSuite {
+	if c != (DefaultCrypto{}) {
+		return CryptoSuiteUnknown
+	}
+	return CryptoSuiteDefault
+}
+
+func (c DefaultCrypto) newHash() hash.Hash {
+	switch c.hash {
+	case HashSHA512:
+		return sha512.New()
+	case HashBLAKE2b:
+		h, _ := blake2b.New512(nil) // No error will occur here as there's no key.
+		return h
+	}
+	return sha256.New()
+}
+
+func (c DefaultCrypto) info(info, def string) []byte {
+	if info == "" {
+		return []byte(def)
+	}
+	return []byte(info)
+}
 
 // GenerateDH creates a new Diffie-Hellman key pair.
 func (c DefaultCrypto) GenerateDH() (DHPair, error) {
 	var privKey [32]byte
 	if _, err := io.ReadFull(rand.Reader, privKey[:]); err != nil {
-		return dhPair{}, fmt.Errorf("couldn't generate privKey: %s", err)
+		return dhPair{}, fmt.Errorf("couldn't generate privKey: %w", err)
 	}
 	privKey[0] &= 248
 	privKey[31] &= 127
@@ -40,31 +154,27 @@ func (c DefaultCrypto) GenerateDH() (DHPair, error) {
 // DH returns the output from the Diffie-Hellman calculation between
 // the private key from the DH key pair dhPair and the DH public key dbPub.
 func (c DefaultCrypto) DH(dhPair DHPair, dhPub Key) (Key, error) {
-	var (
-		dhOut   [32]byte
-		privKey [32]byte
-		pubKey  [32]byte
-	)
 	if len(dhPair.PrivateKey()) != 32 {
-		return nil, fmt.Errorf("Invalid private key length: %d", len(dhPair.PrivateKey()))
+		return nil, fmt.Errorf("%w: private key length %d", ErrInvalidKey, len(dhPair.PrivateKey()))
 	}
 
 	if len(dhPub) != 32 {
-		return nil, fmt.Errorf("Invalid private key length: %d", len(dhPair.PrivateKey()))
+		return nil, fmt.Errorf("%w: public key length %d", ErrInvalidKey, len(dhPub))
 	}
 
-	copy(privKey[:], dhPair.PrivateKey()[:32])
-	copy(pubKey[:], dhPub[:32])
-
-	curve25519.ScalarMult(&dhOut, &privKey, &pubKey)
-	return dhOut[:], nil
+	// X25519 rejects low-order public keys which produce the all-zero output.
+	dhOut, err := curve25519.X25519(dhPair.PrivateKey(), dhPub)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidKey, err)
+	}
+	return dhOut, nil
 }
 
 // KdfRK returns a pair (32-byte root key, 32-byte chain key) as the output of applying
 // a KDF keyed by a 32-byte root key rk to a Diffie-Hellman output dhOut.
 func (c DefaultCrypto) KdfRK(rk, dhOut Key) (Key, Key, Key) {
 	var (
-		r   = hkdf.New(sha256.New, dhOut, rk, []byte("rsZUpEuXUqqwXBvSy3EcievAh4cMj6QL"))
+		r   = hkdf.New(c.newHash, dhOut, rk, c.info(c.kdfRKInfo, defaultKdfRKInfo))
 		buf = make([]byte, 96)
 	)
 
@@ -92,7 +202,7 @@ func (c DefaultCrypto) KdfCK(ck Key) (Key, Key) {
 	chainKey := make(Key, 32)
 	msgKey := make(Key, 32)
 
-	h := hmac.New(sha256.New, ck[:])
+	h := hmac.New(c.newHash, ck[:])
 
 	_, _ = h.Write([]byte{ckInput})
 	copy(chainKey[:], h.Sum(nil))
@@ -125,16 +235,22 @@ func (c DefaultCrypto) Encrypt(mk Key, plaintext, ad []byte) ([]byte, error) {
 // Decrypt returns the AEAD decryption of ciphertext with message key mk.
 func (c DefaultCrypto) Decrypt(mk Key, authCiphertext, ad []byte) ([]byte, error) {
 	var (
-		l          = len(authCiphertext)
-		ciphertext = authCiphertext[:l-sha256.Size]
-		signature  = authCiphertext[l-sha256.Size:]
+		l       = len(authCiphertext)
+		macSize = c.newHash().Size()
+	)
+	if l < aes.BlockSize+macSize {
+		return nil, fmt.Errorf("%w: ciphertext is too short", ErrAuthFailed)
+	}
+	var (
+		ciphertext = authCiphertext[:l-macSize]
+		signature  = authCiphertext[l-macSize:]
 	)
 
 	// Check the signature.
 	encKey, authKey, _ := c.deriveEncKeys(mk)
 
-	if s := c.computeSignature(authKey[:], ciphertext, ad); !bytes.Equal(s, signature) {
-		return nil, fmt.Errorf("invalid signature")
+	if s := c.computeSignature(authKey[:], ciphertext, ad); !hmac.Equal(s, signature) {
+		return nil, ErrAuthFailed
 	}
 
 	// Decrypt.
@@ -153,7 +269,7 @@ func (c DefaultCrypto) deriveEncKeys(mk Key) (Key, Key, [16]byte) {
 	// First, derive encryption and authentication key out of mk.
 	salt := make([]byte, 32)
 	var (
-		r   = hkdf.New(sha256.New, mk[:], salt, []byte("pcwSByyx2CRdryCffXJwy7xgVZWtW5Sh"))
+		r   = hkdf.New(c.newHash, mk[:], salt, c.info(c.encryptionKeysInfo, defaultEncryptionKeysInfo))
 		buf = make([]byte, 80)
 	)
 
@@ -172,7 +288,7 @@ func (c DefaultCrypto) deriveEncKeys(mk Key) (Key, Key, [16]byte) {
 }
 
 func (c DefaultCrypto) computeSignature(authKey, ciphertext, associatedData []byte) []byte {
-	h := hmac.New(sha256.New, authKey)
+	h := hmac.New(c.newHash, authKey)
 	_, _ = h.Write(associatedData)
 	_, _ = h.Write(ciphertext)
 	return h.Sum(nil)
@@ -220,3 +220,93 @@ func TestDefaultCrypto_EncryptDecrypt(t *testing.T) {
 		require.EqualError(t, err, "invalid signature")
 	})
 }
+
+func TestDefaultCrypto_Vectors(t *testing.T) {
+	// Arrange.
+	var (
+		rk    = make(Key, 32)
+		dhOut = make(Key, 32)
+	)
+	for i := range rk {
+		rk[i] = byte(i)
+		dhOut[i] = byte(100 + i)
+	}
+
+	for _, c := range []DefaultCrypto{{}, mustNewCrypto(t)} {
+		// Act.
+		newRK, newCK, newHK := c.KdfRK(rk, dhOut)
+		ck, mk := c.KdfCK(rk)
+		encKey, authKey, iv := c.deriveEncKeys(rk)
+
+		// Assert.
+		require.Equal(t, "9886c334da9be4ca91c2d3e11c3648182eabf3652f9ac68f37b6aea513b040cd", newRK.String())
+		require.Equal(t, "1086abb871c6a303ea5fee3267ab6a340dac7f3a85437f0ac943a4fc6e95c58e", newCK.String())
+		require.Equal(t, "4dbb54f197bc5f7e1e7d38ed107c0482de6e9031b20b84747966104d8e1b00a5", newHK.String())
+		require.Equal(t, "6dde541a14a69bc10044abfcd2ef7684cf16590ee0e5f819d9fc504867cf3ea4", ck.String())
+		require.Equal(t, "4c87116c5cd071df1f2c36f25a09654e3c8ec633d1eb7a5cb669d9dfd7e929e7", mk.String())
+		require.Equal(t, "2a2b3f17ad5b0ef80ea38abb1b9a584de4b61f890800864c3287080c691d70ca", encKey.String())
+		require.Equal(t, "9fe775d203299c068ee229f7ae9d93885d2c97d7bb15796e78ca0f2bb7007a51", authKey.String())
+		require.Equal(t, "597f691eecdd2e1fdcf6a09f2b0edb05", Key(iv[:]).String())
+	}
+}
+
+func TestNewCrypto(t *testing.T) {
+	// Arrange.
+	custom := mustNewCrypto(t, WithKdfRKInfo("MyApp root"), WithEncryptionKeysInfo("MyApp message"))
+
+	// Act.
+	defaults := mustNewCrypto(t, WithKdfRKInfo(defaultKdfRKInfo), WithHash(HashSHA256))
+
+	// Assert.
+	require.Equal(t, DefaultCrypto{}, defaults)
+	require.Equal(t, CryptoSuiteDefault, defaults.Suite())
+	require.Equal(t, CryptoSuiteUnknown, custom.Suite())
+
+	rk1, _, _ := custom.KdfRK(sk, sk)
+	rk2, _, _ := defaults.KdfRK(sk, sk)
+	require.NotEqual(t, rk1, rk2)
+
+	ct, err := custom.Encrypt(sk, []byte("1337"), nil)
+	require.NoError(t, err)
+	_, err = defaults.Decrypt(sk, ct, nil)
+	require.NotNil(t, err)
+}
+
+func TestNewCrypto_InvalidOptions(t *testing.T) {
+	for _, opt := range []cryptoOption{WithKdfRKInfo(""), WithEncryptionKeysInfo(""), WithHash(Hash(100))} {
+		// Act.
+		_, err := NewCrypto(opt)
+
+		// Assert.
+		require.NotNil(t, err)
+	}
+}
+
+func TestNewCrypto_Hashes(t *testing.T) {
+	for _, h := range []Hash{HashSHA256, HashSHA512, HashBLAKE2b} {
+		// Arrange.
+		c := mustNewCrypto(t, WithHash(h))
+		bobPair, err := c.GenerateDH()
+		require.NoError(t, err)
+		bob, err := New([]byte("bob"), sk, bobPair, nil, WithCrypto(c))
+		require.NoError(t, err)
+		alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithCrypto(c))
+		require.NoError(t, err)
+
+		// Act.
+		m, err := alice.RatchetEncrypt([]byte("Hi Bob!"), nil)
+		require.NoError(t, err)
+		d, err := bob.RatchetDecrypt(m, nil)
+
+		// Assert.
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hi Bob!"), d)
+		require.Len(t, m.Ciphertext, 16+len("Hi Bob!")+c.newHash().Size())
+	}
+}
+
+func mustNewCrypto(t *testing.T, opts ...cryptoOption) DefaultCrypto {
+	c, err := NewCrypto(opts...)
+	require.NoError(t, err)
+	return c
+}
@@ -0,0 +1,138 @@
+package doubleratchet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSession_DeferredSendRatchet(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithDeferredSendRatchet())
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+	b := bob.(*sessionState)
+
+	// Act.
+	exchange(t, alice, bob, 3)
+
+	// Assert.
+	require.True(t, b.PendingSendRatchet)
+	require.Equal(t, bobPair.PublicKey(), b.DHs.PublicKey())
+
+	m, err := bob.RatchetEncrypt([]byte("reply"), nil)
+	require.NoError(t, err)
+	require.False(t, b.PendingSendRatchet)
+	require.NotEqual(t, bobPair.PublicKey(), m.Header.DH)
+	require.EqualValues(t, 0, m.Header.N)
+
+	d, err := alice.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("reply"), d)
+
+	for i := 0; i < 3; i++ {
+		exchange(t, alice, bob, 2)
+		exchange(t, bob, alice, 2)
+	}
+}
+
+func TestSession_DeferredSendRatchet_OutOfOrder(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithDeferredSendRatchet())
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithDeferredSendRatchet())
+	require.NoError(t, err)
+	exchange(t, alice, bob, 1)
+
+	// Act.
+	b1, err := bob.RatchetEncrypt([]byte("b1"), nil)
+	require.NoError(t, err)
+	b2, err := bob.RatchetEncrypt([]byte("b2"), nil)
+	require.NoError(t, err)
+	d, err := alice.RatchetDecrypt(b2, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b2"), d)
+
+	a1, err := alice.RatchetEncrypt([]byte("a1"), nil)
+	require.NoError(t, err)
+	d, err = bob.RatchetDecrypt(a1, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a1"), d)
+
+	// Assert.
+	require.EqualValues(t, 1, a1.Header.PN)
+
+	d, err = alice.RatchetDecrypt(b1, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b1"), d)
+}
+
+func TestSession_DeferredSendRatchet_PostQuantum(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithPostQuantumRatchet(256), WithDeferredSendRatchet())
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithPostQuantumRatchet(256), WithDeferredSendRatchet())
+	require.NoError(t, err)
+
+	// Act.
+	var mixed []uint32
+	for i := 0; i < 6; i++ {
+		mixed = append(mixed, exchange(t, alice, bob, 5)...)
+		mixed = append(mixed, exchange(t, bob, alice, 5)...)
+	}
+
+	// Assert.
+	require.Contains(t, mixed, uint32(1))
+	require.Contains(t, mixed, uint32(2))
+}
+
+func TestSessionHE_DeferredSendRatchet(t *testing.T) {
+	// Arrange.
+	bob, err := NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil, WithDeferredSendRatchet())
+	require.NoError(t, err)
+	alice, err := NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil, WithDeferredSendRatchet())
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		// Act.
+		m, err := alice.RatchetEncrypt([]byte("Hi Bob!"), nil)
+		require.NoError(t, err)
+		d, err := bob.RatchetDecrypt(m, nil)
+
+		// Assert.
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hi Bob!"), d)
+
+		m, err = bob.RatchetEncrypt([]byte("Hi Alice!"), nil)
+		require.NoError(t, err)
+		d, err = alice.RatchetDecrypt(m, nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hi Alice!"), d)
+	}
+}
+
+func TestState_MarshalBinary_DeferredSendRatchet(t *testing.T) {
+	// Arrange.
+	state, err := newState(sk, WithDeferredSendRatchet())
+	require.NoError(t, err)
+	state.PendingSendRatchet = true
+
+	data, err := state.MarshalBinary()
+	require.NoError(t, err)
+	jsonData, err := state.MarshalJSON()
+	require.NoError(t, err)
+
+	// Act.
+	var decoded, jsonDecoded State
+	err = decoded.UnmarshalBinary(data)
+	require.NoError(t, err)
+	err = jsonDecoded.UnmarshalJSON(jsonData)
+	require.NoError(t, err)
+
+	// Assert.
+	require.True(t, decoded.DeferSendRatchet)
+	require.True(t, decoded.PendingSendRatchet)
+	require.True(t, jsonDecoded.DeferSendRatchet)
+	require.True(t, jsonDecoded.PendingSendRatchet)
+}
@@ -0,0 +1,43 @@
+package doubleratchet
+
+import "errors"
+
+// Errors returned by sessions and DefaultCrypto. They are wrapped with additional context,
+// use errors.Is to check for them.
+var (
+	// ErrTooManySkipped is returned when decrypting a message requires skipping more message
+	// keys than MaxSkip allows. The message may be dropped.
+	ErrTooManySkipped = errors.New("too many messages")
+
+	// ErrMessageKeyDeleted is returned for a message older than the receiving chain which key
+	// isn't stored anymore, i.e. it has been deleted or already used. The message may be dropped.
+	ErrMessageKeyDeleted = errors.New("bad until: probably an out-of-order message that was deleted")
+
+	// ErrAuthFailed is returned when a message or its header fails authentication, i.e. it has been
+	// tampered with, encrypted with another key or belongs to another session.
+	ErrAuthFailed = errors.New("invalid signature")
+
+	// ErrMalformedHeader is returned for headers which can't be decoded or contain invalid values.
+	ErrMalformedHeader = errors.New("malformed header")
+
+	// ErrDuplicateMessage is returned for a message which is known to be decrypted already.
+	// Duplicates are only tracked with WithReplayProtection. Otherwise the key of a decrypted message
+	// is kept until it's confirmed, so a duplicate decrypts again until then and is reported as
+	// ErrMessageKeyDeleted afterwards.
+	ErrDuplicateMessage = errors.New("duplicate message")
+
+	// ErrSuiteMismatch is returned when a ciphertext was produced by another crypto suite,
+	// e.g. by a peer configured differently.
+	ErrSuiteMismatch = errors.New("crypto suite mismatch")
+
+	// ErrUnsupportedVersion is returned for a message sent with a protocol version the session
+	// doesn't support, see WithProtocolVersions.
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+	// ErrVersionDowngrade is returned for a message advertising a lower protocol version than
+	// the peer advertised before.
+	ErrVersionDowngrade = errors.New("protocol version downgrade")
+
+	// ErrInvalidKey is returned for keys of invalid length or value.
+	ErrInvalidKey = errors.New("invalid key")
+)
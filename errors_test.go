@@ -0,0 +1,91 @@
+package doubleratchet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSession_RatchetDecrypt_Errors(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = New([]byte("bob"), sk, bobPair, nil, WithMaxSkip(1))
+		alice, _ = NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	)
+	var ms []Message
+	for i := 0; i < 3; i++ {
+		m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+		require.NoError(t, err)
+		ms = append(ms, m)
+	}
+
+	t.Run("too many skipped", func(t *testing.T) {
+		_, err := bob.RatchetDecrypt(ms[2], nil)
+		require.True(t, errors.Is(err, ErrTooManySkipped), err)
+	})
+
+	t.Run("auth failed", func(t *testing.T) {
+		m := ms[0]
+		m.Ciphertext = append([]byte{}, ms[0].Ciphertext...)
+		m.Ciphertext[20] ^= 1
+
+		_, err := bob.RatchetDecrypt(m, nil)
+		require.True(t, errors.Is(err, ErrAuthFailed), err)
+
+		_, err = bob.RatchetDecrypt(ms[0], []byte("other"))
+		require.True(t, errors.Is(err, ErrAuthFailed), err)
+	})
+
+	t.Run("message key deleted", func(t *testing.T) {
+		_, err := bob.RatchetDecrypt(ms[1], nil)
+		require.NoError(t, err)
+		require.NoError(t, bob.DeleteMk(ms[0].Header.DH, ms[0].Header.N))
+
+		_, err = bob.RatchetDecrypt(ms[0], nil)
+		require.True(t, errors.Is(err, ErrMessageKeyDeleted), err)
+	})
+}
+
+func TestSessionHE_RatchetDecrypt_Errors(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil)
+		alice, _ = NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+	)
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+
+	t.Run("header auth failed", func(t *testing.T) {
+		bad := m
+		bad.Header = append([]byte{}, m.Header...)
+		bad.Header[20] ^= 1
+
+		_, err := bob.RatchetDecrypt(bad, nil)
+		require.True(t, errors.Is(err, ErrAuthFailed), err)
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		_, err := bob.RatchetDecrypt(m, nil)
+		require.NoError(t, err)
+
+		_, err = bob.RatchetDecrypt(m, nil)
+		require.True(t, errors.Is(err, ErrMessageKeyDeleted), err)
+	})
+}
+
+func TestMessageEncHeader_Decode_ErrMalformedHeader(t *testing.T) {
+	// Act.
+	_, err := MessageEncHeader{1, 2, 3}.Decode()
+
+	// Assert.
+	require.True(t, errors.Is(err, ErrMalformedHeader), err)
+}
+
+func TestDefaultCrypto_DH_ErrInvalidKey(t *testing.T) {
+	// Act.
+	_, err := DefaultCrypto{}.DH(bobPair, Key{1, 2, 3})
+
+	// Assert.
+	require.True(t, errors.Is(err, ErrInvalidKey), err)
+}
@@ -0,0 +1,44 @@
+//go:build unix
+
+package doubleratchet
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// FileLocker is a SessionLocker based on advisory locks of files in Dir, one file per session.
+// All processes sharing sessions must use the same directory.
+type FileLocker struct {
+	Dir string
+}
+
+// NewFileLocker creates a locker keeping lock files in dir. The directory is created if needed.
+func NewFileLocker(dir string) (*FileLocker, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("can't create lock directory: %s", err)
+	}
+	return &FileLocker{Dir: dir}, nil
+}
+
+// Lock blocks until the lock file of the session is exclusively locked.
+func (l *FileLocker) Lock(id []byte) (func() error, error) {
+	f, err := os.OpenFile(filepath.Join(l.Dir, hex.EncodeToString(id)+".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return func() error {
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package doubleratchet
+
+import "fmt"
+
+// FileLocker is a SessionLocker based on advisory locks of files in Dir.
+// It's only supported on Unix systems.
+type FileLocker struct {
+	Dir string
+}
+
+// NewFileLocker returns an error as file locks aren't supported on the platform.
+func NewFileLocker(dir string) (*FileLocker, error) {
+	return nil, fmt.Errorf("file locks aren't supported on this platform")
+}
+
+// Lock returns an error as file locks aren't supported on the platform.
+func (l *FileLocker) Lock(id []byte) (func() error, error) {
+	return nil, fmt.Errorf("file locks aren't supported on this platform")
+}
@@ -0,0 +1,156 @@
+package doubleratchet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultCrypto_Decrypt_ShortCiphertext(t *testing.T) {
+	for _, l := range []int{0, 1, 16, 47} {
+		// Act.
+		_, err := DefaultCrypto{}.Decrypt(sk, make([]byte, l), nil)
+
+		// Assert.
+		require.True(t, errors.Is(err, ErrAuthFailed), err)
+	}
+}
+
+func TestDefaultCrypto_DH_LowOrderKey(t *testing.T) {
+	// Act.
+	_, err := DefaultCrypto{}.DH(bobPair, make(Key, 32))
+
+	// Assert.
+	require.True(t, errors.Is(err, ErrInvalidKey), err)
+}
+
+func TestSession_RatchetDecrypt_LowOrderRatchetKey(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil)
+	require.NoError(t, err)
+
+	// Act.
+	h := MessageHeader{Version: ProtocolVersion, MaxVersion: ProtocolVersion, DH: make(Key, 32)}
+	_, err = bob.RatchetDecrypt(Message{Header: h, Ciphertext: make([]byte, 64)}, nil)
+
+	// Assert.
+	require.True(t, errors.Is(err, ErrInvalidKey), err)
+}
+
+func TestSession_RatchetDecrypt_InvalidRatchetKeyLength(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil)
+	require.NoError(t, err)
+
+	// Act.
+	_, err = bob.RatchetDecrypt(Message{Header: MessageHeader{DH: Key{1}}, Ciphertext: make([]byte, 64)}, nil)
+
+	// Assert.
+	require.True(t, errors.Is(err, ErrMalformedHeader), err)
+}
+
+func FuzzDefaultCrypto_Decrypt(f *testing.F) {
+	ct, err := DefaultCrypto{}.Encrypt(sk, []byte("plaintext"), []byte("ad"))
+	require.NoError(f, err)
+	f.Add([]byte(sk), ct, []byte("ad"))
+	f.Add([]byte{}, []byte{}, []byte{})
+
+	f.Fuzz(func(t *testing.T, mk, ct, ad []byte) {
+		_, _ = DefaultCrypto{}.Decrypt(mk, ct, ad)
+	})
+}
+
+func FuzzMessageEncHeader_Decode(f *testing.F) {
+	f.Add([]byte(MessageHeader{DH: bobPair.PublicKey(), N: 1, PN: 2}.Encode()))
+	f.Add([]byte(MessageHeader{
+		DH: bobPair.PublicKey(),
+		PQ: &PQHeader{Epoch: 1, Kind: PQKindEncapsulationKey, Total: 2, Chunk: []byte("chunk")},
+	}.Encode()))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, err := MessageEncHeader(data).Decode()
+		if err != nil {
+			return
+		}
+		decoded, err := h.Encode().Decode()
+		require.NoError(t, err)
+		require.Equal(t, h, decoded)
+	})
+}
+
+func FuzzSession_RatchetDecrypt(f *testing.F) {
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithPostQuantumRatchet(256))
+	require.NoError(f, err)
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(f, err)
+	f.Add([]byte(m.Header.Encode()), m.Ciphertext)
+	f.Add([]byte(MessageHeader{DH: make(Key, 32), N: 1000, PN: 1000}.Encode()), []byte{})
+
+	f.Fuzz(func(t *testing.T, header, ct []byte) {
+		h, err := MessageEncHeader(header).Decode()
+		if err != nil {
+			return
+		}
+		bob, err := New([]byte("bob"), sk, bobPair, nil, WithPostQuantumRatchet(256))
+		require.NoError(t, err)
+
+		_, _ = bob.RatchetDecrypt(Message{Header: h, Ciphertext: ct}, nil)
+	})
+}
+
+func FuzzSessionHE_RatchetDecrypt(f *testing.F) {
+	alice, err := NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+	require.NoError(f, err)
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(f, err)
+	f.Add(m.Header, m.Ciphertext)
+	f.Add([]byte{}, []byte{})
+
+	f.Fuzz(func(t *testing.T, header, ct []byte) {
+		bob, err := NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil)
+		require.NoError(t, err)
+
+		_, _ = bob.RatchetDecrypt(MessageHE{Header: header, Ciphertext: ct}, nil)
+	})
+}
+
+func FuzzSignalMessage_Decode(f *testing.F) {
+	sm, err := NewSignalMessage(Message{Header: MessageHeader{DH: bobPair.PublicKey(), N: 1, PN: 2}, Ciphertext: make([]byte, 24)})
+	require.NoError(f, err)
+	f.Add([]byte(sm))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := SignalMessage(data).Decode()
+		if err != nil {
+			return
+		}
+		_, err = NewSignalMessage(m)
+		require.NoError(t, err)
+	})
+}
+
+func FuzzMessage_UnmarshalBinary(f *testing.F) {
+	data, err := Message{
+		Header:     MessageHeader{DH: bobPair.PublicKey(), N: 1, PQ: &PQHeader{Epoch: 1, Chunk: []byte("chunk")}},
+		Ciphertext: []byte("ciphertext"),
+	}.MarshalBinary()
+	require.NoError(f, err)
+	f.Add(data)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m Message
+		if err := m.UnmarshalBinary(data); err != nil {
+			return
+		}
+		encoded, err := m.MarshalBinary()
+		require.NoError(t, err)
+
+		var decoded Message
+		require.NoError(t, decoded.UnmarshalBinary(encoded))
+		require.Equal(t, m, decoded)
+	})
+}
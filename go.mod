@@ -0,0 +1,19 @@
+module github.com/status-im/doubleratchet
+
+go 1.25.0
+
+require (
+	filippo.io/edwards25519 v1.1.0
+	github.com/cloudflare/circl v1.6.1
+	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/stretchr/testify v1.9.0
+	golang.org/x/crypto v0.54.0
+	google.golang.org/protobuf v1.36.9
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,104 @@
+package doubleratchet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSession_SkippedKeyTTL(t *testing.T) {
+	// Arrange.
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithSkippedKeyTTL(time.Hour), WithClock(clock))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	early, err := alice.RatchetEncrypt([]byte("early"), nil)
+	require.NoError(t, err)
+	late, err := alice.RatchetEncrypt([]byte("late"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(late, nil)
+	require.NoError(t, err)
+
+	// Act.
+	now = now.Add(time.Hour + time.Second)
+	exchange(t, alice, bob, 1)
+
+	// Assert.
+	_, err = bob.RatchetDecrypt(early, nil)
+	require.ErrorIs(t, err, ErrMessageKeyDeleted)
+}
+
+func TestSession_SkippedKeyTTL_NotExpired(t *testing.T) {
+	// Arrange.
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithSkippedKeyTTL(time.Hour), WithClock(clock))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	early, err := alice.RatchetEncrypt([]byte("early"), nil)
+	require.NoError(t, err)
+	exchange(t, alice, bob, 1)
+
+	// Act.
+	now = now.Add(time.Hour - time.Second)
+	exchange(t, alice, bob, 1)
+	d, err := bob.RatchetDecrypt(early, nil)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []byte("early"), d)
+}
+
+func TestSession_SkippedKeyTTL_PendingKeepsCreationTime(t *testing.T) {
+	// Arrange.
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithSkippedKeyTTL(time.Hour), WithClock(clock), WithAtLeastOnceProcessing())
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	early, err := alice.RatchetEncrypt([]byte("early"), nil)
+	require.NoError(t, err)
+	exchange(t, alice, bob, 1)
+	require.NoError(t, bob.ConfirmAll())
+
+	now = now.Add(50 * time.Minute)
+	_, err = bob.RatchetDecrypt(early, nil)
+	require.NoError(t, err)
+
+	// Act.
+	now = now.Add(10*time.Minute + time.Second)
+	exchange(t, alice, bob, 1)
+
+	// Assert.
+	pending, err := bob.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.NotEqual(t, early.Header.N, pending[0].N)
+}
+
+func TestSession_SkippedKeyTTL_KeysStorageWithoutExpiry(t *testing.T) {
+	// Act.
+	_, err := New([]byte("bob"), sk, bobPair, nil, WithKeysStorage(keysStorageOnly{&KeysStorageInMemory{}}), WithSkippedKeyTTL(time.Hour))
+
+	// Assert.
+	require.Error(t, err)
+}
+
+func TestWithSkippedKeyTTL_Invalid(t *testing.T) {
+	// Act.
+	_, err := New([]byte("bob"), sk, bobPair, nil, WithSkippedKeyTTL(0))
+
+	// Assert.
+	require.Error(t, err)
+}
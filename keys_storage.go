@@ -2,8 +2,11 @@ package doubleratchet
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"sort"
+	"sync"
+	"time"
 )
 
 // KeysStorage is an interface of an abstract in-memory or persistent keys storage.
@@ -11,8 +14,9 @@ type KeysStorage interface {
 	// Get returns a message key by the given key and message number.
 	Get(k Key, msgNum uint) (mk Key, ok bool, err error)
 
-	// Put saves the given mk under the specified key and msgNum.
-	Put(sessionID []byte, k Key, msgNum uint, mk Key, keySeqNum uint) error
+	// Put saves the given mk under the specified key and msgNum. createdAt is the time the key
+	// has been derived at.
+	Put(sessionID []byte, k Key, msgNum uint, mk Key, keySeqNum uint, createdAt time.Time) error
 
 	// DeleteMk ensures there's no message key under the specified key and msgNum.
 	DeleteMk(k Key, msgNum uint) error
@@ -26,17 +30,84 @@ type KeysStorage interface {
 	// Count returns number of message keys stored under the specified key.
 	Count(k Key) (uint, error)
 
-	// All returns all the keys
+	// All returns all the keys indexed by fmt.Sprintf("%x", k) and message number.
 	All() (map[string]map[uint]Key, error)
 }
 
-// KeysStorageInMemory is an in-memory message keys storage.
+// ExpiringKeysStorage is a KeysStorage able to delete message keys by their creation time.
+// Sessions require it for WithSkippedKeyTTL.
+type ExpiringKeysStorage interface {
+	KeysStorage
+
+	// DeleteExpiredMks deletes message keys of a session created before the specified time.
+	DeleteExpiredMks(sessionID []byte, createdBefore time.Time) error
+
+	// PruneExpired deletes message keys of all sessions expired by now according to the TTL
+	// the storage is configured with, so that keys of quiet sessions don't outlive it.
+	PruneExpired(now time.Time) error
+}
+
+// ChainKeysStorage is a KeysStorage able to delete all message keys of a receiving chain at once.
+// Storages which don't implement it have the keys of abandoned chains deleted one by one.
+type ChainKeysStorage interface {
+	KeysStorage
+
+	// DeleteChain deletes all message keys stored under the specified key.
+	DeleteChain(k Key) error
+}
+
+// SessionKeysStorage is a KeysStorage able to list the message keys of a single session.
+// Sessions with encrypted headers use it to look up skipped keys, otherwise they go through
+// the keys of all sessions sharing the storage.
+type SessionKeysStorage interface {
+	KeysStorage
+
+	// SessionKeys returns the keys of a session indexed like All.
+	SessionKeys(sessionID []byte) (map[string]map[uint]Key, error)
+}
+
+// sessionKeys returns the message keys of the session, all the stored keys unless ks
+// implements SessionKeysStorage.
+func sessionKeys(ks KeysStorage, sessionID []byte) (map[string]map[uint]Key, error) {
+	if ss, ok := ks.(SessionKeysStorage); ok {
+		return ss.SessionKeys(sessionID)
+	}
+	return ks.All()
+}
+
+// deleteChain deletes all message keys stored under k.
+func deleteChain(ks KeysStorage, k Key) error {
+	if cs, ok := ks.(ChainKeysStorage); ok {
+		return cs.DeleteChain(k)
+	}
+
+	all, err := ks.All()
+	if err != nil {
+		return err
+	}
+	for n := range all[fmt.Sprintf("%x", k)] {
+		if err := ks.DeleteMk(k, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeysStorageInMemory is an in-memory message keys storage implementing PendingKeysStorage,
+// ExpiringKeysStorage, ChainKeysStorage and SessionKeysStorage. It's safe for concurrent use.
 type KeysStorageInMemory struct {
+	// TTL is how long message keys are kept since they are derived, used by PruneExpired.
+	TTL time.Duration
+
+	mu   sync.RWMutex
 	keys map[string]map[uint]InMemoryKey
 }
 
 // Get returns a message key by the given key and message number.
 func (s *KeysStorageInMemory) Get(pubKey Key, msgNum uint) (Key, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	index := fmt.Sprintf("%x", pubKey)
 	if s.keys == nil {
 		return Key{}, false, nil
@@ -56,10 +127,25 @@ type InMemoryKey struct {
 	messageKey Key
 	seqNum     uint
 	sessionID  []byte
+	pending    bool
+	createdAt  time.Time
 }
 
 // Put saves the given mk under the specified key and msgNum.
-func (s *KeysStorageInMemory) Put(sessionID []byte, pubKey Key, msgNum uint, mk Key, seqNum uint) error {
+func (s *KeysStorageInMemory) Put(sessionID []byte, pubKey Key, msgNum uint, mk Key, seqNum uint, createdAt time.Time) error {
+	return s.put(sessionID, pubKey, msgNum, mk, seqNum, createdAt, false)
+}
+
+// PutPending saves the key of the decrypted message, replacing the skipped one if any.
+// The replaced key keeps its creation time.
+func (s *KeysStorageInMemory) PutPending(sessionID []byte, pubKey Key, msgNum uint, mk Key, seqNum uint, createdAt time.Time) error {
+	return s.put(sessionID, pubKey, msgNum, mk, seqNum, createdAt, true)
+}
+
+func (s *KeysStorageInMemory) put(sessionID []byte, pubKey Key, msgNum uint, mk Key, seqNum uint, createdAt time.Time, pending bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	index := fmt.Sprintf("%x", pubKey)
 
 	if s.keys == nil {
@@ -68,16 +154,33 @@ func (s *KeysStorageInMemory) Put(sessionID []byte, pubKey Key, msgNum uint, mk
 	if _, ok := s.keys[index]; !ok {
 		s.keys[index] = make(map[uint]InMemoryKey)
 	}
+	if existing, ok := s.keys[index][msgNum]; ok && pending {
+		createdAt = existing.createdAt
+	}
 	s.keys[index][msgNum] = InMemoryKey{
 		sessionID:  sessionID,
 		messageKey: mk,
 		seqNum:     seqNum,
+		pending:    pending,
+		createdAt:  createdAt,
 	}
 	return nil
 }
 
 // DeleteMk ensures there's no message key under the specified key and msgNum.
 func (s *KeysStorageInMemory) DeleteMk(pubKey Key, msgNum uint) error {
+	return s.delete(pubKey, msgNum, false)
+}
+
+// DeletePending ensures there's no key awaiting confirmation under the specified key and msgNum.
+func (s *KeysStorageInMemory) DeletePending(pubKey Key, msgNum uint) error {
+	return s.delete(pubKey, msgNum, true)
+}
+
+func (s *KeysStorageInMemory) delete(pubKey Key, msgNum uint, onlyPending bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	index := fmt.Sprintf("%x", pubKey)
 
 	if s.keys == nil {
@@ -86,7 +189,7 @@ func (s *KeysStorageInMemory) DeleteMk(pubKey Key, msgNum uint) error {
 	if _, ok := s.keys[index]; !ok {
 		return nil
 	}
-	if _, ok := s.keys[index][msgNum]; !ok {
+	if k, ok := s.keys[index][msgNum]; !ok || onlyPending && !k.pending {
 		return nil
 	}
 	delete(s.keys[index], msgNum)
@@ -96,8 +199,20 @@ func (s *KeysStorageInMemory) DeleteMk(pubKey Key, msgNum uint) error {
 	return nil
 }
 
+// DeleteChain deletes all message keys stored under the specified key.
+func (s *KeysStorageInMemory) DeleteChain(pubKey Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, fmt.Sprintf("%x", pubKey))
+	return nil
+}
+
 // TruncateMks truncates the number of keys to maxKeys.
 func (s *KeysStorageInMemory) TruncateMks(sessionID []byte, maxKeys int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	var seqNos []uint
 	// Collect all seq numbers
 	for _, keys := range s.keys {
@@ -137,6 +252,9 @@ func (s *KeysStorageInMemory) TruncateMks(sessionID []byte, maxKeys int) error {
 
 // DeleteOldMKeys deletes old message keys for a session.
 func (s *KeysStorageInMemory) DeleteOldMks(sessionID []byte, deleteUntilSeqKey uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	for pubKey, keys := range s.keys {
 		for i, inMemoryKey := range keys {
 			if inMemoryKey.seqNum <= deleteUntilSeqKey && bytes.Equal(inMemoryKey.sessionID, sessionID) {
@@ -147,8 +265,103 @@ func (s *KeysStorageInMemory) DeleteOldMks(sessionID []byte, deleteUntilSeqKey u
 	return nil
 }
 
+// DeleteExpiredMks deletes message keys of a session created before the specified time.
+func (s *KeysStorageInMemory) DeleteExpiredMks(sessionID []byte, createdBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteCreatedBefore(sessionID, createdBefore)
+	return nil
+}
+
+// PruneExpired deletes message keys of all sessions created more than TTL before now.
+func (s *KeysStorageInMemory) PruneExpired(now time.Time) error {
+	if s.TTL <= 0 {
+		return fmt.Errorf("TTL isn't set")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteCreatedBefore(nil, now.Add(-s.TTL))
+	return nil
+}
+
+// deleteCreatedBefore deletes keys created before t, of all sessions if sessionID is nil.
+func (s *KeysStorageInMemory) deleteCreatedBefore(sessionID []byte, t time.Time) {
+	for pubKey, keys := range s.keys {
+		for i, inMemoryKey := range keys {
+			if inMemoryKey.createdAt.Before(t) && (sessionID == nil || bytes.Equal(inMemoryKey.sessionID, sessionID)) {
+				delete(s.keys[pubKey], i)
+			}
+		}
+		if len(keys) == 0 {
+			delete(s.keys, pubKey)
+		}
+	}
+}
+
+// DeleteOldKeys deletes keys of the given state up to the specified sequence number for a session.
+func (s *KeysStorageInMemory) DeleteOldKeys(sessionID []byte, state KeyState, deleteUntilSeqKey uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := state == KeyPending
+	for pubKey, keys := range s.keys {
+		for i, inMemoryKey := range keys {
+			if inMemoryKey.pending == pending && inMemoryKey.seqNum <= deleteUntilSeqKey && bytes.Equal(inMemoryKey.sessionID, sessionID) {
+				delete(s.keys[pubKey], i)
+			}
+		}
+	}
+	return nil
+}
+
+// Pending returns decrypted messages of a session awaiting confirmation, the oldest first.
+func (s *KeysStorageInMemory) Pending(sessionID []byte) ([]PendingMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	type pendingKey struct {
+		seqNum uint
+		msg    PendingMessage
+	}
+	var keys []pendingKey
+	for pubKey, msgs := range s.keys {
+		for n, inMemoryKey := range msgs {
+			if !inMemoryKey.pending || !bytes.Equal(inMemoryKey.sessionID, sessionID) {
+				continue
+			}
+			k, err := keyFromIndex(pubKey)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, pendingKey{seqNum: inMemoryKey.seqNum, msg: PendingMessage{DH: k, N: uint32(n)}})
+		}
+	}
+
+	// Keys sharing a sequence number are ordered by the key and the message number.
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].seqNum != keys[j].seqNum {
+			return keys[i].seqNum < keys[j].seqNum
+		}
+		if c := bytes.Compare(keys[i].msg.DH, keys[j].msg.DH); c != 0 {
+			return c < 0
+		}
+		return keys[i].msg.N < keys[j].msg.N
+	})
+	response := make([]PendingMessage, 0, len(keys))
+	for _, k := range keys {
+		response = append(response, k.msg)
+	}
+	return response, nil
+}
+
 // Count returns number of message keys stored under the specified key.
 func (s *KeysStorageInMemory) Count(pubKey Key) (uint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	index := fmt.Sprintf("%x", pubKey)
 	if s.keys == nil {
 		return 0, nil
@@ -158,6 +371,9 @@ func (s *KeysStorageInMemory) Count(pubKey Key) (uint, error) {
 
 // All returns all the keys
 func (s *KeysStorageInMemory) All() (map[string]map[uint]Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	response := make(map[string]map[uint]Key)
 
 	for pubKey, keys := range s.keys {
@@ -169,3 +385,33 @@ func (s *KeysStorageInMemory) All() (map[string]map[uint]Key, error) {
 
 	return response, nil
 }
+
+// SessionKeys returns the keys of a session indexed like All.
+func (s *KeysStorageInMemory) SessionKeys(sessionID []byte) (map[string]map[uint]Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	response := make(map[string]map[uint]Key)
+	for pubKey, keys := range s.keys {
+		for n, key := range keys {
+			if !bytes.Equal(key.sessionID, sessionID) {
+				continue
+			}
+			if _, ok := response[pubKey]; !ok {
+				response[pubKey] = make(map[uint]Key)
+			}
+			response[pubKey][n] = key.messageKey
+		}
+	}
+	return response, nil
+}
+
+// keyFromIndex reverses the fmt.Sprintf("%x", k) index used by KeysStorage.All.
+// As Key implements fmt.Stringer, the index is a hex encoding of the hex string.
+func keyFromIndex(index string) (Key, error) {
+	str, err := hex.DecodeString(index)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(string(str))
+}
@@ -3,6 +3,7 @@ package doubleratchet
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -30,7 +31,7 @@ func TestKeysStorageInMemory_Put(t *testing.T) {
 	ks := &KeysStorageInMemory{}
 
 	// Act and assert.
-	err := ks.Put([]byte("session-id"), pubKey1, 0, mk, 1)
+	err := ks.Put([]byte("session-id"), pubKey1, 0, mk, 1, time.Now())
 	require.NoError(t, err)
 }
 
@@ -61,7 +62,7 @@ func TestKeysStorageInMemory_Flow(t *testing.T) {
 
 	t.Run("put and get existing", func(t *testing.T) {
 		// Act.
-		err := ks.Put([]byte("session-id"), pubKey1, 0, mk, 1)
+		err := ks.Put([]byte("session-id"), pubKey1, 0, mk, 1, time.Now())
 		require.NoError(t, err)
 
 		k, ok, err := ks.Get(pubKey1, 0)
@@ -135,3 +136,107 @@ func TestKeysStorageInMemory_Flow(t *testing.T) {
 		require.EqualValues(t, 0, cnt)
 	})
 }
+
+func TestKeysStorageInMemory_DeleteExpiredMks(t *testing.T) {
+	// Arrange.
+	var (
+		ks  = &KeysStorageInMemory{}
+		now = time.Now()
+	)
+	require.NoError(t, ks.Put([]byte("session-1"), pubKey1, 0, mk, 0, now.Add(-2*time.Hour)))
+	require.NoError(t, ks.Put([]byte("session-1"), pubKey1, 1, mk, 1, now))
+	require.NoError(t, ks.Put([]byte("session-2"), pubKey2, 0, mk, 0, now.Add(-2*time.Hour)))
+
+	// Act.
+	err := ks.DeleteExpiredMks([]byte("session-1"), now.Add(-time.Hour))
+
+	// Assert.
+	require.NoError(t, err)
+	_, ok, err := ks.Get(pubKey1, 0)
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, ok, err = ks.Get(pubKey1, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, ok, err = ks.Get(pubKey2, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestKeysStorageInMemory_PruneExpired(t *testing.T) {
+	// Arrange.
+	var (
+		ks  = &KeysStorageInMemory{TTL: time.Hour}
+		now = time.Now()
+	)
+	require.NoError(t, ks.Put([]byte("session-1"), pubKey1, 0, mk, 0, now.Add(-2*time.Hour)))
+	require.NoError(t, ks.Put([]byte("session-2"), pubKey2, 0, mk, 0, now.Add(-2*time.Hour)))
+	require.NoError(t, ks.Put([]byte("session-2"), pubKey2, 1, mk, 1, now))
+
+	// Act.
+	err := ks.PruneExpired(now)
+
+	// Assert.
+	require.NoError(t, err)
+	all, err := ks.All()
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	require.Len(t, all[fmt.Sprintf("%x", pubKey2)], 1)
+}
+
+func TestKeysStorageInMemory_PruneExpired_NoTTL(t *testing.T) {
+	// Act.
+	err := (&KeysStorageInMemory{}).PruneExpired(time.Now())
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+func TestKeysStorageInMemory_PutPending_KeepsCreationTime(t *testing.T) {
+	// Arrange.
+	var (
+		ks  = &KeysStorageInMemory{TTL: time.Hour}
+		now = time.Now()
+	)
+	require.NoError(t, ks.Put([]byte("session-1"), pubKey1, 0, mk, 0, now.Add(-2*time.Hour)))
+
+	// Act.
+	err := ks.PutPending([]byte("session-1"), pubKey1, 0, mk, 1, now)
+
+	// Assert.
+	require.NoError(t, err)
+	require.NoError(t, ks.PruneExpired(now))
+	_, ok, err := ks.Get(pubKey1, 0)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestKeysStorageInMemory_Pending_SharedSeqNum(t *testing.T) {
+	// Arrange.
+	ks := &KeysStorageInMemory{}
+	require.NoError(t, ks.PutPending([]byte("session-1"), pubKey2, 0, mk, 1, time.Now()))
+	require.NoError(t, ks.PutPending([]byte("session-1"), pubKey1, 1, mk, 1, time.Now()))
+	require.NoError(t, ks.PutPending([]byte("session-1"), pubKey1, 0, mk, 0, time.Now()))
+
+	// Act.
+	pending, err := ks.Pending([]byte("session-1"))
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []PendingMessage{{DH: pubKey1, N: 0}, {DH: pubKey1, N: 1}, {DH: pubKey2, N: 0}}, pending)
+}
+
+func TestKeysStorageInMemory_SessionKeys(t *testing.T) {
+	// Arrange.
+	ks := &KeysStorageInMemory{}
+	require.NoError(t, ks.Put([]byte("session-1"), pubKey1, 0, mk, 0, time.Now()))
+	require.NoError(t, ks.PutPending([]byte("session-1"), pubKey1, 1, mk, 1, time.Now()))
+	require.NoError(t, ks.Put([]byte("session-2"), pubKey2, 0, mk, 0, time.Now()))
+
+	// Act.
+	keys, err := ks.SessionKeys([]byte("session-1"))
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, map[string]map[uint]Key{fmt.Sprintf("%x", pubKey1): {0: mk, 1: mk}}, keys)
+}
@@ -15,10 +15,23 @@ type MessageHE struct {
 type Message struct {
 	Header     MessageHeader `json:"header"`
 	Ciphertext []byte        `json:"ciphertext"`
+
+	// received is the serialized message the MAC was computed over by the sender,
+	// set for wire formats authenticated as received, see SignalMessage.
+	received []byte
 }
 
 // MessageHeader that is prepended to every message.
 type MessageHeader struct {
+	// Version is the protocol version the message is sent with.
+	Version uint8 `json:"version"`
+
+	// MaxVersion is the highest protocol version supported by the sender.
+	MaxVersion uint8 `json:"max_version"`
+
+	// Suite identifies the crypto of the sender, CryptoSuiteUnknown if it can't be identified.
+	Suite CryptoSuite `json:"suite"`
+
 	// DHr is the sender's current ratchet public key.
 	DH Key `json:"dh"`
 
@@ -27,30 +40,82 @@ type MessageHeader struct {
 
 	// PN is the length of the previous sending chain.
 	PN uint32 `json:"pn"`
+
+	// PQ is set only by sessions with the sparse post-quantum ratchet.
+	PQ *PQHeader `json:"pq,omitempty"`
 }
 
 // Encode the header in the binary format.
+// The header starts with the versions and the suite, the DH key is prefixed with its length,
+// so that keys of any curve fit in. The post-quantum part, if any, is appended after the key.
 func (mh MessageHeader) Encode() MessageEncHeader {
-	buf := make([]byte, 8)
-	binary.LittleEndian.PutUint32(buf[0:4], mh.N)
-	binary.LittleEndian.PutUint32(buf[4:8], mh.PN)
-	return append(buf, mh.DH[:]...)
+	buf := make([]byte, 12, 12+len(mh.DH))
+	buf[0] = mh.Version
+	buf[1] = mh.MaxVersion
+	buf[2] = byte(mh.Suite)
+	binary.LittleEndian.PutUint32(buf[3:7], mh.N)
+	binary.LittleEndian.PutUint32(buf[7:11], mh.PN)
+	buf[11] = byte(len(mh.DH))
+	buf = append(buf, mh.DH[:]...)
+	if mh.PQ == nil {
+		return buf
+	}
+
+	// epoch (4 bytes) + mixed epoch (4 bytes) + kind (1 byte) + index (2 bytes) + total (2 bytes)
+	// + chunk length (2 bytes) + chunk
+	pq := make([]byte, pqHeaderSize)
+	binary.LittleEndian.PutUint32(pq[0:4], mh.PQ.Epoch)
+	binary.LittleEndian.PutUint32(pq[4:8], mh.PQ.MixedEpoch)
+	pq[8] = mh.PQ.Kind
+	binary.LittleEndian.PutUint16(pq[9:11], mh.PQ.Index)
+	binary.LittleEndian.PutUint16(pq[11:13], mh.PQ.Total)
+	binary.LittleEndian.PutUint16(pq[13:15], uint16(len(mh.PQ.Chunk)))
+	buf = append(buf, pq...)
+	return append(buf, mh.PQ.Chunk...)
 }
 
+// pqHeaderSize is the size of the encoded post-quantum part of the header without the chunk.
+const pqHeaderSize = 15
+
 // MessageEncHeader is a binary-encoded representation of a message header.
 type MessageEncHeader []byte
 
 // Decode message header out of the binary-encoded representation.
 func (mh MessageEncHeader) Decode() (MessageHeader, error) {
-	// n (4 bytes) + pn (4 bytes) + dh (32 bytes)
-	if len(mh) != 40 {
-		return MessageHeader{}, fmt.Errorf("encoded message header must be 40 bytes, %d given", len(mh))
-	}
-	var dh Key = make(Key, 32)
-	copy(dh[:], mh[8:40])
-	return MessageHeader{
-		DH: dh,
-		N:  binary.LittleEndian.Uint32(mh[0:4]),
-		PN: binary.LittleEndian.Uint32(mh[4:8]),
-	}, nil
+	// version (1 byte) + max version (1 byte) + suite (1 byte) + n (4 bytes) + pn (4 bytes)
+	// + dh length (1 byte) + dh
+	if len(mh) < 12 || mh[11] == 0 || len(mh) < 12+int(mh[11]) {
+		return MessageHeader{}, fmt.Errorf("%w: encoded message header is too short, %d bytes given", ErrMalformedHeader, len(mh))
+	}
+	end := 12 + int(mh[11])
+	if len(mh) != end && len(mh) < end+pqHeaderSize {
+		return MessageHeader{}, fmt.Errorf("%w: post-quantum header is too short, %d bytes given", ErrMalformedHeader, len(mh)-end)
+	}
+	h := MessageHeader{
+		Version:    mh[0],
+		MaxVersion: mh[1],
+		Suite:      CryptoSuite(mh[2]),
+		DH:         append(Key{}, mh[12:end]...),
+		N:          binary.LittleEndian.Uint32(mh[3:7]),
+		PN:         binary.LittleEndian.Uint32(mh[7:11]),
+	}
+	if len(mh) == end {
+		return h, nil
+	}
+
+	pq := mh[end:]
+	if n := int(binary.LittleEndian.Uint16(pq[13:15])); len(pq) != pqHeaderSize+n {
+		return MessageHeader{}, fmt.Errorf("%w: post-quantum chunk must be %d bytes, %d given", ErrMalformedHeader, n, len(pq)-pqHeaderSize)
+	}
+	h.PQ = &PQHeader{
+		Epoch:      binary.LittleEndian.Uint32(pq[0:4]),
+		MixedEpoch: binary.LittleEndian.Uint32(pq[4:8]),
+		Kind:       pq[8],
+		Index:      binary.LittleEndian.Uint16(pq[9:11]),
+		Total:      binary.LittleEndian.Uint16(pq[11:13]),
+	}
+	if len(pq) > pqHeaderSize {
+		h.PQ.Chunk = append([]byte{}, pq[pqHeaderSize:]...)
+	}
+	return h, nil
 }
@@ -0,0 +1,192 @@
+package doubleratchet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MessageEncodingVersion is the version of the binary Message and MessageHE encodings.
+// It's the first byte of both of them.
+const MessageEncodingVersion = 1
+
+// pqSectionMarker starts the optional post-quantum section of the Message encoding.
+const pqSectionMarker = 1
+
+// MarshalBinary encodes the message as the encoding version byte, the protocol versions and
+// the suite bytes, uvarint N and PN, the length-prefixed DH key and ciphertext. The post-quantum
+// header, if any, follows as a marked section of uvarints and the length-prefixed chunk.
+func (m Message) MarshalBinary() ([]byte, error) {
+	buf := []byte{MessageEncodingVersion, m.Header.Version, m.Header.MaxVersion, byte(m.Header.Suite)}
+	buf = binary.AppendUvarint(buf, uint64(m.Header.N))
+	buf = binary.AppendUvarint(buf, uint64(m.Header.PN))
+	buf = appendBytes(buf, m.Header.DH)
+	buf = appendBytes(buf, m.Ciphertext)
+
+	if pq := m.Header.PQ; pq != nil {
+		buf = append(buf, pqSectionMarker)
+		for _, x := range []uint64{uint64(pq.Epoch), uint64(pq.MixedEpoch), uint64(pq.Kind), uint64(pq.Index), uint64(pq.Total)} {
+			buf = binary.AppendUvarint(buf, x)
+		}
+		buf = appendBytes(buf, pq.Chunk)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the message encoded with MarshalBinary.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	r, err := newMessageReader(data)
+	if err != nil {
+		return err
+	}
+
+	var decoded Message
+	decoded.Header.Version = r.byte()
+	decoded.Header.MaxVersion = r.byte()
+	decoded.Header.Suite = CryptoSuite(r.byte())
+	decoded.Header.N = r.uint32()
+	decoded.Header.PN = r.uint32()
+	decoded.Header.DH = r.bytes()
+	decoded.Ciphertext = r.bytes()
+
+	if r.err == nil && len(r.data) > 0 {
+		if marker := r.byte(); marker != pqSectionMarker && r.err == nil {
+			r.err = fmt.Errorf("unknown section %d", marker)
+		}
+		decoded.Header.PQ = &PQHeader{
+			Epoch:      r.uint32(),
+			MixedEpoch: r.uint32(),
+			Kind:       r.uint8(),
+			Index:      r.uint16(),
+			Total:      r.uint16(),
+			Chunk:      r.bytes(),
+		}
+	}
+	if err := r.finish(); err != nil {
+		return err
+	}
+	if len(decoded.Header.DH) == 0 {
+		return fmt.Errorf("%w: DH key is missing", ErrMalformedHeader)
+	}
+
+	*m = decoded
+	return nil
+}
+
+// MarshalBinary encodes the message as the version byte, the length-prefixed encrypted header
+// and ciphertext.
+func (m MessageHE) MarshalBinary() ([]byte, error) {
+	buf := []byte{MessageEncodingVersion}
+	buf = appendBytes(buf, m.Header)
+	return appendBytes(buf, m.Ciphertext), nil
+}
+
+// UnmarshalBinary decodes the message encoded with MarshalBinary.
+func (m *MessageHE) UnmarshalBinary(data []byte) error {
+	r, err := newMessageReader(data)
+	if err != nil {
+		return err
+	}
+
+	var decoded MessageHE
+	decoded.Header = r.bytes()
+	decoded.Ciphertext = r.bytes()
+	if err := r.finish(); err != nil {
+		return err
+	}
+
+	*m = decoded
+	return nil
+}
+
+func appendBytes(buf, v []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+// messageReader reads values of the binary message encodings. The first error is kept
+// and the following reads return zero values.
+type messageReader struct {
+	data []byte
+	err  error
+}
+
+func newMessageReader(data []byte) (*messageReader, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: message encoding is empty", ErrMalformedHeader)
+	}
+	if data[0] != MessageEncodingVersion {
+		return nil, fmt.Errorf("%w: unsupported message encoding version %d", ErrMalformedHeader, data[0])
+	}
+	return &messageReader{data: data[1:]}, nil
+}
+
+func (r *messageReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) == 0 {
+		r.err = fmt.Errorf("unexpected end of message")
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *messageReader) uvarint(max uint64) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("malformed varint")
+		return 0
+	}
+	if x > max {
+		r.err = fmt.Errorf("value %d is out of range", x)
+		return 0
+	}
+	r.data = r.data[n:]
+	return x
+}
+
+func (r *messageReader) uint32() uint32 {
+	return uint32(r.uvarint(1<<32 - 1))
+}
+
+func (r *messageReader) uint16() uint16 {
+	return uint16(r.uvarint(1<<16 - 1))
+}
+
+func (r *messageReader) uint8() uint8 {
+	return uint8(r.uvarint(1<<8 - 1))
+}
+
+func (r *messageReader) bytes() []byte {
+	if r.err != nil {
+		return nil
+	}
+	l, n := binary.Uvarint(r.data)
+	if n <= 0 || l > uint64(len(r.data)-n) {
+		r.err = fmt.Errorf("malformed length")
+		return nil
+	}
+	r.data = r.data[n:]
+	if l == 0 {
+		return nil
+	}
+	v := append([]byte{}, r.data[:l]...)
+	r.data = r.data[l:]
+	return v
+}
+
+// finish returns the first error, if any, or an error if there are bytes left.
+func (r *messageReader) finish() error {
+	if r.err == nil && len(r.data) > 0 {
+		r.err = fmt.Errorf("%d trailing bytes", len(r.data))
+	}
+	if r.err != nil {
+		return fmt.Errorf("%w: malformed message: %s", ErrMalformedHeader, r.err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package doubleratchet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage_MarshalBinary_RoundTrip(t *testing.T) {
+	cases := map[string]Message{
+		"classic": {
+			Header:     MessageHeader{DH: bobPair.PublicKey(), N: 300, PN: 1 << 31},
+			Ciphertext: []byte("ciphertext"),
+		},
+		"post-quantum": {
+			Header: MessageHeader{
+				DH: bobPair.PublicKey(),
+				N:  1,
+				PQ: &PQHeader{Epoch: 3, MixedEpoch: 2, Kind: PQKindCiphertext, Index: 1, Total: 5, Chunk: []byte("chunk")},
+			},
+			Ciphertext: []byte("ciphertext"),
+		},
+	}
+	for name, m := range cases {
+		t.Run(name, func(t *testing.T) {
+			// Act.
+			data, err := m.MarshalBinary()
+			require.NoError(t, err)
+
+			var decoded Message
+			err = decoded.UnmarshalBinary(data)
+
+			// Assert.
+			require.NoError(t, err)
+			require.EqualValues(t, MessageEncodingVersion, data[0])
+			require.Equal(t, m, decoded)
+		})
+	}
+}
+
+func TestMessage_MarshalBinary_Layout(t *testing.T) {
+	// Arrange.
+	m := Message{Header: MessageHeader{Version: 1, MaxVersion: 2, Suite: CryptoSuiteAESGCM, DH: Key{0xaa, 0xbb}, N: 1, PN: 300}, Ciphertext: []byte{0xcc}}
+
+	// Act.
+	data, err := m.MarshalBinary()
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []byte{MessageEncodingVersion, 0x01, 0x02, byte(CryptoSuiteAESGCM), 0x01, 0xac, 0x02, 0x02, 0xaa, 0xbb, 0x01, 0xcc}, data)
+}
+
+func TestMessage_UnmarshalBinary_Malformed(t *testing.T) {
+	// Arrange.
+	valid, err := Message{
+		Header:     MessageHeader{DH: bobPair.PublicKey(), N: 1, PQ: &PQHeader{Epoch: 1, Chunk: []byte("chunk")}},
+		Ciphertext: []byte("ciphertext"),
+	}.MarshalBinary()
+	require.NoError(t, err)
+
+	cases := map[string][]byte{
+		"empty":           nil,
+		"version":         append([]byte{2}, valid[1:]...),
+		"truncated":       valid[:len(valid)-1],
+		"trailing":        append(append([]byte{}, valid...), 0),
+		"no DH":           {MessageEncodingVersion, 1, 1, 1, 0, 0, 0, 0},
+		"counter range":   {MessageEncodingVersion, 1, 1, 1, 0xff, 0xff, 0xff, 0xff, 0x7f, 0, 1, 1, 0},
+		"unknown section": append(append([]byte{}, valid[:4+1+1+1+32+1+10]...), 7),
+		"length":          {MessageEncodingVersion, 1, 1, 1, 0, 0, 0xff, 0xff, 0xff, 0xff, 0x0f},
+	}
+	for name, data := range cases {
+		// Act.
+		var m Message
+		err := m.UnmarshalBinary(data)
+
+		// Assert.
+		require.True(t, errors.Is(err, ErrMalformedHeader), "%s: %v", name, err)
+		require.Equal(t, Message{}, m)
+	}
+}
+
+func TestMessageHE_MarshalBinary_RoundTrip(t *testing.T) {
+	// Arrange.
+	alice, err := NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+	bob, err := NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil)
+	require.NoError(t, err)
+	m, err := alice.RatchetEncrypt([]byte("Hi Bob!"), nil)
+	require.NoError(t, err)
+
+	// Act.
+	data, err := m.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded MessageHE
+	err = decoded.UnmarshalBinary(data)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, m, decoded)
+	require.Len(t, data, 1+1+len(m.Header)+1+len(m.Ciphertext))
+
+	d, err := bob.RatchetDecrypt(decoded, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi Bob!"), d)
+
+	err = decoded.UnmarshalBinary(data[:len(data)-1])
+	require.True(t, errors.Is(err, ErrMalformedHeader), err)
+}
@@ -32,3 +32,21 @@ func TestMessageEncHeader_Decode(t *testing.T) {
 	// Assert.
 	require.NotNil(t, err)
 }
+
+func TestMessageHeader_Encode_LengthPrefixedDH(t *testing.T) {
+	// Arrange.
+	mh := MessageHeader{DH: make(Key, 56), N: 1, PN: 2}
+
+	// Act.
+	encoded := mh.Encode()
+	decoded, err := encoded.Decode()
+
+	// Assert.
+	require.NoError(t, err)
+	require.Len(t, encoded, 1+1+1+4+4+1+56)
+	require.EqualValues(t, 56, encoded[11])
+	require.Equal(t, mh, decoded)
+
+	_, err = encoded[:40].Decode()
+	require.NotNil(t, err)
+}
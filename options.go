@@ -1,6 +1,9 @@
 package doubleratchet
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // option is a constructor option.
 type option func(*State) error
@@ -29,6 +32,38 @@ func WithMaxKeep(n int) option {
 	}
 }
 
+// WithMaxKeepSteps specifies how many DH ratchet steps skipped keys of a receiving chain are kept
+// after the chain is replaced by a newer one. Zero keeps them until MaxKeep or MaxMessageKeysPerSession
+// prune them.
+// nolint: golint
+func WithMaxKeepSteps(n int) option {
+	return func(s *State) error {
+		if n < 0 {
+			return fmt.Errorf("n must be non-negative")
+		}
+		s.MaxKeepSteps = uint(n)
+		if n == 0 {
+			s.SkippedChains = nil
+		}
+		return nil
+	}
+}
+
+// WithMaxKeepPending specifies how long we keep keys of decrypted messages awaiting confirmation,
+// counted in number of messages received. Applications confirming messages right after processing
+// can set it lower than MaxKeep to get forward secrecy back sooner. The keys storage must
+// implement PendingKeysStorage.
+// nolint: golint
+func WithMaxKeepPending(n int) option {
+	return func(s *State) error {
+		if n < 0 {
+			return fmt.Errorf("n must be non-negative")
+		}
+		s.MaxKeepPending = uint(n)
+		return nil
+	}
+}
+
 // WithMaxMessageKeysPerSession specifies the maximum number of message keys per session
 // nolint: golint
 func WithMaxMessageKeysPerSession(n int) option {
@@ -67,3 +102,108 @@ func WithCrypto(c Crypto) option {
 		return nil
 	}
 }
+
+// WithPostQuantumRatchet enables the sparse post-quantum ratchet for Session: ML-KEM-768
+// encapsulation keys and ciphertexts are exchanged in message headers, split into chunks of
+// at most chunkSize bytes, and their shared secrets are periodically mixed into the root key.
+// Both parties must enable it when creating sessions, it has no effect on SessionHE.
+// nolint: golint
+func WithPostQuantumRatchet(chunkSize int) option {
+	return func(s *State) error {
+		if chunkSize <= 0 {
+			return fmt.Errorf("chunkSize must be positive")
+		}
+		s.PQ.Enabled = true
+		s.PQ.ChunkSize = chunkSize
+		return nil
+	}
+}
+
+// WithSessionLocker specifies the locker serializing changes of the session shared by several
+// processes. The session must have a storage.
+// nolint: golint
+func WithSessionLocker(l SessionLocker) option {
+	return func(s *State) error {
+		if l == nil {
+			return fmt.Errorf("SessionLocker mustn't be nil")
+		}
+		s.Locker = l
+		return nil
+	}
+}
+
+// WithDeferredSendRatchet postpones generation of a new ratchet key pair and sending chain
+// after a received DH ratchet step until the next message is sent. It saves a key pair generation
+// and two DH calculations per step on sessions which mostly receive, e.g. broadcast channels.
+// nolint: golint
+func WithDeferredSendRatchet() option {
+	return func(s *State) error {
+		s.DeferSendRatchet = true
+		return nil
+	}
+}
+
+// WithProtocolVersions specifies the range of protocol versions the session accepts. Messages are
+// sent with the highest version supported by both parties once the other party advertises its versions.
+// nolint: golint
+func WithProtocolVersions(min, max uint8) option {
+	return func(s *State) error {
+		if min == 0 || max < min {
+			return fmt.Errorf("invalid protocol versions range %d-%d", min, max)
+		}
+		s.MinVersion, s.MaxVersion = min, max
+		return nil
+	}
+}
+
+// WithReplayProtection makes sessions remember the last window decrypted messages and reject
+// their replays with ErrDuplicateMessage. Keys of decrypted messages are deleted right away
+// unless WithAtLeastOnceProcessing is specified.
+// nolint: golint
+func WithReplayProtection(window int) option {
+	return func(s *State) error {
+		if window <= 0 {
+			return fmt.Errorf("replay window must be positive")
+		}
+		s.Replay.Size = window
+		return nil
+	}
+}
+
+// WithAtLeastOnceProcessing keeps the key of a decrypted message until DeleteMk is called,
+// so that the message can be decrypted again if the application fails to process it.
+// Replays are rejected once the key is deleted. Only makes a difference together with
+// WithReplayProtection, header-encrypted sessions always delete used keys.
+// nolint: golint
+func WithAtLeastOnceProcessing() option {
+	return func(s *State) error {
+		s.Replay.AtLeastOnce = true
+		return nil
+	}
+}
+
+// WithSkippedKeyTTL specifies how long message keys are kept since they are derived. Expired keys
+// are deleted whenever the session stores keys, use PruneExpired of the storage to delete them
+// in quiet sessions. The keys storage must implement ExpiringKeysStorage.
+// nolint: golint
+func WithSkippedKeyTTL(ttl time.Duration) option {
+	return func(s *State) error {
+		if ttl <= 0 {
+			return fmt.Errorf("ttl must be positive")
+		}
+		s.SkippedKeyTTL = ttl
+		return nil
+	}
+}
+
+// WithClock replaces time.Now used to timestamp and expire message keys.
+// nolint: golint
+func WithClock(now func() time.Time) option {
+	return func(s *State) error {
+		if now == nil {
+			return fmt.Errorf("clock mustn't be nil")
+		}
+		s.Clock = now
+		return nil
+	}
+}
@@ -0,0 +1,82 @@
+// Package pb provides the protobuf encoding of Double Ratchet messages for transports
+// which prefer a schema shared across languages, see message.proto.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative message.proto
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/status-im/doubleratchet"
+)
+
+// FromMessage converts the message of a Session.
+func FromMessage(m doubleratchet.Message) *Message {
+	h := &MessageHeader{
+		Dh:         m.Header.DH,
+		N:          m.Header.N,
+		Pn:         m.Header.PN,
+		Version:    uint32(m.Header.Version),
+		MaxVersion: uint32(m.Header.MaxVersion),
+		Suite:      uint32(m.Header.Suite),
+	}
+	if pq := m.Header.PQ; pq != nil {
+		h.Pq = &PQHeader{
+			Epoch:      pq.Epoch,
+			MixedEpoch: pq.MixedEpoch,
+			Kind:       uint32(pq.Kind),
+			Index:      uint32(pq.Index),
+			Total:      uint32(pq.Total),
+			Chunk:      pq.Chunk,
+		}
+	}
+	return &Message{Header: h, Ciphertext: m.Ciphertext}
+}
+
+// ToMessage converts m back to the message of a Session.
+func (m *Message) ToMessage() (doubleratchet.Message, error) {
+	h := m.GetHeader()
+	if len(h.GetDh()) == 0 {
+		return doubleratchet.Message{}, fmt.Errorf("%w: DH key is missing", doubleratchet.ErrMalformedHeader)
+	}
+	if h.GetVersion() > math.MaxUint8 || h.GetMaxVersion() > math.MaxUint8 || h.GetSuite() > math.MaxUint8 {
+		return doubleratchet.Message{}, fmt.Errorf("%w: version or suite is out of range", doubleratchet.ErrMalformedHeader)
+	}
+
+	msg := doubleratchet.Message{
+		Header: doubleratchet.MessageHeader{
+			Version:    uint8(h.GetVersion()),
+			MaxVersion: uint8(h.GetMaxVersion()),
+			Suite:      doubleratchet.CryptoSuite(h.GetSuite()),
+			DH:         h.GetDh(),
+			N:          h.GetN(),
+			PN:         h.GetPn(),
+		},
+		Ciphertext: m.GetCiphertext(),
+	}
+	if pq := h.GetPq(); pq != nil {
+		if pq.GetKind() > math.MaxUint8 || pq.GetIndex() > math.MaxUint16 || pq.GetTotal() > math.MaxUint16 {
+			return doubleratchet.Message{}, fmt.Errorf("%w: post-quantum header is out of range", doubleratchet.ErrMalformedHeader)
+		}
+		msg.Header.PQ = &doubleratchet.PQHeader{
+			Epoch:      pq.GetEpoch(),
+			MixedEpoch: pq.GetMixedEpoch(),
+			Kind:       uint8(pq.GetKind()),
+			Index:      uint16(pq.GetIndex()),
+			Total:      uint16(pq.GetTotal()),
+			Chunk:      pq.GetChunk(),
+		}
+	}
+	return msg, nil
+}
+
+// FromMessageHE converts the message of a SessionHE.
+func FromMessageHE(m doubleratchet.MessageHE) *MessageHE {
+	return &MessageHE{Header: m.Header, Ciphertext: m.Ciphertext}
+}
+
+// ToMessageHE converts m back to the message of a SessionHE.
+func (m *MessageHE) ToMessageHE() doubleratchet.MessageHE {
+	return doubleratchet.MessageHE{Header: m.GetHeader(), Ciphertext: m.GetCiphertext()}
+}
@@ -0,0 +1,79 @@
+package pb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/status-im/doubleratchet"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMessage_RoundTrip(t *testing.T) {
+	// Arrange.
+	m := doubleratchet.Message{
+		Header: doubleratchet.MessageHeader{
+			Version:    1,
+			MaxVersion: 2,
+			Suite:      doubleratchet.CryptoSuiteDefault,
+			DH:         make(doubleratchet.Key, 32),
+			N:          300,
+			PN:         7,
+			PQ:         &doubleratchet.PQHeader{Epoch: 3, MixedEpoch: 2, Kind: doubleratchet.PQKindCiphertext, Index: 1, Total: 5, Chunk: []byte("chunk")},
+		},
+		Ciphertext: []byte("ciphertext"),
+	}
+
+	// Act.
+	data, err := proto.Marshal(FromMessage(m))
+	require.NoError(t, err)
+
+	var decoded Message
+	err = proto.Unmarshal(data, &decoded)
+	require.NoError(t, err)
+	converted, err := decoded.ToMessage()
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, m, converted)
+}
+
+func TestMessage_ToMessage_Malformed(t *testing.T) {
+	cases := map[string]*Message{
+		"no header": {Ciphertext: []byte("ciphertext")},
+		"pq range":  {Header: &MessageHeader{Dh: []byte{1}, Pq: &PQHeader{Kind: 256}}},
+		"version":   {Header: &MessageHeader{Dh: []byte{1}, Version: 256}},
+	}
+	for name, m := range cases {
+		// Act.
+		_, err := m.ToMessage()
+
+		// Assert.
+		require.True(t, errors.Is(err, doubleratchet.ErrMalformedHeader), "%s: %v", name, err)
+	}
+}
+
+func TestMessage_Unmarshal_Malformed(t *testing.T) {
+	// Act.
+	var m Message
+	err := proto.Unmarshal([]byte{0x0a, 0xff}, &m)
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+func TestMessageHE_RoundTrip(t *testing.T) {
+	// Arrange.
+	m := doubleratchet.MessageHE{Header: []byte("header"), Ciphertext: []byte("ciphertext")}
+
+	// Act.
+	data, err := proto.Marshal(FromMessageHE(m))
+	require.NoError(t, err)
+
+	var decoded MessageHE
+	err = proto.Unmarshal(data, &decoded)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, m, decoded.ToMessageHE())
+}
@@ -0,0 +1,243 @@
+package doubleratchet
+
+import (
+	"crypto/mlkem"
+	"fmt"
+)
+
+// Kinds of payloads carried by PQHeader chunks.
+const (
+	PQKindEncapsulationKey uint8 = 1
+	PQKindCiphertext       uint8 = 2
+)
+
+// pqMaxChunks limits the number of chunks a payload can be split into.
+const pqMaxChunks = mlkem.EncapsulationKeySize768
+
+// PQHeader carries data of the sparse post-quantum ratchet, see WithPostQuantumRatchet.
+type PQHeader struct {
+	// Epoch is the number of the KEM exchange the chunk belongs to.
+	Epoch uint32 `json:"epoch"`
+
+	// MixedEpoch is the epoch which shared secret is mixed into the root key
+	// together with the DH output of the message's chain, 0 if none.
+	MixedEpoch uint32 `json:"mixed_epoch,omitempty"`
+
+	// Kind of the chunked payload, 0 if there's no chunk.
+	Kind uint8 `json:"kind,omitempty"`
+
+	// Index of the chunk and the total number of chunks of the payload.
+	Index uint16 `json:"index,omitempty"`
+	Total uint16 `json:"total,omitempty"`
+
+	Chunk []byte `json:"chunk,omitempty"`
+}
+
+// pqRatchet is the state of the sparse post-quantum ratchet running alongside the DH ratchet.
+//
+// Parties take turns in epochs. The owner of an epoch generates an ML-KEM-768 key pair and
+// sends the encapsulation key in chunks within message headers. The other party encapsulates
+// a shared secret to it and sends the ciphertext back the same way. As soon as the owner
+// decapsulates the secret, it mixes the secret into the root key together with the DH output
+// of its next sending chain and marks headers of that chain with the epoch, so the other party
+// mixes the same secret into the corresponding receiving chain. Then the other party becomes
+// the owner of the next epoch.
+type pqRatchet struct {
+	Enabled   bool `json:"enabled"`
+	ChunkSize int  `json:"chunk_size"`
+
+	Epoch uint32 `json:"epoch"`
+	Owner bool   `json:"owner"`
+
+	// DK is the seed of the owner's decapsulation key until the secret is decapsulated.
+	DK []byte `json:"dk,omitempty"`
+
+	// Secret is the shared secret of the epoch waiting to be mixed.
+	Secret []byte `json:"secret,omitempty"`
+
+	// Outgoing payload sent in chunks and the number of chunks sent.
+	Out      []byte `json:"out,omitempty"`
+	OutKind  uint8  `json:"out_kind,omitempty"`
+	OutCount uint32 `json:"out_count,omitempty"`
+
+	// Incoming payload being reassembled.
+	InKind  uint8    `json:"in_kind,omitempty"`
+	InTotal uint16   `json:"in_total,omitempty"`
+	In      [][]byte `json:"in,omitempty"`
+
+	// SendMixEpoch is the epoch mixed into the current sending chain, 0 if none.
+	SendMixEpoch uint32 `json:"send_mix_epoch,omitempty"`
+}
+
+// clone returns a copy of the ratchet which can be modified independently.
+func (p pqRatchet) clone() pqRatchet {
+	p.In = append([][]byte(nil), p.In...)
+	return p
+}
+
+// init sets the ratchet up for a new session. The party which knows the remote ratchet key
+// from the very beginning owns the first epoch.
+func (p *pqRatchet) init(owner bool) error {
+	if !p.Enabled {
+		return nil
+	}
+	if owner {
+		return p.start()
+	}
+	p.Epoch = 1
+	return nil
+}
+
+// start begins the next epoch owned by the party.
+func (p *pqRatchet) start() error {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return fmt.Errorf("can't generate KEM key: %s", err)
+	}
+	p.Epoch++
+	p.Owner = true
+	p.DK = dk.Bytes()
+	p.Secret = nil
+	p.Out = dk.EncapsulationKey().Bytes()
+	p.OutKind = PQKindEncapsulationKey
+	p.OutCount = 0
+	p.resetIn()
+	return nil
+}
+
+func (p *pqRatchet) resetIn() {
+	p.InKind = 0
+	p.InTotal = 0
+	p.In = nil
+}
+
+// header returns the post-quantum part of the next message header.
+func (p *pqRatchet) header() *PQHeader {
+	if !p.Enabled || (p.Out == nil && p.SendMixEpoch == 0) {
+		return nil
+	}
+
+	h := &PQHeader{Epoch: p.Epoch, MixedEpoch: p.SendMixEpoch}
+	if p.Out != nil {
+		var (
+			total = (len(p.Out) + p.ChunkSize - 1) / p.ChunkSize
+			i     = int(p.OutCount % uint32(total))
+			end   = (i + 1) * p.ChunkSize
+		)
+		if end > len(p.Out) {
+			end = len(p.Out)
+		}
+		h.Kind = p.OutKind
+		h.Index = uint16(i)
+		h.Total = uint16(total)
+		h.Chunk = p.Out[i*p.ChunkSize : end]
+		p.OutCount++
+	}
+	return h
+}
+
+// receive handles the chunk carried by the header of a received message.
+func (p *pqRatchet) receive(h *PQHeader) error {
+	if !p.Enabled || h == nil || h.Kind == 0 {
+		return nil
+	}
+	if h.Total == 0 || h.Total > pqMaxChunks || h.Index >= h.Total {
+		return fmt.Errorf("%w: post-quantum chunk %d/%d", ErrMalformedHeader, h.Index, h.Total)
+	}
+
+	switch {
+	case h.Kind == PQKindEncapsulationKey && p.Owner && h.Epoch == p.Epoch+1 && p.DK == nil && p.Secret == nil:
+		// The other party has mixed the secret and started the next epoch.
+		p.Epoch++
+		p.Owner = false
+		p.Out = nil
+		p.resetIn()
+	case h.Kind == PQKindEncapsulationKey && !p.Owner && h.Epoch == p.Epoch && p.Secret == nil:
+	case h.Kind == PQKindCiphertext && p.Owner && h.Epoch == p.Epoch && p.DK != nil:
+		// The other party has received the whole encapsulation key.
+		p.Out = nil
+	default:
+		// Stale or unexpected chunk.
+		return nil
+	}
+
+	payload := p.collect(h)
+	if payload == nil {
+		return nil
+	}
+
+	switch h.Kind {
+	case PQKindEncapsulationKey:
+		ek, err := mlkem.NewEncapsulationKey768(payload)
+		if err != nil {
+			return fmt.Errorf("%w: post-quantum encapsulation key: %s", ErrInvalidKey, err)
+		}
+		ss, ct := ek.Encapsulate()
+		p.Secret = ss
+		p.Out = ct
+		p.OutKind = PQKindCiphertext
+		p.OutCount = 0
+	case PQKindCiphertext:
+		dk, err := mlkem.NewDecapsulationKey768(p.DK)
+		if err != nil {
+			return fmt.Errorf("invalid post-quantum decapsulation key: %s", err)
+		}
+		ss, err := dk.Decapsulate(payload)
+		if err != nil {
+			return fmt.Errorf("%w: post-quantum ciphertext: %s", ErrMalformedHeader, err)
+		}
+		p.Secret = ss
+		p.DK = nil
+	}
+	return nil
+}
+
+// collect adds the chunk to the incoming payload and returns the payload once it's complete.
+func (p *pqRatchet) collect(h *PQHeader) []byte {
+	if p.InKind != h.Kind || p.InTotal != h.Total {
+		p.InKind = h.Kind
+		p.InTotal = h.Total
+		p.In = make([][]byte, h.Total)
+	}
+	p.In[h.Index] = append([]byte{}, h.Chunk...)
+
+	var payload []byte
+	for _, chunk := range p.In {
+		if chunk == nil {
+			return nil
+		}
+		payload = append(payload, chunk...)
+	}
+	p.resetIn()
+	return payload
+}
+
+// recvInput returns the root KDF input for the receiving chain of the message with header h.
+func (p *pqRatchet) recvInput(dhOut Key, h *PQHeader) (Key, error) {
+	if h == nil || h.MixedEpoch == 0 {
+		return dhOut, nil
+	}
+	if !p.Enabled || p.Owner || p.Secret == nil || h.MixedEpoch != p.Epoch {
+		return nil, fmt.Errorf("%w: unknown post-quantum epoch %d", ErrMalformedHeader, h.MixedEpoch)
+	}
+
+	in := append(append(Key{}, dhOut...), p.Secret...)
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// sendInput returns the root KDF input for a new sending chain and mixes the secret
+// of the epoch into it if it's ready.
+func (p *pqRatchet) sendInput(dhOut Key) Key {
+	p.SendMixEpoch = 0
+	if !p.Enabled || !p.Owner || p.DK != nil || p.Secret == nil {
+		return dhOut
+	}
+
+	in := append(append(Key{}, dhOut...), p.Secret...)
+	p.SendMixEpoch = p.Epoch
+	p.Secret = nil
+	return in
+}
@@ -0,0 +1,159 @@
+package doubleratchet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// exchange sends n messages from one party to the other and returns the mixed epochs
+// seen in their headers.
+func exchange(t *testing.T, from, to Session, n int) []uint32 {
+	var mixed []uint32
+	for i := 0; i < n; i++ {
+		m, err := from.RatchetEncrypt([]byte("hi"), nil)
+		require.NoError(t, err)
+
+		d, err := to.RatchetDecrypt(m, nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hi"), d)
+
+		if m.Header.PQ != nil && m.Header.PQ.MixedEpoch != 0 {
+			mixed = append(mixed, m.Header.PQ.MixedEpoch)
+		}
+	}
+	return mixed
+}
+
+func newPQSessions(t *testing.T, chunkSize int) (*sessionState, *sessionState) {
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithPostQuantumRatchet(chunkSize))
+	require.NoError(t, err)
+
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithPostQuantumRatchet(chunkSize))
+	require.NoError(t, err)
+
+	return alice.(*sessionState), bob.(*sessionState)
+}
+
+func TestWithPostQuantumRatchet_BadChunkSize(t *testing.T) {
+	// Act.
+	_, err := New([]byte("bob"), sk, bobPair, nil, WithPostQuantumRatchet(0))
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+func TestSession_PostQuantumRatchet_MixesSecrets(t *testing.T) {
+	// Arrange.
+	alice, bob := newPQSessions(t, 256)
+
+	// Act.
+	var mixed []uint32
+	for i := 0; i < 6; i++ {
+		mixed = append(mixed, exchange(t, alice, bob, 5)...)
+		mixed = append(mixed, exchange(t, bob, alice, 5)...)
+	}
+
+	// Assert.
+	require.Contains(t, mixed, uint32(1))
+	require.Contains(t, mixed, uint32(2))
+	require.True(t, alice.PQ.Epoch >= 3)
+	require.Equal(t, alice.PQ.Epoch, bob.PQ.Epoch)
+	require.NotEqual(t, alice.PQ.Owner, bob.PQ.Owner)
+}
+
+func TestSession_PostQuantumRatchet_SecretIsMixed(t *testing.T) {
+	// Arrange.
+	alice, bob := newPQSessions(t, 2000)
+	exchange(t, alice, bob, 1)
+	exchange(t, bob, alice, 1)
+	require.EqualValues(t, 1, alice.PQ.SendMixEpoch)
+
+	// Act.
+	bob.PQ.Secret = make([]byte, len(bob.PQ.Secret))
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+
+	_, err = bob.RatchetDecrypt(m, nil)
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+func TestSession_PostQuantumRatchet_LostMessages(t *testing.T) {
+	// Arrange.
+	alice, bob := newPQSessions(t, 400)
+
+	// Act.
+	var mixed []uint32
+	for i := 0; i < 8; i++ {
+		// Every other message is lost, chunks are resent in the following ones.
+		for j := 0; j < 4; j++ {
+			_, err := alice.RatchetEncrypt([]byte("lost"), nil)
+			require.NoError(t, err)
+			mixed = append(mixed, exchange(t, alice, bob, 1)...)
+		}
+		for j := 0; j < 4; j++ {
+			_, err := bob.RatchetEncrypt([]byte("lost"), nil)
+			require.NoError(t, err)
+			mixed = append(mixed, exchange(t, bob, alice, 1)...)
+		}
+	}
+
+	// Assert.
+	require.Contains(t, mixed, uint32(1))
+	require.Contains(t, mixed, uint32(2))
+}
+
+func TestState_MarshalBinary_PostQuantumRatchet(t *testing.T) {
+	// Arrange.
+	alice, bob := newPQSessions(t, 256)
+	exchange(t, alice, bob, 2)
+
+	// Act.
+	data, err := bob.State.MarshalBinary()
+	require.NoError(t, err)
+
+	decoded := State{MkSkipped: bob.MkSkipped}
+	err = decoded.UnmarshalBinary(data)
+	require.NoError(t, err)
+
+	jsonData, err := bob.State.MarshalJSON()
+	require.NoError(t, err)
+
+	jsonDecoded := State{MkSkipped: bob.MkSkipped}
+	err = jsonDecoded.UnmarshalJSON(jsonData)
+	require.NoError(t, err)
+
+	// Assert.
+	require.Equal(t, bob.PQ, decoded.PQ)
+	require.Equal(t, bob.PQ, jsonDecoded.PQ)
+
+	bob = &sessionState{id: []byte("bob"), State: decoded}
+	var mixed []uint32
+	for i := 0; i < 4; i++ {
+		mixed = append(mixed, exchange(t, alice, bob, 5)...)
+		mixed = append(mixed, exchange(t, bob, alice, 5)...)
+	}
+	require.Contains(t, mixed, uint32(1))
+}
+
+func TestMessageHeader_EncodeAndDecode_PostQuantum(t *testing.T) {
+	// Arrange.
+	mh := MessageHeader{
+		DH: bobPair.PublicKey(),
+		N:  1,
+		PN: 2,
+		PQ: &PQHeader{Epoch: 3, MixedEpoch: 2, Kind: PQKindCiphertext, Index: 1, Total: 5, Chunk: []byte("chunk")},
+	}
+
+	// Act.
+	decoded, err := mh.Encode().Decode()
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, mh, decoded)
+
+	_, err = mh.Encode()[:50].Decode()
+	require.NotNil(t, err)
+}
@@ -0,0 +1,64 @@
+package doubleratchet
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PreparedDecrypt holds the changes of the session made by decrypting a message with
+// RatchetDecryptPrepare: the next state and the message keys to store or delete. The session
+// is left intact until Commit is called, so the plaintext can be stored durably first.
+type PreparedDecrypt struct {
+	// base is the version of the state the changes are made to.
+	base    uint64
+	state   State
+	skipped []skippedKey
+
+	commit func(*PreparedDecrypt) error
+
+	mu   sync.Mutex
+	done bool
+}
+
+func newPreparedDecrypt(base uint64, sc State, skipped []skippedKey, commit func(*PreparedDecrypt) error) *PreparedDecrypt {
+	return &PreparedDecrypt{base: base, state: sc, skipped: skipped, commit: commit}
+}
+
+// Commit applies the changes to the session and stores them. It fails with *VersionConflictError
+// if the session has been changed since the message was decrypted, in which case the message
+// must be decrypted again.
+func (p *PreparedDecrypt) Commit() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done {
+		return fmt.Errorf("decrypt is already committed or discarded")
+	}
+	if err := p.commit(p); err != nil {
+		return err
+	}
+	p.discard()
+	return nil
+}
+
+// Discard drops the changes, the session stays as if the message has never been received.
+func (p *PreparedDecrypt) Discard() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.discard()
+}
+
+func (p *PreparedDecrypt) discard() {
+	p.done = true
+	p.state = State{}
+	p.skipped = nil
+}
+
+// applyTo applies the changes to s unless it has been changed since they were prepared.
+func (p *PreparedDecrypt) applyTo(id []byte, storage SessionStorage, s *State) error {
+	if s.Version != p.base {
+		return &VersionConflictError{ID: id, Version: p.state.Version, Stored: s.Version}
+	}
+	return commitChanges(id, storage, s, p.state, p.skipped)
+}
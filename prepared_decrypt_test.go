@@ -0,0 +1,127 @@
+package doubleratchet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSession_RatchetDecryptPrepare_Discard(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil)
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+	b := bob.(*sessionState)
+
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	before := b.State.toEncoding()
+
+	// Act.
+	d, p, err := bob.RatchetDecryptPrepare(m, nil)
+	require.NoError(t, err)
+	p.Discard()
+
+	// Assert.
+	require.Equal(t, []byte("hi"), d)
+	require.Equal(t, before, b.State.toEncoding())
+	require.Error(t, p.Commit())
+
+	d, err = bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hi"), d)
+}
+
+func TestSession_RatchetDecryptPrepare_Commit(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithReplayProtection(10))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	m1, err := alice.RatchetEncrypt([]byte("1"), nil)
+	require.NoError(t, err)
+	m2, err := alice.RatchetEncrypt([]byte("2"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m2, nil)
+	require.NoError(t, err)
+
+	// Act.
+	d, p, err := bob.RatchetDecryptPrepare(m1, nil)
+	require.NoError(t, err)
+	_, ok, err := bob.(*sessionState).MkSkipped.Get(m1.Header.DH, uint(m1.Header.N))
+	require.NoError(t, err)
+	require.True(t, ok)
+	err = p.Commit()
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), d)
+	_, err = bob.RatchetDecrypt(m1, nil)
+	require.ErrorIs(t, err, ErrDuplicateMessage)
+	require.Error(t, p.Commit())
+
+	exchange(t, bob, alice, 2)
+	exchange(t, alice, bob, 2)
+}
+
+func TestSession_RatchetDecryptPrepare_Conflict(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil)
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	m1, err := alice.RatchetEncrypt([]byte("1"), nil)
+	require.NoError(t, err)
+	m2, err := alice.RatchetEncrypt([]byte("2"), nil)
+	require.NoError(t, err)
+
+	_, p, err := bob.RatchetDecryptPrepare(m1, nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m2, nil)
+	require.NoError(t, err)
+
+	// Act.
+	err = p.Commit()
+
+	// Assert.
+	var conflict *VersionConflictError
+	require.True(t, errors.As(err, &conflict))
+
+	d, err := bob.RatchetDecrypt(m1, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), d)
+}
+
+func TestSessionHE_RatchetDecryptPrepare(t *testing.T) {
+	// Arrange.
+	bob, err := NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil)
+	require.NoError(t, err)
+	alice, err := NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+	b := bob.(*sessionHE)
+
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	before := b.State.toEncoding()
+
+	// Act.
+	d, p, err := bob.RatchetDecryptPrepare(m, nil)
+	require.NoError(t, err)
+	require.Equal(t, before, b.State.toEncoding())
+	err = p.Commit()
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []byte("hi"), d)
+	require.NotEqual(t, before, b.State.toEncoding())
+
+	reply, err := bob.RatchetEncrypt([]byte("reply"), nil)
+	require.NoError(t, err)
+	d, err = alice.RatchetDecrypt(reply, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("reply"), d)
+}
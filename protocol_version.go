@@ -0,0 +1,81 @@
+package doubleratchet
+
+import "fmt"
+
+// ProtocolVersion is the highest protocol version implemented by the library. Every message
+// header carries the version it's sent with and the highest one supported by the sender,
+// both are authenticated along with the rest of the header.
+const ProtocolVersion uint8 = 1
+
+// versions returns the range of supported protocol versions.
+func (s *State) versions() (uint8, uint8) {
+	min, max := s.MinVersion, s.MaxVersion
+	if min == 0 {
+		min = 1
+	}
+	if max == 0 {
+		max = ProtocolVersion
+	}
+	return min, max
+}
+
+// sendVersion returns the protocol version to send messages with: the highest one supported
+// by both parties or the lowest supported one until the peer advertises its versions.
+func (s *State) sendVersion() uint8 {
+	min, max := s.versions()
+	switch {
+	case s.PeerMaxVersion == 0:
+		return min
+	case s.PeerMaxVersion < max:
+		return s.PeerMaxVersion
+	}
+	return max
+}
+
+// header returns the header of the next message in the sending chain.
+func (s *State) header() MessageHeader {
+	_, max := s.versions()
+	return MessageHeader{
+		Version:    s.sendVersion(),
+		MaxVersion: max,
+		Suite:      suiteOf(s.Crypto),
+		DH:         s.DHs.PublicKey(),
+		N:          s.SendCh.N,
+		PN:         s.PN,
+	}
+}
+
+// checkVersion verifies that the message is sent with a supported protocol version and crypto suite.
+func (s *State) checkVersion(h MessageHeader) error {
+	min, max := s.versions()
+	switch {
+	case h.Version == 0 || h.Version > h.MaxVersion:
+		return fmt.Errorf("%w: version %d, max version %d", ErrMalformedHeader, h.Version, h.MaxVersion)
+	case h.Version < min || h.Version > max:
+		return fmt.Errorf("%w: version %d, supported %d-%d", ErrUnsupportedVersion, h.Version, min, max)
+	}
+	if cs := suiteOf(s.Crypto); h.Suite != cs && h.Suite != CryptoSuiteUnknown && cs != CryptoSuiteUnknown {
+		return fmt.Errorf("%w: message of %s, session of %s", ErrSuiteMismatch, h.Suite, cs)
+	}
+	return nil
+}
+
+// checkDowngrade verifies that the peer doesn't advertise a lower version than it did before.
+// Only headers newer than the last accepted one are checked, i.e. with a new ratchet key
+// or a higher number on the current chain, so that messages delayed across an upgrade are accepted.
+func (s *State) checkDowngrade(h MessageHeader, step bool) error {
+	if !step && h.N < s.RecvCh.N {
+		return nil
+	}
+	if h.MaxVersion < s.PeerMaxVersion {
+		return fmt.Errorf("%w: max version %d, %d advertised before", ErrVersionDowngrade, h.MaxVersion, s.PeerMaxVersion)
+	}
+	return nil
+}
+
+// acceptVersion records the versions advertised by the authenticated header.
+func (s *State) acceptVersion(h MessageHeader) {
+	if h.MaxVersion > s.PeerMaxVersion {
+		s.PeerMaxVersion = h.MaxVersion
+	}
+}
@@ -0,0 +1,249 @@
+package doubleratchet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSession_ProtocolVersionNegotiation(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithProtocolVersions(1, 2))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithProtocolVersions(1, 3))
+	require.NoError(t, err)
+
+	// Act.
+	first, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(first, nil)
+	require.NoError(t, err)
+
+	reply, err := bob.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = alice.RatchetDecrypt(reply, nil)
+	require.NoError(t, err)
+
+	next, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(next, nil)
+	require.NoError(t, err)
+
+	// Assert.
+	require.EqualValues(t, 1, first.Header.Version)
+	require.EqualValues(t, 3, first.Header.MaxVersion)
+	require.EqualValues(t, 2, reply.Header.Version)
+	require.EqualValues(t, 2, reply.Header.MaxVersion)
+	require.EqualValues(t, 2, next.Header.Version)
+	require.EqualValues(t, 2, alice.(*sessionState).PeerMaxVersion)
+	require.EqualValues(t, 3, bob.(*sessionState).PeerMaxVersion)
+}
+
+func TestSession_RatchetDecrypt_UnsupportedVersion(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithProtocolVersions(2, 2))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+
+	// Act.
+	_, err = bob.RatchetDecrypt(m, nil)
+
+	// Assert.
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestSession_RatchetDecrypt_VersionDowngrade(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithProtocolVersions(1, 2))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithProtocolVersions(1, 2))
+	require.NoError(t, err)
+	exchange(t, alice, bob, 1)
+
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	m.Header.MaxVersion = 1
+
+	// Act.
+	_, err = bob.RatchetDecrypt(m, nil)
+
+	// Assert.
+	require.ErrorIs(t, err, ErrVersionDowngrade)
+}
+
+func TestSession_RatchetDecrypt_DelayedAcrossUpgrade(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithProtocolVersions(1, 2))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithProtocolVersions(1, 1))
+	require.NoError(t, err)
+
+	first, err := alice.RatchetEncrypt([]byte("first"), nil)
+	require.NoError(t, err)
+	delayed, err := alice.RatchetEncrypt([]byte("delayed"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(first, nil)
+	require.NoError(t, err)
+	exchange(t, bob, alice, 1)
+
+	// Alice upgrades the library and sends with a new ratchet key.
+	alice.(*sessionState).MaxVersion = 2
+	upgraded, err := alice.RatchetEncrypt([]byte("upgraded"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(upgraded, nil)
+	require.NoError(t, err)
+
+	// Act.
+	d, err := bob.RatchetDecrypt(delayed, nil)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []byte("delayed"), d)
+	require.EqualValues(t, 2, bob.(*sessionState).PeerMaxVersion)
+}
+
+func TestSession_RatchetDecrypt_OutOfOrderAcrossUpgrade(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithProtocolVersions(1, 2))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithProtocolVersions(1, 1))
+	require.NoError(t, err)
+
+	old, err := alice.RatchetEncrypt([]byte("old"), nil)
+	require.NoError(t, err)
+	alice.(*sessionState).MaxVersion = 2
+	upgraded, err := alice.RatchetEncrypt([]byte("upgraded"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(upgraded, nil)
+	require.NoError(t, err)
+
+	// Act.
+	d, err := bob.RatchetDecrypt(old, nil)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), d)
+
+	next, err := alice.RatchetEncrypt([]byte("next"), nil)
+	require.NoError(t, err)
+	next.Header.MaxVersion = 1
+	_, err = bob.RatchetDecrypt(next, nil)
+	require.ErrorIs(t, err, ErrVersionDowngrade)
+}
+
+func TestSessionHE_RatchetDecrypt_OutOfOrderAcrossUpgrade(t *testing.T) {
+	// Arrange.
+	bob, err := NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil, WithProtocolVersions(1, 2))
+	require.NoError(t, err)
+	alice, err := NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil, WithProtocolVersions(1, 1))
+	require.NoError(t, err)
+
+	old, err := alice.RatchetEncrypt([]byte("old"), nil)
+	require.NoError(t, err)
+	alice.(*sessionHE).MaxVersion = 2
+	upgraded, err := alice.RatchetEncrypt([]byte("upgraded"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(upgraded, nil)
+	require.NoError(t, err)
+
+	// Act.
+	d, err := bob.RatchetDecrypt(old, nil)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), d)
+	require.EqualValues(t, 2, bob.(*sessionHE).PeerMaxVersion)
+}
+
+func TestSession_RatchetDecrypt_TamperedVersion(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithProtocolVersions(1, 2))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithProtocolVersions(1, 2))
+	require.NoError(t, err)
+
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	m.Header.Version = 2
+
+	// Act.
+	_, err = bob.RatchetDecrypt(m, nil)
+
+	// Assert.
+	require.ErrorIs(t, err, ErrAuthFailed)
+	require.Zero(t, bob.(*sessionState).PeerMaxVersion)
+}
+
+func TestSession_RatchetDecrypt_SuiteMismatch(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil)
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	m.Header.Suite = CryptoSuiteAESGCM
+
+	// Act.
+	_, err = bob.RatchetDecrypt(m, nil)
+
+	// Assert.
+	require.ErrorIs(t, err, ErrSuiteMismatch)
+}
+
+func TestSessionHE_ProtocolVersionNegotiation(t *testing.T) {
+	// Arrange.
+	bob, err := NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil, WithProtocolVersions(1, 2))
+	require.NoError(t, err)
+	alice, err := NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil, WithProtocolVersions(2, 2))
+	require.NoError(t, err)
+
+	// Act.
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+
+	reply, err := bob.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = alice.RatchetDecrypt(reply, nil)
+
+	// Assert.
+	require.NoError(t, err)
+	require.EqualValues(t, 2, bob.(*sessionHE).PeerMaxVersion)
+	require.EqualValues(t, 2, alice.(*sessionHE).PeerMaxVersion)
+}
+
+func TestWithProtocolVersions(t *testing.T) {
+	for name, tc := range map[string]struct {
+		min, max uint8
+		ok       bool
+	}{
+		"single": {1, 1, true},
+		"range":  {1, 3, true},
+		"zero":   {0, 1, false},
+		"empty":  {2, 1, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Arrange.
+			s := &State{}
+
+			// Act.
+			err := WithProtocolVersions(tc.min, tc.max)(s)
+
+			// Assert.
+			if !tc.ok {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.min, s.MinVersion)
+			require.Equal(t, tc.max, s.MaxVersion)
+		})
+	}
+}
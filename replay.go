@@ -0,0 +1,68 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// replayWindow remembers the most recently decrypted messages of the session to tell replays
+// apart from other undecryptable messages, see WithReplayProtection.
+type replayWindow struct {
+	// Size is the number of remembered messages, 0 if replay protection is off.
+	Size int `json:"size"`
+
+	// AtLeastOnce keeps message keys until DeleteMk is called, so that a message can be decrypted
+	// again until the application confirms it's processed.
+	AtLeastOnce bool `json:"at_least_once,omitempty"`
+
+	// Seen messages, the oldest first.
+	Seen []seenMessage `json:"seen,omitempty"`
+}
+
+// seenMessage identifies a decrypted message by its ratchet public key and number.
+type seenMessage struct {
+	DH Key    `json:"dh"`
+	N  uint32 `json:"n"`
+}
+
+// clone returns a copy of the window which can be modified independently.
+func (w replayWindow) clone() replayWindow {
+	w.Seen = append([]seenMessage(nil), w.Seen...)
+	return w
+}
+
+// enabled reports whether replays are tracked.
+func (w replayWindow) enabled() bool {
+	return w.Size > 0
+}
+
+// keepsUsedKeys reports whether the key of a decrypted message is stored until DeleteMk is called.
+func (w replayWindow) keepsUsedKeys() bool {
+	return !w.enabled() || w.AtLeastOnce
+}
+
+// check returns ErrDuplicateMessage if the message has already been decrypted.
+func (w replayWindow) check(dh Key, n uint32) error {
+	for _, m := range w.Seen {
+		if m.N == n && bytes.Equal(m.DH, dh) {
+			return fmt.Errorf("%w: message %d", ErrDuplicateMessage, n)
+		}
+	}
+	return nil
+}
+
+// add returns the window with the message appended and the oldest ones dropped to fit the size.
+// The receiver isn't modified.
+func (w replayWindow) add(dh Key, n uint32) replayWindow {
+	if !w.enabled() || w.check(dh, n) != nil {
+		return w
+	}
+	start := 0
+	if len(w.Seen) >= w.Size {
+		start = len(w.Seen) - w.Size + 1
+	}
+	seen := make([]seenMessage, 0, len(w.Seen)-start+1)
+	seen = append(seen, w.Seen[start:]...)
+	w.Seen = append(seen, seenMessage{DH: dh, N: n})
+	return w
+}
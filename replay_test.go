@@ -0,0 +1,165 @@
+package doubleratchet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newReplaySessions(t *testing.T, opts ...option) (Session, Session) {
+	bob, err := New([]byte("bob"), sk, bobPair, nil, opts...)
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, opts...)
+	require.NoError(t, err)
+	return alice, bob
+}
+
+func TestSession_RatchetDecrypt_Replay(t *testing.T) {
+	// Arrange.
+	alice, bob := newReplaySessions(t, WithReplayProtection(10))
+
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+
+	// Act.
+	_, err = bob.RatchetDecrypt(m, nil)
+
+	// Assert.
+	require.ErrorIs(t, err, ErrDuplicateMessage)
+	exchange(t, alice, bob, 1)
+}
+
+func TestSession_RatchetDecrypt_ReplayWithoutProtection(t *testing.T) {
+	// Arrange.
+	alice, bob := newReplaySessions(t)
+
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+
+	// Act.
+	d, err := bob.RatchetDecrypt(m, nil)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []byte("hi"), d)
+
+	require.NoError(t, bob.Confirm(m.Header))
+	_, err = bob.RatchetDecrypt(m, nil)
+	require.ErrorIs(t, err, ErrMessageKeyDeleted)
+}
+
+func TestSession_RatchetDecrypt_ReplayOfSkipped(t *testing.T) {
+	// Arrange.
+	alice, bob := newReplaySessions(t, WithReplayProtection(10))
+
+	m1, err := alice.RatchetEncrypt([]byte("1"), nil)
+	require.NoError(t, err)
+	exchange(t, alice, bob, 1)
+	_, err = bob.RatchetDecrypt(m1, nil)
+	require.NoError(t, err)
+
+	// Act.
+	_, err = bob.RatchetDecrypt(m1, nil)
+
+	// Assert.
+	require.ErrorIs(t, err, ErrDuplicateMessage)
+	_, ok, err := bob.(*sessionState).MkSkipped.Get(m1.Header.DH, uint(m1.Header.N))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestSession_RatchetDecrypt_ReplayOutsideWindow(t *testing.T) {
+	// Arrange.
+	alice, bob := newReplaySessions(t, WithReplayProtection(2))
+
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+	exchange(t, alice, bob, 2)
+
+	// Act.
+	_, err = bob.RatchetDecrypt(m, nil)
+
+	// Assert.
+	require.ErrorIs(t, err, ErrMessageKeyDeleted)
+	require.Len(t, bob.(*sessionState).Replay.Seen, 2)
+}
+
+func TestSession_RatchetDecrypt_AtLeastOnceProcessing(t *testing.T) {
+	// Arrange.
+	alice, bob := newReplaySessions(t, WithReplayProtection(10), WithAtLeastOnceProcessing())
+
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+
+	// Act.
+	d, err := bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hi"), d)
+
+	err = bob.DeleteMk(m.Header.DH, m.Header.N)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m, nil)
+
+	// Assert.
+	require.ErrorIs(t, err, ErrDuplicateMessage)
+}
+
+func TestSessionHE_RatchetDecrypt_Replay(t *testing.T) {
+	// Arrange.
+	bob, err := NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil, WithReplayProtection(10))
+	require.NoError(t, err)
+	alice, err := NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil, WithReplayProtection(10))
+	require.NoError(t, err)
+
+	m1, err := alice.RatchetEncrypt([]byte("1"), nil)
+	require.NoError(t, err)
+	m2, err := alice.RatchetEncrypt([]byte("2"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m2, nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m1, nil)
+	require.NoError(t, err)
+
+	// Act.
+	_, err1 := bob.RatchetDecrypt(m1, nil)
+	_, err2 := bob.RatchetDecrypt(m2, nil)
+
+	// Assert.
+	require.ErrorIs(t, err1, ErrDuplicateMessage)
+	require.ErrorIs(t, err2, ErrDuplicateMessage)
+}
+
+func TestState_MarshalBinary_ReplayWindow(t *testing.T) {
+	// Arrange.
+	alice, bob := newReplaySessions(t, WithReplayProtection(10), WithAtLeastOnceProcessing())
+	exchange(t, alice, bob, 3)
+	state := bob.(*sessionState).State
+
+	// Act.
+	data, err := state.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded State
+	err = decoded.UnmarshalBinary(data)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, state.Replay, decoded.Replay)
+	require.Len(t, decoded.Replay.Seen, 3)
+}
+
+func TestWithReplayProtection_Invalid(t *testing.T) {
+	// Act.
+	_, err := New([]byte("bob"), sk, bobPair, nil, WithReplayProtection(0))
+
+	// Assert.
+	require.Error(t, err)
+}
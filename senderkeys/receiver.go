@@ -0,0 +1,162 @@
+package senderkeys
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/status-im/doubleratchet"
+)
+
+// Receiver is the receiving side of another member's sender key.
+type Receiver struct {
+	id  []byte
+	cfg config
+
+	keyID uint32
+
+	// 32-byte chain key and number of the next message.
+	ck doubleratchet.Key
+	n  uint32
+
+	signingKey ed25519.PublicKey
+
+	// Number of message keys generated, used to truncate skipped keys in FIFO fashion.
+	keysCount uint
+}
+
+// NewReceiver creates a receiver of group messages out of the sender's distribution message.
+// id identifies the sender in the keys storage.
+func NewReceiver(id []byte, m DistributionMessage, opts ...option) (*Receiver, error) {
+	c, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.ChainKey) != 32 {
+		return nil, fmt.Errorf("invalid chain key length: %d", len(m.ChainKey))
+	}
+	if len(m.SigningKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid signing key length: %d", len(m.SigningKey))
+	}
+
+	return &Receiver{
+		id:         id,
+		cfg:        c,
+		keyID:      m.KeyID,
+		ck:         m.ChainKey,
+		n:          m.N,
+		signingKey: ed25519.PublicKey(m.SigningKey),
+	}, nil
+}
+
+// LoadReceiver restores the receiver encoded by MarshalBinary. Options must be the ones
+// the receiver was created with, including the keys storage skipped message keys are kept in.
+func LoadReceiver(id []byte, data []byte, opts ...option) (*Receiver, error) {
+	c, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeState(data, receiverStateSize); err != nil {
+		return nil, err
+	}
+	return &Receiver{
+		id:         id,
+		cfg:        c,
+		keyID:      binary.LittleEndian.Uint32(data[1:5]),
+		n:          binary.LittleEndian.Uint32(data[5:9]),
+		ck:         append(doubleratchet.Key{}, data[9:41]...),
+		signingKey: append(ed25519.PublicKey{}, data[41:73]...),
+		keysCount:  uint(binary.LittleEndian.Uint64(data[73:81])),
+	}, nil
+}
+
+// MarshalBinary encodes the receiver state including the secret chain key.
+// Skipped message keys are kept by the keys storage and aren't a part of it.
+func (r *Receiver) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 9, receiverStateSize)
+	buf[0] = StateEncodingVersion
+	binary.LittleEndian.PutUint32(buf[1:5], r.keyID)
+	binary.LittleEndian.PutUint32(buf[5:9], r.n)
+	buf = append(buf, r.ck...)
+	buf = append(buf, r.signingKey...)
+	return binary.LittleEndian.AppendUint64(buf, uint64(r.keysCount)), nil
+}
+
+// KeyID returns the identifier of the sender key.
+func (r *Receiver) KeyID() uint32 {
+	return r.keyID
+}
+
+// index returns the key skipped message keys of the sender are stored under.
+func (r *Receiver) index() doubleratchet.Key {
+	return doubleratchet.Key(r.signingKey)
+}
+
+// Decrypt verifies the signature and decrypts the group message. Skipped message keys are stored
+// and deleted right after the corresponding message is decrypted.
+func (r *Receiver) Decrypt(m Message, ad []byte) ([]byte, error) {
+	if m.KeyID != r.keyID {
+		return nil, fmt.Errorf("unknown sender key %d", m.KeyID)
+	}
+	if !ed25519.Verify(r.signingKey, m.signedData(), m.Signature) {
+		return nil, doubleratchet.ErrAuthFailed
+	}
+
+	// Is the message one of the skipped?
+	mk, ok, err := r.cfg.storage.Get(r.index(), uint(m.N))
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		plaintext, err := r.cfg.crypto.Decrypt(mk, m.Ciphertext, m.associatedData(ad))
+		if err != nil {
+			return nil, fmt.Errorf("can't decrypt skipped message: %w", err)
+		}
+		if err := r.cfg.storage.DeleteMk(r.index(), uint(m.N)); err != nil {
+			return nil, err
+		}
+		return plaintext, nil
+	}
+
+	if m.N < r.n {
+		return nil, fmt.Errorf("%w: message %d, next one is %d", doubleratchet.ErrMessageKeyDeleted, m.N, r.n)
+	}
+	if uint(r.n)+r.cfg.maxSkip < uint(m.N) {
+		return nil, fmt.Errorf("%w: %d to skip, %d allowed", doubleratchet.ErrTooManySkipped, m.N-r.n, r.cfg.maxSkip)
+	}
+
+	// All changes are applied on copies, so that the receiver won't be left in a dirty state.
+	var (
+		ck        = r.ck
+		n         = r.n
+		keysCount = r.keysCount
+		skipped   []doubleratchet.Key
+	)
+	for n < m.N {
+		ck, mk = r.cfg.crypto.KdfCK(ck)
+		skipped = append(skipped, mk)
+		n++
+	}
+	ck, mk = r.cfg.crypto.KdfCK(ck)
+	n++
+
+	plaintext, err := r.cfg.crypto.Decrypt(mk, m.Ciphertext, m.associatedData(ad))
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt: %w", err)
+	}
+
+	for i, mk := range skipped {
+		if err := r.cfg.storage.Put(r.id, r.index(), uint(r.n)+uint(i), mk, keysCount, time.Now()); err != nil {
+			return nil, err
+		}
+		keysCount++
+	}
+	if err := r.cfg.storage.TruncateMks(r.id, r.cfg.maxKeys); err != nil {
+		return nil, err
+	}
+
+	r.ck, r.n, r.keysCount = ck, n, keysCount
+
+	return plaintext, nil
+}
@@ -0,0 +1,113 @@
+package senderkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/status-im/doubleratchet"
+)
+
+// Sender is the sending side of a member's sender key.
+type Sender struct {
+	crypto doubleratchet.Crypto
+
+	keyID uint32
+
+	// 32-byte chain key and number of the next message.
+	ck doubleratchet.Key
+	n  uint32
+
+	signingKey ed25519.PrivateKey
+}
+
+// NewSender creates a sender with a random chain key, key identifier and signing key.
+func NewSender(opts ...option) (*Sender, error) {
+	c, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4+32)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return nil, fmt.Errorf("couldn't generate chain key: %s", err)
+	}
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate signing key: %s", err)
+	}
+
+	return &Sender{
+		crypto:     c.crypto,
+		keyID:      binary.LittleEndian.Uint32(buf[:4]),
+		ck:         buf[4:],
+		signingKey: signingKey,
+	}, nil
+}
+
+// LoadSender restores the sender encoded by MarshalBinary. Options must be the ones
+// the sender was created with.
+func LoadSender(data []byte, opts ...option) (*Sender, error) {
+	c, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeState(data, senderStateSize); err != nil {
+		return nil, err
+	}
+	return &Sender{
+		crypto:     c.crypto,
+		keyID:      binary.LittleEndian.Uint32(data[1:5]),
+		n:          binary.LittleEndian.Uint32(data[5:9]),
+		ck:         append(doubleratchet.Key{}, data[9:41]...),
+		signingKey: ed25519.NewKeyFromSeed(data[41:73]),
+	}, nil
+}
+
+// MarshalBinary encodes the sender state including the secret chain and signing keys.
+func (s *Sender) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 9, senderStateSize)
+	buf[0] = StateEncodingVersion
+	binary.LittleEndian.PutUint32(buf[1:5], s.keyID)
+	binary.LittleEndian.PutUint32(buf[5:9], s.n)
+	buf = append(buf, s.ck...)
+	return append(buf, s.signingKey.Seed()...), nil
+}
+
+// KeyID returns the identifier of the sender key.
+func (s *Sender) KeyID() uint32 {
+	return s.keyID
+}
+
+// DistributionMessage returns the message which lets other members decrypt
+// group messages starting from the next one.
+func (s *Sender) DistributionMessage() DistributionMessage {
+	return DistributionMessage{
+		KeyID:      s.keyID,
+		N:          s.n,
+		ChainKey:   append(doubleratchet.Key{}, s.ck...),
+		SigningKey: append([]byte{}, s.signingKey.Public().(ed25519.PublicKey)...),
+	}
+}
+
+// Encrypt performs a symmetric-key ratchet step, then encrypts and signs the group message.
+func (s *Sender) Encrypt(plaintext, ad []byte) (Message, error) {
+	var (
+		m      = Message{KeyID: s.keyID, N: s.n}
+		ck, mk = s.crypto.KdfCK(s.ck)
+	)
+
+	ct, err := s.crypto.Encrypt(mk, plaintext, m.associatedData(ad))
+	if err != nil {
+		return Message{}, err
+	}
+	m.Ciphertext = ct
+	m.Signature = ed25519.Sign(s.signingKey, m.signedData())
+
+	s.ck = ck
+	s.n++
+
+	return m, nil
+}
@@ -0,0 +1,222 @@
+// Package senderkeys implements group messaging with sender keys layered on pairwise
+// Double Ratchet sessions.
+//
+// Every member of a group creates a Sender which holds a symmetric sender chain and a signing key.
+// The member distributes its DistributionMessage to every other member over the existing pairwise
+// doubleratchet.Session (see Distribute and Accept) and then encrypts each group message only once.
+// Other members keep a Receiver per sender which advances the sender chain, stores skipped message
+// keys and verifies signatures of group messages.
+//
+// Senders and receivers are kept in memory. Persist them with MarshalBinary after every Encrypt
+// and Decrypt and restore them with LoadSender and LoadReceiver, along with the same KeysStorage.
+//
+// Sender keys provide forward secrecy of the symmetric chain only. When a member leaves the group,
+// the remaining members must create new senders and distribute them again.
+package senderkeys
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/status-im/doubleratchet"
+)
+
+const (
+	// distributionMessageSize is key id (4 bytes) + n (4 bytes) + chain key (32 bytes) + signing key (32 bytes).
+	distributionMessageSize = 72
+
+	// headerSize is key id (4 bytes) + n (4 bytes).
+	headerSize = 8
+
+	// senderStateSize is version (1 byte) + key id (4 bytes) + n (4 bytes) + chain key (32 bytes) +
+	// signing key seed (32 bytes).
+	senderStateSize = 73
+
+	// receiverStateSize is version (1 byte) + key id (4 bytes) + n (4 bytes) + chain key (32 bytes) +
+	// signing key (32 bytes) + keys count (8 bytes).
+	receiverStateSize = 81
+)
+
+// StateEncodingVersion is the version of the Sender and Receiver binary encodings.
+// It's the first byte of the encoding.
+const StateEncodingVersion = 1
+
+// DistributionMessage lets a member decrypt group messages of the sender starting from N.
+// It's secret and must only be sent over pairwise sessions.
+type DistributionMessage struct {
+	// KeyID identifies the sender key.
+	KeyID uint32 `json:"key_id"`
+
+	// N is the number of the next message in the sender chain.
+	N uint32 `json:"n"`
+
+	// ChainKey is the 32-byte chain key for message N.
+	ChainKey doubleratchet.Key `json:"chain_key"`
+
+	// SigningKey is the Ed25519 public key group messages are signed with.
+	SigningKey []byte `json:"signing_key"`
+}
+
+// Encode the distribution message in the binary format.
+func (m DistributionMessage) Encode() []byte {
+	buf := make([]byte, 8, distributionMessageSize)
+	binary.LittleEndian.PutUint32(buf[0:4], m.KeyID)
+	binary.LittleEndian.PutUint32(buf[4:8], m.N)
+	buf = append(buf, m.ChainKey...)
+	return append(buf, m.SigningKey...)
+}
+
+// decodeState checks the version and the size of the encoded sender or receiver state.
+func decodeState(data []byte, size int) error {
+	if len(data) == 0 {
+		return fmt.Errorf("encoded state is empty")
+	}
+	if data[0] != StateEncodingVersion {
+		return fmt.Errorf("unsupported state encoding version %d", data[0])
+	}
+	if len(data) != size {
+		return fmt.Errorf("encoded state must be %d bytes, %d given", size, len(data))
+	}
+	return nil
+}
+
+// DecodeDistributionMessage decodes the distribution message out of the binary format.
+func DecodeDistributionMessage(data []byte) (DistributionMessage, error) {
+	if len(data) != distributionMessageSize {
+		return DistributionMessage{}, fmt.Errorf("encoded distribution message must be %d bytes, %d given", distributionMessageSize, len(data))
+	}
+	return DistributionMessage{
+		KeyID:      binary.LittleEndian.Uint32(data[0:4]),
+		N:          binary.LittleEndian.Uint32(data[4:8]),
+		ChainKey:   append(doubleratchet.Key{}, data[8:40]...),
+		SigningKey: append([]byte{}, data[40:72]...),
+	}, nil
+}
+
+// Message is a single group message.
+type Message struct {
+	// KeyID identifies the sender key the message is encrypted with.
+	KeyID uint32 `json:"key_id"`
+
+	// N is the number of the message in the sender chain.
+	N uint32 `json:"n"`
+
+	Ciphertext []byte `json:"ciphertext"`
+
+	// Signature is the Ed25519 signature of the header and the ciphertext.
+	Signature []byte `json:"signature"`
+}
+
+// header returns the binary-encoded key id and message number.
+func (m Message) header() []byte {
+	buf := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(buf[0:4], m.KeyID)
+	binary.LittleEndian.PutUint32(buf[4:8], m.N)
+	return buf
+}
+
+// signedData returns the data covered by the signature.
+func (m Message) signedData() []byte {
+	return append(m.header(), m.Ciphertext...)
+}
+
+// associatedData returns the AEAD associated data of the message.
+func (m Message) associatedData(ad []byte) []byte {
+	return append(append([]byte{}, ad...), m.header()...)
+}
+
+type config struct {
+	crypto  doubleratchet.Crypto
+	storage doubleratchet.KeysStorage
+	maxSkip uint
+	maxKeys int
+}
+
+// option is a NewSender and NewReceiver option.
+type option func(*config) error
+
+// WithCrypto replaces the default cryptographic supplement with the specified.
+// Only KdfCK, Encrypt and Decrypt are used. All members must use the same one.
+// nolint: golint
+func WithCrypto(c doubleratchet.Crypto) option {
+	return func(cfg *config) error {
+		if c == nil {
+			return fmt.Errorf("Crypto mustn't be nil")
+		}
+		cfg.crypto = c
+		return nil
+	}
+}
+
+// WithKeysStorage replaces the default storage of skipped message keys with the specified.
+// nolint: golint
+func WithKeysStorage(ks doubleratchet.KeysStorage) option {
+	return func(cfg *config) error {
+		if ks == nil {
+			return fmt.Errorf("KeysStorage mustn't be nil")
+		}
+		cfg.storage = ks
+		return nil
+	}
+}
+
+// WithMaxSkip specifies the maximum number of messages skipped at once in a sender chain.
+// nolint: golint
+func WithMaxSkip(n int) option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return fmt.Errorf("n must be non-negative")
+		}
+		cfg.maxSkip = uint(n)
+		return nil
+	}
+}
+
+// WithMaxMessageKeys specifies the maximum number of skipped message keys kept per sender,
+// older keys are deleted in FIFO fashion.
+// nolint: golint
+func WithMaxMessageKeys(n int) option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return fmt.Errorf("n must be non-negative")
+		}
+		cfg.maxKeys = n
+		return nil
+	}
+}
+
+func newConfig(opts []option) (config, error) {
+	c := config{
+		crypto:  doubleratchet.DefaultCrypto{},
+		maxSkip: 1000,
+		maxKeys: 2000,
+	}
+	for i := range opts {
+		if err := opts[i](&c); err != nil {
+			return config{}, fmt.Errorf("failed to apply option: %s", err)
+		}
+	}
+	if c.storage == nil {
+		c.storage = &doubleratchet.KeysStorageInMemory{}
+	}
+	return c, nil
+}
+
+// Distribute sends the distribution message of s to a member over the pairwise session.
+func Distribute(session doubleratchet.Session, s *Sender, ad []byte) (doubleratchet.Message, error) {
+	return session.RatchetEncrypt(s.DistributionMessage().Encode(), ad)
+}
+
+// Accept decrypts the distribution message received over the pairwise session and creates
+// a receiver of group messages of the sender. id identifies the sender in the keys storage.
+func Accept(id []byte, session doubleratchet.Session, m doubleratchet.Message, ad []byte, opts ...option) (*Receiver, error) {
+	data, err := session.RatchetDecrypt(m, ad)
+	if err != nil {
+		return nil, err
+	}
+	dm, err := DecodeDistributionMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewReceiver(id, dm, opts...)
+}
@@ -0,0 +1,242 @@
+package senderkeys
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/status-im/doubleratchet"
+)
+
+var (
+	sk = doubleratchet.Key{
+		0xeb, 0x8, 0x10, 0x7c, 0x33, 0x54, 0x0, 0x20,
+		0xe9, 0x4f, 0x6c, 0x84, 0xe4, 0x39, 0x50, 0x5a,
+		0x2f, 0x60, 0xbe, 0x81, 0xa, 0x78, 0x8b, 0xeb,
+		0x1e, 0x2c, 0x9, 0x8d, 0x4b, 0x4d, 0xc1, 0x40,
+	}
+	groupAD = []byte("group")
+)
+
+func newPairwiseSessions(t *testing.T) (alice, bob doubleratchet.Session) {
+	bobPair, err := doubleratchet.DefaultCrypto{}.GenerateDH()
+	require.NoError(t, err)
+
+	bob, err = doubleratchet.New([]byte("bob"), sk, bobPair, nil)
+	require.NoError(t, err)
+
+	alice, err = doubleratchet.NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	return alice, bob
+}
+
+func newSenderReceiver(t *testing.T, opts ...option) (*Sender, *Receiver) {
+	s, err := NewSender(opts...)
+	require.NoError(t, err)
+
+	r, err := NewReceiver([]byte("alice"), s.DistributionMessage(), opts...)
+	require.NoError(t, err)
+
+	return s, r
+}
+
+func TestDistributeAccept(t *testing.T) {
+	// Arrange.
+	alice, bob := newPairwiseSessions(t)
+	s, err := NewSender()
+	require.NoError(t, err)
+
+	// Act.
+	m, err := Distribute(alice, s, nil)
+	require.NoError(t, err)
+
+	r, err := Accept([]byte("alice"), bob, m, nil)
+	require.NoError(t, err)
+
+	// Assert.
+	require.Equal(t, s.KeyID(), r.KeyID())
+
+	gm, err := s.Encrypt([]byte("Hi all!"), groupAD)
+	require.NoError(t, err)
+
+	d, err := r.Decrypt(gm, groupAD)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi all!"), d)
+}
+
+func TestReceiver_Decrypt_SkippedMessages(t *testing.T) {
+	// Arrange.
+	s, r := newSenderReceiver(t, WithMaxSkip(2))
+
+	var ms []Message
+	for i := 0; i < 5; i++ {
+		m, err := s.Encrypt([]byte{byte(i)}, groupAD)
+		require.NoError(t, err)
+		ms = append(ms, m)
+	}
+
+	// Act and assert.
+	_, err := r.Decrypt(ms[3], groupAD)
+	require.NotNil(t, err, "too many messages")
+
+	d, err := r.Decrypt(ms[2], groupAD)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, d)
+
+	d, err = r.Decrypt(ms[0], groupAD)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0}, d)
+
+	_, err = r.Decrypt(ms[0], groupAD)
+	require.NotNil(t, err, "the key is deleted after use")
+
+	d, err = r.Decrypt(ms[4], groupAD)
+	require.NoError(t, err)
+	require.Equal(t, []byte{4}, d)
+
+	d, err = r.Decrypt(ms[1], groupAD)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, d)
+
+	d, err = r.Decrypt(ms[3], groupAD)
+	require.NoError(t, err)
+	require.Equal(t, []byte{3}, d)
+}
+
+func TestReceiver_Decrypt_LateJoiner(t *testing.T) {
+	// Arrange.
+	s, err := NewSender()
+	require.NoError(t, err)
+
+	old, err := s.Encrypt([]byte("before"), groupAD)
+	require.NoError(t, err)
+
+	r, err := NewReceiver([]byte("alice"), s.DistributionMessage())
+	require.NoError(t, err)
+
+	m, err := s.Encrypt([]byte("after"), groupAD)
+	require.NoError(t, err)
+
+	// Act.
+	_, oldErr := r.Decrypt(old, groupAD)
+	d, err := r.Decrypt(m, groupAD)
+
+	// Assert.
+	require.NotNil(t, oldErr)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after"), d)
+}
+
+func TestReceiver_Decrypt_Errors(t *testing.T) {
+	// Arrange.
+	s, r := newSenderReceiver(t)
+	m, err := s.Encrypt([]byte("hi"), groupAD)
+	require.NoError(t, err)
+
+	t.Run("wrong key id", func(t *testing.T) {
+		bad := m
+		bad.KeyID++
+
+		_, err := r.Decrypt(bad, groupAD)
+		require.NotNil(t, err)
+	})
+
+	t.Run("invalid signature", func(t *testing.T) {
+		bad := m
+		bad.Ciphertext = append([]byte{}, m.Ciphertext...)
+		bad.Ciphertext[0] ^= 1
+
+		_, err := r.Decrypt(bad, groupAD)
+		require.NotNil(t, err)
+	})
+
+	t.Run("wrong associated data", func(t *testing.T) {
+		_, err := r.Decrypt(m, []byte("other group"))
+		require.NotNil(t, err)
+	})
+
+	t.Run("state is intact", func(t *testing.T) {
+		d, err := r.Decrypt(m, groupAD)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hi"), d)
+	})
+}
+
+func TestDistributionMessage_EncodeAndDecode(t *testing.T) {
+	// Arrange.
+	s, err := NewSender()
+	require.NoError(t, err)
+	dm := s.DistributionMessage()
+
+	// Act.
+	decoded, err := DecodeDistributionMessage(dm.Encode())
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, dm, decoded)
+
+	_, err = DecodeDistributionMessage(dm.Encode()[:40])
+	require.NotNil(t, err)
+}
+
+func TestSenderReceiver_MarshalAndLoad(t *testing.T) {
+	// Arrange.
+	ks := &doubleratchet.KeysStorageInMemory{}
+	s, r := newSenderReceiver(t, WithKeysStorage(ks))
+
+	var ms []Message
+	for i := 0; i < 3; i++ {
+		m, err := s.Encrypt([]byte{byte(i)}, groupAD)
+		require.NoError(t, err)
+		ms = append(ms, m)
+	}
+	_, err := r.Decrypt(ms[2], groupAD)
+	require.NoError(t, err)
+
+	// Act.
+	sData, err := s.MarshalBinary()
+	require.NoError(t, err)
+	rData, err := r.MarshalBinary()
+	require.NoError(t, err)
+
+	loadedS, err := LoadSender(sData)
+	require.NoError(t, err)
+	loadedR, err := LoadReceiver([]byte("alice"), rData, WithKeysStorage(ks))
+	require.NoError(t, err)
+
+	// Assert.
+	require.Equal(t, s.DistributionMessage(), loadedS.DistributionMessage())
+	require.Equal(t, r.keysCount, loadedR.keysCount)
+
+	d, err := loadedR.Decrypt(ms[0], groupAD)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0}, d)
+
+	m, err := loadedS.Encrypt([]byte("after restart"), groupAD)
+	require.NoError(t, err)
+	d, err = loadedR.Decrypt(m, groupAD)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after restart"), d)
+}
+
+func TestLoadSenderReceiver_Invalid(t *testing.T) {
+	// Arrange.
+	s, r := newSenderReceiver(t)
+	sData, err := s.MarshalBinary()
+	require.NoError(t, err)
+	rData, err := r.MarshalBinary()
+	require.NoError(t, err)
+
+	// Act and assert.
+	_, err = LoadSender(sData[:40])
+	require.NotNil(t, err)
+	_, err = LoadReceiver([]byte("alice"), rData[:40])
+	require.NotNil(t, err)
+	_, err = LoadSender(nil)
+	require.NotNil(t, err)
+
+	sData[0] = StateEncodingVersion + 1
+	_, err = LoadSender(sData)
+	require.NotNil(t, err)
+}
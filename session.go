@@ -3,9 +3,11 @@ package doubleratchet
 import (
 	"bytes"
 	"fmt"
+	"sync"
 )
 
 // Session of the party involved in the Double Ratchet Algorithm.
+// Sessions are safe for concurrent use.
 type Session interface {
 	// RatchetEncrypt performs a symmetric-key ratchet step, then AEAD-encrypts the message with
 	// the resulting message key.
@@ -14,14 +16,35 @@ type Session interface {
 	// RatchetDecrypt is called to AEAD-decrypt messages.
 	RatchetDecrypt(m Message, associatedData []byte) ([]byte, error)
 
+	// RatchetDecryptPrepare decrypts the message without changing the session. The changes
+	// are applied once Commit of the returned PreparedDecrypt is called.
+	RatchetDecryptPrepare(m Message, associatedData []byte) ([]byte, *PreparedDecrypt, error)
+
 	//DeleteMk remove a message key from the database
 	DeleteMk(Key, uint32) error
+
+	// Confirm deletes the key kept for the decrypted message with the given header.
+	Confirm(h MessageHeader) error
+
+	// ConfirmAll deletes keys of all the decrypted messages awaiting confirmation.
+	// The keys storage must implement PendingKeysStorage.
+	ConfirmAll() error
+
+	// Pending returns decrypted messages awaiting confirmation, the oldest first.
+	// The keys storage must implement PendingKeysStorage.
+	Pending() ([]PendingMessage, error)
 }
 
 type sessionState struct {
 	id []byte
 	State
 	storage SessionStorage
+
+	// opts are applied to the state reloaded by sync.
+	opts []option
+
+	// mu serializes changes of the state.
+	mu sync.Mutex
 }
 
 // New creates session with the shared key.
@@ -31,10 +54,13 @@ func New(id []byte, sharedKey Key, keyPair DHPair, storage SessionStorage, opts
 		return nil, err
 	}
 	state.DHs = keyPair
+	if err := state.PQ.init(false); err != nil {
+		return nil, err
+	}
 
-	session := &sessionState{id: id, State: state, storage: storage}
+	session := &sessionState{id: id, State: state, storage: storage, opts: opts}
 
-	return session, session.store()
+	return session, session.create()
 }
 
 // NewWithRemoteKey creates session with the shared key and public key of the other party.
@@ -45,19 +71,22 @@ func NewWithRemoteKey(id []byte, sharedKey, remoteKey Key, storage SessionStorag
 	}
 	state.DHs, err = state.Crypto.GenerateDH()
 	if err != nil {
-		return nil, fmt.Errorf("can't generate key pair: %s", err)
+		return nil, fmt.Errorf("can't generate key pair: %w", err)
 	}
 	state.DHr = remoteKey
 	secret, err := state.Crypto.DH(state.DHs, state.DHr)
 	if err != nil {
-		return nil, fmt.Errorf("can't generate dh secret: %s", err)
+		return nil, fmt.Errorf("can't generate dh secret: %w", err)
 	}
 
 	state.SendCh, _ = state.RootCh.step(secret)
+	if err := state.PQ.init(true); err != nil {
+		return nil, err
+	}
 
-	session := &sessionState{id: id, State: state, storage: storage}
+	session := &sessionState{id: id, State: state, storage: storage, opts: opts}
 
-	return session, session.store()
+	return session, session.create()
 }
 
 // Load a session from a SessionStorage implementation and apply options.
@@ -75,12 +104,48 @@ func Load(id []byte, store SessionStorage, opts ...option) (Session, error) {
 		return nil, err
 	}
 
-	s := &sessionState{id: id, State: *state}
+	if state.Crypto == nil {
+		return nil, fmt.Errorf("crypto of the loaded state is unknown, specify it with WithCrypto")
+	}
+
+	s := &sessionState{id: id, State: *state, opts: opts}
 	s.storage = store
 
 	return s, nil
 }
 
+// create stores the state of the new session replacing the stored one if any.
+func (s *sessionState) create() error {
+	if s.Locker != nil && s.storage == nil {
+		return fmt.Errorf("SessionLocker requires a SessionStorage")
+	}
+	unlock, err := lockSession(s.Locker, s.id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return s.store()
+}
+
+// sync locks the session if the locker is set and reloads the state which could be changed
+// by other processes. The returned function releases the lock.
+func (s *sessionState) sync() (func(), error) {
+	unlock, err := lockSession(s.Locker, s.id)
+	if err != nil {
+		return nil, err
+	}
+	if s.Locker != nil {
+		state, err := reloadState(s.id, s.storage, s.opts)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		s.State = state
+	}
+	return unlock, nil
+}
+
 func (s *sessionState) store() error {
 	if s.storage != nil {
 		err := s.storage.Save(s.id, &s.State)
@@ -94,49 +159,153 @@ func (s *sessionState) store() error {
 // RatchetEncrypt performs a symmetric-key ratchet step, then encrypts the message with
 // the resulting message key.
 func (s *sessionState) RatchetEncrypt(plaintext, ad []byte) (Message, error) {
-	var (
-		h = MessageHeader{
-			DH: s.DHs.PublicKey(),
-			N:  s.SendCh.N,
-			PN: s.PN,
-		}
-		mk = s.SendCh.step()
-	)
-	ct, err := s.Crypto.Encrypt(mk, plaintext, append(ad, h.Encode()...))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.sync()
+	if err != nil {
+		return Message{}, err
+	}
+	defer unlock()
+
+	// All changes are applied on a copy, so that the session is left intact if saving fails.
+	sc := s.State
+	sc.PQ = s.PQ.clone()
+	if err := sc.ensureSendingChain(); err != nil {
+		return Message{}, err
+	}
+
+	h := sc.header()
+	h.PQ = sc.PQ.header()
+	mk := sc.SendCh.step()
+
+	ct, err := s.Crypto.Encrypt(mk, plaintext, associatedData(s.Crypto, ad, h))
 	if err != nil {
 		return Message{}, err
 	}
 
 	// Store state
-	if err := s.store(); err != nil {
+	sc.Version++
+	if err := saveChanges(s.id, s.storage, &s.State, sc); err != nil {
 		return Message{}, err
 	}
 
-	return Message{h, ct}, nil
+	return Message{Header: h, Ciphertext: ct}, nil
 }
 
 // DeleteMk deletes a message key
 func (s *sessionState) DeleteMk(dh Key, n uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.sync()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	return s.MkSkipped.DeleteMk(dh, uint(n))
 }
 
 // RatchetDecrypt is called to decrypt messages.
 func (s *sessionState) RatchetDecrypt(m Message, ad []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.sync()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	plaintext, sc, keys, err := s.decrypt(m, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply changes and store state.
+	if err := commitChanges(s.id, s.storage, &s.State, sc, keys); err != nil {
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+// RatchetDecryptPrepare decrypts the message without changing the session.
+func (s *sessionState) RatchetDecryptPrepare(m Message, ad []byte) ([]byte, *PreparedDecrypt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.sync()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	plaintext, sc, keys, err := s.decrypt(m, ad)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, newPreparedDecrypt(s.Version, sc, keys, s.commitPrepared), nil
+}
+
+// commitPrepared applies the changes prepared by RatchetDecryptPrepare.
+func (s *sessionState) commitPrepared(p *PreparedDecrypt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.sync()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return p.applyTo(s.id, s.storage, &s.State)
+}
+
+// decrypt decrypts the message and returns the changed copy of the state along with the message
+// keys to store or delete. The session isn't modified.
+func (s *sessionState) decrypt(m Message, ad []byte) ([]byte, State, []skippedKey, error) {
+	if err := s.checkRatchetKey(m.Header); err != nil {
+		return nil, State{}, nil, err
+	}
+	if err := s.checkVersion(m.Header); err != nil {
+		return nil, State{}, nil, err
+	}
+
 	// Is the message one of the skipped?
 	mk, ok, err := s.MkSkipped.Get(m.Header.DH, uint(m.Header.N))
 	if err != nil {
-		return nil, err
+		return nil, State{}, nil, err
 	}
 
 	if ok {
-		plaintext, err := s.Crypto.Decrypt(mk, m.Ciphertext, append(ad, m.Header.Encode()...))
+		plaintext, err := decryptMessage(s.Crypto, mk, m, ad)
 		if err != nil {
-			return nil, fmt.Errorf("can't decrypt skipped message: %s", err)
+			return nil, State{}, nil, fmt.Errorf("can't decrypt skipped message: %w", err)
 		}
-		if err := s.store(); err != nil {
-			return nil, err
+
+		sc := s.State
+		used := skippedKey{key: m.Header.DH, nr: uint(m.Header.N), mk: mk, seq: sc.KeysCount, created: sc.now(), step: sc.Step}
+		var keys []skippedKey
+		if !s.Replay.keepsUsedKeys() {
+			used.drop = true
+			keys = append(keys, used)
+		} else if _, ok := s.MkSkipped.(PendingKeysStorage); ok {
+			// The key is kept waiting for confirmation.
+			used.pending = true
+			keys = append(keys, used)
+			sc.KeysCount++
 		}
-		return plaintext, nil
+		sc.Replay = s.Replay.add(m.Header.DH, m.Header.N)
+		sc.Version++
+		return plaintext, sc, keys, nil
+	}
+	if err := s.Replay.check(m.Header.DH, m.Header.N); err != nil {
+		return nil, State{}, nil, err
+	}
+	if err := s.checkDowngrade(m.Header, !bytes.Equal(m.Header.DH, s.DHr)); err != nil {
+		return nil, State{}, nil, err
 	}
 
 	var (
@@ -147,47 +316,51 @@ func (s *sessionState) RatchetDecrypt(m Message, ad []byte) ([]byte, error) {
 		skippedKeys2 []skippedKey
 	)
 
+	sc.PQ = s.PQ.clone()
+	if err := sc.PQ.receive(m.Header.PQ); err != nil {
+		return nil, State{}, nil, err
+	}
+
 	// Is there a new ratchet key?
 	if !bytes.Equal(m.Header.DH, sc.DHr) {
 		if skippedKeys1, err = sc.skipMessageKeys(sc.DHr, uint(m.Header.PN)); err != nil {
-			return nil, fmt.Errorf("can't skip previous chain message keys: %s", err)
+			return nil, State{}, nil, fmt.Errorf("can't skip previous chain message keys: %w", err)
 		}
 		if err = sc.dhRatchet(m.Header); err != nil {
-			return nil, fmt.Errorf("can't perform ratchet step: %s", err)
+			return nil, State{}, nil, fmt.Errorf("can't perform ratchet step: %w", err)
 		}
 	}
 
 	// After all, update the current chain.
 	if skippedKeys2, err = sc.skipMessageKeys(sc.DHr, uint(m.Header.N)); err != nil {
-		return nil, fmt.Errorf("can't skip current chain message keys: %s", err)
+		return nil, State{}, nil, fmt.Errorf("can't skip current chain message keys: %w", err)
 	}
 	mk = sc.RecvCh.step()
-	plaintext, err := s.Crypto.Decrypt(mk, m.Ciphertext, append(ad, m.Header.Encode()...))
+	plaintext, err := decryptMessage(s.Crypto, mk, m, ad)
 	if err != nil {
-		return nil, fmt.Errorf("can't decrypt: %s", err)
+		return nil, State{}, nil, fmt.Errorf("can't decrypt: %w", err)
 	}
 
-	// Append current key, waiting for confirmation
-	skippedKeys := append(skippedKeys1, skippedKeys2...)
-	skippedKeys = append(skippedKeys, skippedKey{
-		key: sc.DHr,
-		nr:  uint(m.Header.N),
-		mk:  mk,
-		seq: sc.KeysCount,
-	})
-
-	// Increment the number of keys
-	sc.KeysCount++
-
-	// Apply changes.
-	if err := s.applyChanges(sc, s.id, skippedKeys); err != nil {
-		return nil, err
-	}
+	sc.acceptVersion(m.Header)
+	sc.Replay = s.Replay.add(sc.DHr, m.Header.N)
 
-	// Store state
-	if err := s.store(); err != nil {
-		return nil, err
+	skippedKeys := append(skippedKeys1, skippedKeys2...)
+	if sc.Replay.keepsUsedKeys() {
+		// Append current key, waiting for confirmation
+		skippedKeys = append(skippedKeys, skippedKey{
+			key:     sc.DHr,
+			nr:      uint(m.Header.N),
+			mk:      mk,
+			seq:     sc.KeysCount,
+			created: sc.now(),
+			step:    sc.Step,
+			pending: true,
+		})
+
+		// Increment the number of keys
+		sc.KeysCount++
 	}
 
-	return plaintext, nil
+	sc.Version++
+	return plaintext, sc, skippedKeys, nil
 }
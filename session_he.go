@@ -0,0 +1,395 @@
+package doubleratchet
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+// SessionHE is the session of the party involved the Double Ratchet Algorithm with encrypted header modification.
+// Sessions are safe for concurrent use.
+type SessionHE interface {
+	// RatchetEncrypt performs a symmetric-key ratchet step, then AEAD-encrypts
+	// the header-encrypted message with the resulting message key.
+	RatchetEncrypt(plaintext, associatedData []byte) (MessageHE, error)
+
+	// RatchetDecrypt is called to AEAD-decrypt header-encrypted messages.
+	RatchetDecrypt(m MessageHE, associatedData []byte) ([]byte, error)
+
+	// RatchetDecryptPrepare decrypts the header-encrypted message without changing the session.
+	// The changes are applied once Commit of the returned PreparedDecrypt is called.
+	RatchetDecryptPrepare(m MessageHE, associatedData []byte) ([]byte, *PreparedDecrypt, error)
+}
+
+type sessionHE struct {
+	id []byte
+	State
+	storage SessionStorage
+
+	// opts are applied to the state reloaded by sync.
+	opts []option
+
+	// mu serializes changes of the state.
+	mu sync.Mutex
+}
+
+// NewHE creates session with the shared keys.
+func NewHE(id []byte, sharedKey, sharedHka, sharedNhkb Key, keyPair DHPair, storage SessionStorage, opts ...option) (SessionHE, error) {
+	state, err := newState(sharedKey, opts...)
+	if err != nil {
+		return nil, err
+	}
+	state.DHs = keyPair
+	state.NHKs = sharedNhkb
+	state.HKs = sharedHka
+	state.NHKr = sharedHka
+
+	session := &sessionHE{id: id, State: state, storage: storage, opts: opts}
+
+	return session, session.create()
+}
+
+// NewHEWithRemoteKey creates session with the shared keys and public key of the other party.
+func NewHEWithRemoteKey(id []byte, sharedKey, sharedHka, sharedNhkb, remoteKey Key, storage SessionStorage, opts ...option) (SessionHE, error) {
+	state, err := newState(sharedKey, opts...)
+	if err != nil {
+		return nil, err
+	}
+	state.DHs, err = state.Crypto.GenerateDH()
+	if err != nil {
+		return nil, fmt.Errorf("can't generate key pair: %w", err)
+	}
+	state.DHr = remoteKey
+	secret, err := state.Crypto.DH(state.DHs, state.DHr)
+	if err != nil {
+		return nil, fmt.Errorf("can't generate dh secret: %w", err)
+	}
+
+	state.SendCh, state.NHKs = state.RootCh.step(secret)
+	state.HKs = sharedHka
+	state.NHKr = sharedNhkb
+	state.HKr = sharedHka
+
+	session := &sessionHE{id: id, State: state, storage: storage, opts: opts}
+
+	return session, session.create()
+}
+
+// LoadHE loads a header-encrypted session from a SessionStorage implementation and applies options.
+func LoadHE(id []byte, store SessionStorage, opts ...option) (SessionHE, error) {
+	state, err := store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil {
+		return nil, nil
+	}
+
+	if err = state.applyOptions(opts); err != nil {
+		return nil, err
+	}
+
+	if state.Crypto == nil {
+		return nil, fmt.Errorf("crypto of the loaded state is unknown, specify it with WithCrypto")
+	}
+
+	s := &sessionHE{id: id, State: *state, opts: opts}
+	s.storage = store
+
+	return s, nil
+}
+
+// create stores the state of the new session replacing the stored one if any.
+func (s *sessionHE) create() error {
+	if s.Locker != nil && s.storage == nil {
+		return fmt.Errorf("SessionLocker requires a SessionStorage")
+	}
+	unlock, err := lockSession(s.Locker, s.id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return s.store()
+}
+
+// sync locks the session if the locker is set and reloads the state which could be changed
+// by other processes. The returned function releases the lock.
+func (s *sessionHE) sync() (func(), error) {
+	unlock, err := lockSession(s.Locker, s.id)
+	if err != nil {
+		return nil, err
+	}
+	if s.Locker != nil {
+		state, err := reloadState(s.id, s.storage, s.opts)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		s.State = state
+	}
+	return unlock, nil
+}
+
+func (s *sessionHE) store() error {
+	if s.storage != nil {
+		err := s.storage.Save(s.id, &s.State)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RatchetEncrypt performs a symmetric-key ratchet step, then encrypts the header with
+// the corresponding header key and the message with resulting message key.
+func (s *sessionHE) RatchetEncrypt(plaintext, ad []byte) (MessageHE, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.sync()
+	if err != nil {
+		return MessageHE{}, err
+	}
+	defer unlock()
+
+	// All changes are applied on a copy, so that the session is left intact if saving fails.
+	sc := s.State
+	sc.PQ = s.PQ.clone()
+	if err := sc.ensureSendingChain(); err != nil {
+		return MessageHE{}, err
+	}
+
+	var (
+		h  = sc.header()
+		mk = sc.SendCh.step()
+	)
+	hEnc, err := sealHeader(s.Crypto, sc.HKs, h)
+	if err != nil {
+		return MessageHE{}, fmt.Errorf("can't encrypt header: %w", err)
+	}
+	ct, err := s.Crypto.Encrypt(mk, plaintext, append(ad, hEnc...))
+	if err != nil {
+		return MessageHE{}, err
+	}
+
+	// Store state
+	sc.Version++
+	if err := saveChanges(s.id, s.storage, &s.State, sc); err != nil {
+		return MessageHE{}, err
+	}
+
+	return MessageHE{Header: hEnc, Ciphertext: ct}, nil
+}
+
+// RatchetDecrypt is called to AEAD-decrypt header-encrypted messages.
+func (s *sessionHE) RatchetDecrypt(m MessageHE, ad []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.sync()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	plaintext, sc, keys, err := s.decrypt(m, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply changes and store state.
+	if err := commitChanges(s.id, s.storage, &s.State, sc, keys); err != nil {
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+// RatchetDecryptPrepare decrypts the header-encrypted message without changing the session.
+func (s *sessionHE) RatchetDecryptPrepare(m MessageHE, ad []byte) ([]byte, *PreparedDecrypt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.sync()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	plaintext, sc, keys, err := s.decrypt(m, ad)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, newPreparedDecrypt(s.Version, sc, keys, s.commitPrepared), nil
+}
+
+// commitPrepared applies the changes prepared by RatchetDecryptPrepare.
+func (s *sessionHE) commitPrepared(p *PreparedDecrypt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.sync()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return p.applyTo(s.id, s.storage, &s.State)
+}
+
+// decrypt decrypts the message and returns the changed copy of the state along with the message
+// keys to store or delete. The session isn't modified.
+func (s *sessionHE) decrypt(m MessageHE, ad []byte) ([]byte, State, []skippedKey, error) {
+	// Is the message one of the skipped?
+	if plaintext, sc, keys, err := s.trySkippedMessages(m, ad); err != nil || plaintext != nil {
+		return plaintext, sc, keys, err
+	}
+
+	h, step, err := s.decryptHeader(m.Header)
+	if err != nil {
+		return nil, State{}, nil, fmt.Errorf("can't decrypt header: %w", err)
+	}
+	if err := s.checkRatchetKey(h); err != nil {
+		return nil, State{}, nil, err
+	}
+	if err := s.checkVersion(h); err != nil {
+		return nil, State{}, nil, err
+	}
+	if err := s.Replay.check(h.DH, h.N); err != nil {
+		return nil, State{}, nil, err
+	}
+	if err := s.checkDowngrade(h, step); err != nil {
+		return nil, State{}, nil, err
+	}
+
+	var (
+		// All changes must be applied on a different session object, so that this session won't be modified nor left in a dirty session.
+		sc = s.State
+
+		skippedKeys1 []skippedKey
+		skippedKeys2 []skippedKey
+	)
+	if step {
+		if skippedKeys1, err = sc.skipMessageKeys(sc.HKr, uint(h.PN)); err != nil {
+			return nil, State{}, nil, fmt.Errorf("can't skip previous chain message keys: %w", err)
+		}
+		if err = sc.dhRatchet(h); err != nil {
+			return nil, State{}, nil, fmt.Errorf("can't perform ratchet step: %w", err)
+		}
+	}
+
+	// After all, update the current chain.
+	if skippedKeys2, err = sc.skipMessageKeys(sc.HKr, uint(h.N)); err != nil {
+		return nil, State{}, nil, fmt.Errorf("can't skip current chain message keys: %w", err)
+	}
+	mk := sc.RecvCh.step()
+	plaintext, err := s.Crypto.Decrypt(mk, m.Ciphertext, append(ad, m.Header...))
+	if err != nil {
+		return nil, State{}, nil, fmt.Errorf("can't decrypt: %w", err)
+	}
+
+	sc.acceptVersion(h)
+	sc.Replay = s.Replay.add(h.DH, h.N)
+	sc.Version++
+	return plaintext, sc, append(skippedKeys1, skippedKeys2...), nil
+}
+
+// trySkippedMessages looks for a skipped message key of the session which header key decrypts
+// the header and uses it to decrypt the message. The key is deleted once the changes are applied.
+func (s *sessionHE) trySkippedMessages(m MessageHE, ad []byte) ([]byte, State, []skippedKey, error) {
+	allKeys, err := sessionKeys(s.MkSkipped, s.id)
+	if err != nil {
+		return nil, State{}, nil, err
+	}
+
+	for index, keys := range allKeys {
+		hk, err := keyFromIndex(index)
+		if err != nil {
+			return nil, State{}, nil, fmt.Errorf("can't decode header key %s: %w", index, err)
+		}
+		encoded, err := openHeader(s.Crypto, hk, m.Header)
+		if err != nil {
+			continue
+		}
+		h, err := encoded.Decode()
+		if err != nil {
+			return nil, State{}, nil, fmt.Errorf("can't decode header for skipped message key under %s: %w", index, err)
+		}
+		mk, ok := keys[uint(h.N)]
+		if !ok {
+			continue
+		}
+		if err := s.checkRatchetKey(h); err != nil {
+			return nil, State{}, nil, err
+		}
+		if err := s.checkVersion(h); err != nil {
+			return nil, State{}, nil, err
+		}
+
+		plaintext, err := s.Crypto.Decrypt(mk, m.Ciphertext, append(ad, m.Header...))
+		if err != nil {
+			return nil, State{}, nil, fmt.Errorf("can't decrypt skipped message: %w", err)
+		}
+
+		sc := s.State
+		sc.Replay = s.Replay.add(h.DH, h.N)
+		sc.Version++
+		return plaintext, sc, []skippedKey{{key: hk, nr: uint(h.N), drop: true}}, nil
+	}
+	return nil, State{}, nil, nil
+}
+
+// decryptHeader decrypts the header with the current or the next receiving header key.
+// The returned flag is true when the next header key was used, which means a DH ratchet step
+// must be performed.
+func (s *sessionHE) decryptHeader(encHeader []byte) (MessageHeader, bool, error) {
+	if s.HKr != nil {
+		if encoded, err := openHeader(s.Crypto, s.HKr, encHeader); err == nil {
+			h, err := encoded.Decode()
+			return h, false, err
+		}
+	}
+	if s.NHKr != nil {
+		if encoded, err := openHeader(s.Crypto, s.NHKr, encHeader); err == nil {
+			h, err := encoded.Decode()
+			return h, true, err
+		}
+	}
+	return MessageHeader{}, false, fmt.Errorf("%w: no header key decrypts the header", ErrAuthFailed)
+}
+
+// headerNonceSize is the size of the random nonce prepended to every encrypted header.
+const headerNonceSize = 16
+
+// sealHeader encrypts h with a one-time key derived from the header key hk and a random nonce,
+// so that headers of a single chain don't share a keystream. The nonce is prepended to the result.
+func sealHeader(c Crypto, hk Key, h MessageHeader) ([]byte, error) {
+	nonce := make([]byte, headerNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("can't generate header nonce: %w", err)
+	}
+	ct, err := c.Encrypt(headerKey(c, hk, nonce), h.Encode(), nonce)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, ct...), nil
+}
+
+// openHeader decrypts the header encrypted by sealHeader with the header key hk.
+func openHeader(c Crypto, hk Key, encHeader []byte) (MessageEncHeader, error) {
+	if len(encHeader) < headerNonceSize {
+		return nil, fmt.Errorf("%w: encrypted header is too short", ErrAuthFailed)
+	}
+	nonce := encHeader[:headerNonceSize]
+	encoded, err := c.Decrypt(headerKey(c, hk, nonce), encHeader[headerNonceSize:], nonce)
+	return MessageEncHeader(encoded), err
+}
+
+// headerKey derives the key encrypting a single header out of the header key hk and the nonce
+// with the root KDF of c, so that the header keys follow the primitives of the crypto suite.
+func headerKey(c Crypto, hk Key, nonce []byte) Key {
+	_, k, _ := c.KdfRK(hk, nonce)
+	return k
+}
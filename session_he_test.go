@@ -0,0 +1,373 @@
+package doubleratchet
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	sharedHka  = Key{0xbd, 0x29, 0x18, 0xcb, 0x18, 0x6c, 0x26, 0x32, 0xd5, 0x82, 0x41, 0x2d, 0x11, 0xa4, 0x55, 0x87, 0x1e, 0x5b, 0xa3, 0xb5, 0x5a, 0x6d, 0xe1, 0x97, 0xde, 0xf7, 0x5e, 0xc3, 0xf2, 0xec, 0x1d, 0xd}
+	sharedNhkb = Key{0x32, 0x89, 0x3a, 0xed, 0x4b, 0xf0, 0xbf, 0xc1, 0xa5, 0xa9, 0x53, 0x73, 0x5b, 0xf9, 0x76, 0xce, 0x70, 0x8e, 0xe1, 0xa, 0xed, 0x98, 0x1d, 0xe3, 0xb4, 0xe9, 0xa9, 0x88, 0x54, 0x94, 0xaf, 0x23}
+)
+
+func TestNewHE(t *testing.T) {
+	// Act.
+	si, err := NewHE([]byte("id"), sk, sharedHka, sharedNhkb, bobPair, nil)
+	require.NoError(t, err)
+
+	s := si.(*sessionHE)
+
+	// Assert.
+	require.Equal(t, bobPair, s.DHs)
+	require.Equal(t, sharedHka, s.HKs)
+	require.Equal(t, sharedNhkb, s.NHKs)
+	require.Equal(t, sharedHka, s.NHKr)
+	require.Nil(t, s.HKr)
+}
+
+func TestNewHE_BadOption(t *testing.T) {
+	// Act.
+	_, err := NewHE([]byte("id"), sk, sharedHka, sharedNhkb, bobPair, nil, WithMaxSkip(-10))
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+func TestNewHEWithRemoteKey(t *testing.T) {
+	// Act.
+	si, err := NewHEWithRemoteKey([]byte("id"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	s := si.(*sessionHE)
+
+	// Assert.
+	require.Equal(t, bobPair.PublicKey(), s.DHr)
+	require.Equal(t, sharedHka, s.HKs)
+	require.Equal(t, sharedHka, s.HKr)
+	require.Equal(t, sharedNhkb, s.NHKr)
+	require.NotEmpty(t, s.NHKs)
+	require.NotEqual(t, sk, s.SendCh.CK)
+}
+
+func TestSessionHE_RatchetEncrypt_HeaderIsEncrypted(t *testing.T) {
+	// Arrange.
+	si, err := NewHEWithRemoteKey([]byte("id"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	s := si.(*sessionHE)
+
+	// Act.
+	m, err := si.RatchetEncrypt([]byte("1337"), nil)
+
+	// Assert.
+	require.NoError(t, err)
+	require.EqualValues(t, 1, s.SendCh.N)
+	require.NotEmpty(t, m.Ciphertext)
+	require.NotContains(t, string(m.Header), string(s.DHs.PublicKey()))
+
+	_, err = MessageEncHeader(m.Header).Decode()
+	require.NotNil(t, err)
+}
+
+func TestSessionHE_RatchetEncrypt_HeadersDontShareKeystream(t *testing.T) {
+	for name, c := range map[string]Crypto{"default": DefaultCrypto{}, "aes-gcm": AESGCMCrypto{}} {
+		t.Run(name, func(t *testing.T) {
+			// Arrange.
+			alice, err := NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil, WithCrypto(c))
+			require.NoError(t, err)
+
+			// Act.
+			m1, err := alice.RatchetEncrypt([]byte("1"), nil)
+			require.NoError(t, err)
+			m2, err := alice.RatchetEncrypt([]byte("2"), nil)
+			require.NoError(t, err)
+
+			// Assert.
+			require.Len(t, m2.Header, len(m1.Header))
+			for i := 0; i+4 <= len(m1.Header); i++ {
+				require.NotEqual(t, m1.Header[i:i+4], m2.Header[i:i+4], "headers share bytes at %d", i)
+			}
+		})
+	}
+}
+
+func TestHeaderKey_SessionKDF(t *testing.T) {
+	// Arrange.
+	var (
+		nonce    = make([]byte, headerNonceSize)
+		sha512   = mustNewCrypto(t, WithHash(HashSHA512))
+		_, ck, _ = X448Crypto{}.KdfRK(sharedHka, nonce)
+	)
+
+	// Act.
+	k := headerKey(X448Crypto{}, sharedHka, nonce)
+
+	// Assert.
+	require.Equal(t, ck, k)
+	require.NotEqual(t, headerKey(DefaultCrypto{}, sharedHka, nonce), headerKey(sha512, sharedHka, nonce))
+}
+
+func TestSessionHE_RatchetDecrypt_InvalidRatchetKeyLength(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil)
+		alice, _ = NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+	)
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+
+	// Act.
+	h := MessageHeader{Version: ProtocolVersion, MaxVersion: ProtocolVersion, DH: Key{1}, N: 1}
+	hEnc, err := sealHeader(DefaultCrypto{}, alice.(*sessionHE).HKs, h)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(MessageHE{Header: hEnc, Ciphertext: make([]byte, 64)}, nil)
+
+	// Assert.
+	require.ErrorIs(t, err, ErrMalformedHeader)
+}
+
+func TestSessionHE_RatchetDecrypt_SkippedOfSession(t *testing.T) {
+	// Arrange.
+	var (
+		ks       = sessionKeysOnly{&KeysStorageInMemory{}}
+		bob, _   = NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil, WithKeysStorage(ks))
+		alice, _ = NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+	)
+	delayed, err := alice.RatchetEncrypt([]byte("delayed"), nil)
+	require.NoError(t, err)
+	m, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+	_, err = bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+
+	// Act.
+	d, err := bob.RatchetDecrypt(delayed, nil)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []byte("delayed"), d)
+}
+
+// sessionKeysOnly is a keys storage which doesn't list keys of all sessions.
+type sessionKeysOnly struct {
+	*KeysStorageInMemory
+}
+
+func (s sessionKeysOnly) All() (map[string]map[uint]Key, error) {
+	return nil, errors.New("keys of all sessions are listed")
+}
+
+func TestSessionHE_RatchetDecrypt_CommunicationPingPong(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil)
+		alice, _ = NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+		h        = SessionHETestHelper{t, alice, bob}
+	)
+
+	for i := 0; i < 10; i++ {
+		pt := fmt.Sprintf("msg%d", i)
+		t.Run(pt, func(t *testing.T) {
+			h.t = t
+			h.AliceToBob(pt+"alice", []byte("alice associated data"))
+			h.BobToAlice(pt+"bob", []byte("bob associated data"))
+		})
+	}
+}
+
+func TestSessionHE_RatchetDecrypt_BobSendsFirst(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil)
+		alice, _ = NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+		h        = SessionHETestHelper{t, alice, bob}
+	)
+
+	// Act and assert.
+	h.BobToAlice("bob0", nil)
+	h.BobToAlice("bob1", nil)
+	h.AliceToBob("alice0", nil)
+	h.BobToAlice("bob2", nil)
+}
+
+func TestSessionHE_RatchetDecrypt_CommunicationSkippedMessages(t *testing.T) {
+	// Arrange.
+	var (
+		bobI, _ = NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil, WithMaxSkip(1))
+		bob     = bobI.(*sessionHE)
+
+		alice, _ = NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil, WithMaxSkip(1))
+	)
+
+	m0, err := alice.RatchetEncrypt([]byte("hi"), nil)
+	require.NoError(t, err)
+
+	m1, err := alice.RatchetEncrypt([]byte("bob"), nil)
+	require.NoError(t, err)
+
+	m2, err := alice.RatchetEncrypt([]byte("how are you?"), nil)
+	require.NoError(t, err)
+
+	m3, err := alice.RatchetEncrypt([]byte("still do cryptography?"), nil)
+	require.NoError(t, err)
+
+	m4, err := alice.RatchetEncrypt([]byte("you there?"), nil)
+	require.NoError(t, err)
+
+	// Act and assert.
+	m1.Ciphertext[len(m1.Ciphertext)-1] ^= 10
+	_, err = bob.RatchetDecrypt(m1, nil) // Error: invalid signature.
+	require.NotNil(t, err)
+
+	bobSkippedCount, err := bob.MkSkipped.Count(bob.NHKr)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, bobSkippedCount)
+
+	m1.Ciphertext[len(m1.Ciphertext)-1] ^= 10
+	d, err := bob.RatchetDecrypt(m1, nil) // Decrypted and skipped.
+	require.NoError(t, err)
+	require.Equal(t, []byte("bob"), d)
+
+	bobSkippedCount, err = bob.MkSkipped.Count(bob.HKr)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, bobSkippedCount)
+
+	_, err = bob.RatchetDecrypt(m4, nil) // Too many messages.
+	require.NotNil(t, err)
+
+	d, err = bob.RatchetDecrypt(m0, nil) // Decrypted with a skipped key.
+	require.NoError(t, err)
+	require.Equal(t, []byte("hi"), d)
+
+	bobSkippedCount, err = bob.MkSkipped.Count(bob.HKr)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, bobSkippedCount)
+
+	_, err = bob.RatchetDecrypt(m0, nil) // Skipped key is already deleted.
+	require.NotNil(t, err)
+
+	d, err = bob.RatchetDecrypt(m2, nil) // Decrypted.
+	require.NoError(t, err)
+	require.Equal(t, []byte("how are you?"), d)
+
+	d, err = bob.RatchetDecrypt(m3, nil) // Decrypted.
+	require.NoError(t, err)
+	require.Equal(t, []byte("still do cryptography?"), d)
+
+	d, err = bob.RatchetDecrypt(m4, nil) // Decrypted.
+	require.NoError(t, err)
+	require.Equal(t, []byte("you there?"), d)
+}
+
+func TestSessionHE_RatchetDecrypt_SkippedMessagesFromPreviousChain(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil)
+		alice, _ = NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+		h        = SessionHETestHelper{t, alice, bob}
+	)
+
+	m0, err := alice.RatchetEncrypt([]byte("delayed"), nil)
+	require.NoError(t, err)
+
+	// Act.
+	h.AliceToBob("Bob!", nil)
+	h.BobToAlice("Alice?", nil)
+	h.AliceToBob("How are you?", nil)
+
+	// Assert.
+	d, err := bob.RatchetDecrypt(m0, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("delayed"), d)
+}
+
+func TestSessionHE_RatchetDecrypt_InvalidHeader(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil)
+		alice, _ = NewHEWithRemoteKey([]byte("alice"), sk, sharedNhkb, sharedHka, bobPair.PublicKey(), nil)
+	)
+
+	m, err := alice.RatchetEncrypt([]byte("something important"), nil)
+	require.NoError(t, err)
+
+	// Act.
+	_, err = bob.RatchetDecrypt(m, nil)
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+func TestLoadHE(t *testing.T) {
+	// Arrange.
+	var (
+		store    = &sessionStorageInMemory{}
+		bob, _   = NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, store)
+		alice, _ = NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), store)
+	)
+	h := SessionHETestHelper{t, alice, bob}
+	h.AliceToBob("Bob!", nil)
+
+	// Act.
+	loaded, err := LoadHE([]byte("bob"), store)
+	require.NoError(t, err)
+
+	// Assert.
+	h.bob = loaded
+	h.BobToAlice("Alice?", nil)
+	h.AliceToBob("How are you?", nil)
+}
+
+type sessionStorageInMemory struct {
+	states map[string]State
+}
+
+func (s *sessionStorageInMemory) Save(id []byte, state *State) error {
+	if s.states == nil {
+		s.states = make(map[string]State)
+	}
+	s.states[string(id)] = *state
+	return nil
+}
+
+func (s *sessionStorageInMemory) Load(id []byte) (*State, error) {
+	state, ok := s.states[string(id)]
+	if !ok {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+type SessionHETestHelper struct {
+	t *testing.T
+
+	alice SessionHE
+	bob   SessionHE
+}
+
+func (h SessionHETestHelper) AliceToBob(msg string, ad []byte) {
+	msgByte := []byte(msg)
+
+	m, err := h.alice.RatchetEncrypt(msgByte, ad)
+	require.NoError(h.t, err)
+
+	d, err := h.bob.RatchetDecrypt(m, ad)
+	require.NoError(h.t, err)
+	require.EqualValues(h.t, msgByte, d)
+}
+
+func (h SessionHETestHelper) BobToAlice(msg string, ad []byte) {
+	msgByte := []byte(msg)
+
+	m, err := h.bob.RatchetEncrypt(msgByte, ad)
+	require.NoError(h.t, err)
+
+	d, err := h.alice.RatchetDecrypt(m, ad)
+	require.NoError(h.t, err)
+	require.EqualValues(h.t, msgByte, d)
+}
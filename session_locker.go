@@ -0,0 +1,65 @@
+package doubleratchet
+
+import "fmt"
+
+// SessionLocker serializes changes of sessions shared by several processes. When it's set with
+// WithSessionLocker, methods changing the session lock it and reload its state from the storage
+// first, so the state read by Load may be stale but is never used for changes.
+type SessionLocker interface {
+	// Lock blocks until the session keyed by id is locked by the caller.
+	// The returned function releases the lock.
+	Lock(id []byte) (unlock func() error, err error)
+}
+
+// VersionConflictError is returned by SessionStorage.Save when the stored state has been changed
+// since the saved one was loaded, for example, by another process. The session must be loaded again.
+type VersionConflictError struct {
+	ID []byte
+
+	// Version of the saved state and the stored one.
+	Version, Stored uint64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("session %x has been changed concurrently: saving version %d over %d", e.ID, e.Version, e.Stored)
+}
+
+// CheckVersion is used by SessionStorage implementations to reject stale writes. It returns
+// *VersionConflictError unless the state is the next version of the stored one. States of version 0,
+// i.e. newly created sessions, replace the stored state unconditionally.
+func CheckVersion(id []byte, state *State, stored uint64) error {
+	if state.Version == 0 || state.Version == stored+1 {
+		return nil
+	}
+	return &VersionConflictError{ID: id, Version: state.Version, Stored: stored}
+}
+
+// lockSession locks the session if the locker is set, the returned function releases the lock.
+func lockSession(l SessionLocker, id []byte) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	unlock, err := l.Lock(id)
+	if err != nil {
+		return nil, fmt.Errorf("can't lock session: %w", err)
+	}
+	return func() { _ = unlock() }, nil
+}
+
+// reloadState returns the stored state of the session with opts applied.
+func reloadState(id []byte, storage SessionStorage, opts []option) (State, error) {
+	state, err := storage.Load(id)
+	if err != nil {
+		return State{}, err
+	}
+	if state == nil {
+		return State{}, fmt.Errorf("session %x is not found", id)
+	}
+	if err := state.applyOptions(opts); err != nil {
+		return State{}, err
+	}
+	if state.Crypto == nil {
+		return State{}, fmt.Errorf("crypto of the loaded state is unknown, specify it with WithCrypto")
+	}
+	return *state, nil
+}
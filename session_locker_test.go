@@ -0,0 +1,211 @@
+package doubleratchet
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version, stored uint64
+		conflict        bool
+	}{
+		{0, 0, false},
+		{0, 5, false},
+		{1, 0, false},
+		{6, 5, false},
+		{5, 5, true},
+		{7, 5, true},
+	} {
+		err := CheckVersion([]byte("id"), &State{Version: tc.version}, tc.stored)
+
+		var conflict *VersionConflictError
+		require.Equal(t, tc.conflict, errors.As(err, &conflict), "%d over %d", tc.version, tc.stored)
+	}
+}
+
+func TestFileLocker_Lock(t *testing.T) {
+	// Arrange.
+	l, err := NewFileLocker(t.TempDir())
+	require.NoError(t, err)
+
+	unlock, err := l.Lock([]byte("id"))
+	require.NoError(t, err)
+
+	// Act.
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := l.Lock([]byte("id"))
+		if err == nil {
+			_ = unlock()
+		}
+		close(locked)
+	}()
+
+	// Assert.
+	select {
+	case <-locked:
+		t.Fatal("the session is locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, unlock())
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the session isn't unlocked")
+	}
+}
+
+func TestSession_VersionConflict(t *testing.T) {
+	// Arrange.
+	store := &versionedStorageInMemory{}
+	_, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), store)
+	require.NoError(t, err)
+
+	first, err := Load([]byte("alice"), store)
+	require.NoError(t, err)
+	second, err := Load([]byte("alice"), store)
+	require.NoError(t, err)
+
+	_, err = first.RatchetEncrypt([]byte("first"), nil)
+	require.NoError(t, err)
+
+	// Act.
+	_, err = second.RatchetEncrypt([]byte("second"), nil)
+
+	// Assert.
+	var conflict *VersionConflictError
+	require.True(t, errors.As(err, &conflict))
+	require.EqualValues(t, 1, conflict.Version)
+	require.EqualValues(t, 1, conflict.Stored)
+}
+
+func TestSession_SessionLocker(t *testing.T) {
+	// Arrange.
+	var (
+		store  = &versionedStorageInMemory{}
+		bob, _ = New([]byte("bob"), sk, bobPair, nil)
+	)
+	l, err := NewFileLocker(t.TempDir())
+	require.NoError(t, err)
+
+	_, err = NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), store, WithSessionLocker(l))
+	require.NoError(t, err)
+
+	first, err := Load([]byte("alice"), store, WithSessionLocker(l))
+	require.NoError(t, err)
+	second, err := Load([]byte("alice"), store, WithSessionLocker(l))
+	require.NoError(t, err)
+
+	// Act.
+	m1, err := first.RatchetEncrypt([]byte("first"), nil)
+	require.NoError(t, err)
+	m2, err := second.RatchetEncrypt([]byte("second"), nil)
+	require.NoError(t, err)
+
+	d2, err := bob.RatchetDecrypt(m2, nil)
+	require.NoError(t, err)
+	reply, err := bob.RatchetEncrypt([]byte("reply"), nil)
+	require.NoError(t, err)
+
+	dr, err := first.RatchetDecrypt(reply, nil)
+	require.NoError(t, err)
+
+	// Assert.
+	require.EqualValues(t, 0, m1.Header.N)
+	require.EqualValues(t, 1, m2.Header.N)
+	require.Equal(t, []byte("second"), d2)
+	require.Equal(t, []byte("reply"), dr)
+
+	d1, err := bob.RatchetDecrypt(m1, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), d1)
+}
+
+func TestLoad_AppliesOptionsOnce(t *testing.T) {
+	// Arrange.
+	store := &versionedStorageInMemory{}
+	l, err := NewFileLocker(t.TempDir())
+	require.NoError(t, err)
+	_, err = NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), store, WithSessionLocker(l))
+	require.NoError(t, err)
+
+	applied := 0
+	counting := func(s *State) error {
+		applied++
+		return nil
+	}
+
+	// Act.
+	_, err = Load([]byte("alice"), store, WithSessionLocker(l), counting)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, 1, applied)
+}
+
+func TestSession_SessionLocker_Error(t *testing.T) {
+	// Arrange.
+	var (
+		store   = &versionedStorageInMemory{}
+		errLock = errors.New("lock failed")
+		l       = lockerFunc(func(id []byte) (func() error, error) { return nil, errLock })
+	)
+	s, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), store)
+	require.NoError(t, err)
+	s, err = Load([]byte("alice"), store, WithSessionLocker(l))
+	require.NoError(t, err)
+
+	// Act.
+	_, err = s.RatchetEncrypt([]byte("hi"), nil)
+
+	// Assert.
+	require.ErrorIs(t, err, errLock)
+}
+
+// lockerFunc is a SessionLocker calling the function.
+type lockerFunc func(id []byte) (func() error, error)
+
+func (f lockerFunc) Lock(id []byte) (func() error, error) {
+	return f(id)
+}
+
+func TestNew_SessionLockerWithoutStorage(t *testing.T) {
+	// Arrange.
+	l, err := NewFileLocker(t.TempDir())
+	require.NoError(t, err)
+
+	// Act.
+	_, err = New([]byte("bob"), sk, bobPair, nil, WithSessionLocker(l))
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+// versionedStorageInMemory rejects stale writes like persistent storages do.
+type versionedStorageInMemory struct {
+	mu sync.Mutex
+	sessionStorageInMemory
+}
+
+func (s *versionedStorageInMemory) Save(id []byte, state *State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := CheckVersion(id, state, s.states[string(id)].Version); err != nil {
+		return err
+	}
+	return s.sessionStorageInMemory.Save(id, state)
+}
+
+func (s *versionedStorageInMemory) Load(id []byte) (*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sessionStorageInMemory.Load(id)
+}
@@ -0,0 +1,264 @@
+package doubleratchet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Address identifies a device of a remote party.
+type Address struct {
+	// Identity is the long-term identity of the remote party, e.g. its public identity key.
+	Identity []byte
+
+	// DeviceID identifies one of the party's devices.
+	DeviceID uint32
+}
+
+// SessionID returns the id of the session with the device in the session storage.
+func (a Address) SessionID() []byte {
+	id := binary.AppendUvarint(nil, uint64(len(a.Identity)))
+	id = append(id, a.Identity...)
+	return binary.BigEndian.AppendUint32(id, a.DeviceID)
+}
+
+// DeviceStorage is implemented by session storages able to keep the list of a party's devices.
+// SessionManager requires it to know which devices to encrypt for after a restart.
+type DeviceStorage interface {
+	// SaveDevices replaces the list of devices of the party with the given identity.
+	SaveDevices(identity []byte, deviceIDs []uint32) error
+
+	// LoadDevices returns sorted ids of the party's devices, nil if there are none.
+	LoadDevices(identity []byte) ([]uint32, error)
+}
+
+// SessionManager keeps one Session per remote device on top of a SessionStorage.
+// The storage must implement DeviceStorage, the list of a party's devices is kept there
+// and updated when sessions with devices are created or removed.
+type SessionManager struct {
+	storage SessionStorage
+	devices DeviceStorage
+	opts    []option
+
+	mu       sync.Mutex
+	sessions map[string]map[uint32]Session
+}
+
+// NewSessionManager creates a session manager. opts are passed to every created or loaded session.
+func NewSessionManager(storage SessionStorage, opts ...option) (*SessionManager, error) {
+	if storage == nil {
+		return nil, fmt.Errorf("SessionStorage mustn't be nil")
+	}
+	devices, ok := storage.(DeviceStorage)
+	if !ok {
+		return nil, fmt.Errorf("SessionStorage must implement DeviceStorage")
+	}
+	return &SessionManager{
+		storage:  storage,
+		devices:  devices,
+		opts:     opts,
+		sessions: make(map[string]map[uint32]Session),
+	}, nil
+}
+
+// Initiate creates a session with the device out of the shared key and the device's public key,
+// see NewWithRemoteKey. An existing session with the device is considered stale and replaced,
+// its message keys are deleted.
+func (m *SessionManager) Initiate(addr Address, sharedKey, remoteKey Key) (Session, error) {
+	if err := m.deleteStale(addr); err != nil {
+		return nil, err
+	}
+	s, err := NewWithRemoteKey(addr.SessionID(), sharedKey, remoteKey, m.storage, m.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.add(addr, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accept creates a session with the device out of the shared key and the self key pair,
+// see New. An existing session with the device is considered stale and replaced,
+// its message keys are deleted.
+func (m *SessionManager) Accept(addr Address, sharedKey Key, keyPair DHPair) (Session, error) {
+	if err := m.deleteStale(addr); err != nil {
+		return nil, err
+	}
+	s, err := New(addr.SessionID(), sharedKey, keyPair, m.storage, m.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.add(addr, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Session returns the session with the device loading it from the storage if needed.
+// It returns nil if there's no session with the device.
+func (m *SessionManager) Session(addr Address) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.sessionLocked(addr)
+}
+
+func (m *SessionManager) sessionLocked(addr Address) (Session, error) {
+	if s, ok := m.sessions[string(addr.Identity)][addr.DeviceID]; ok {
+		return s, nil
+	}
+
+	s, err := Load(addr.SessionID(), m.storage, m.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("can't load session: %w", err)
+	}
+	if s == nil {
+		return nil, nil
+	}
+	m.cacheLocked(addr, s)
+	return s, nil
+}
+
+// Devices returns sorted ids of the party's devices with sessions.
+func (m *SessionManager) Devices(identity []byte) ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.devices.LoadDevices(identity)
+}
+
+// RemoveDevice forgets the session with the device. The session is also deleted from the storage
+// if the storage implements SessionDeleter, otherwise Session would load it again.
+func (m *SessionManager) RemoveDevice(addr Address) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if d, ok := m.storage.(SessionDeleter); ok {
+		if err := d.Delete(addr.SessionID()); err != nil {
+			return fmt.Errorf("can't delete session: %w", err)
+		}
+	}
+
+	ids, err := m.devices.LoadDevices(addr.Identity)
+	if err != nil {
+		return fmt.Errorf("can't load devices: %w", err)
+	}
+	kept := ids[:0]
+	for _, id := range ids {
+		if id != addr.DeviceID {
+			kept = append(kept, id)
+		}
+	}
+	if err := m.devices.SaveDevices(addr.Identity, kept); err != nil {
+		return fmt.Errorf("can't save devices: %w", err)
+	}
+
+	devices := m.sessions[string(addr.Identity)]
+	delete(devices, addr.DeviceID)
+	if len(devices) == 0 {
+		delete(m.sessions, string(addr.Identity))
+	}
+	return nil
+}
+
+// Encrypt encrypts the plaintext for every device of the party. It returns messages
+// indexed by device id. Devices are processed in the order of their ids and the sessions of
+// devices processed before a failure have already advanced, so along with the error Encrypt
+// returns the messages encrypted so far, they should be sent anyway.
+func (m *SessionManager) Encrypt(identity, plaintext, ad []byte) (map[uint32]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids, err := m.devices.LoadDevices(identity)
+	if err != nil {
+		return nil, fmt.Errorf("can't load devices: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no sessions with %x", identity)
+	}
+
+	msgs := make(map[uint32]Message, len(ids))
+	for _, id := range ids {
+		s, err := m.sessionLocked(Address{Identity: identity, DeviceID: id})
+		if err == nil && s == nil {
+			err = fmt.Errorf("session is missing")
+		}
+		if err != nil {
+			return msgs, fmt.Errorf("can't encrypt for device %d: %w", id, err)
+		}
+		msg, err := s.RatchetEncrypt(plaintext, ad)
+		if err != nil {
+			return msgs, fmt.Errorf("can't encrypt for device %d: %w", id, err)
+		}
+		msgs[id] = msg
+	}
+	return msgs, nil
+}
+
+// Decrypt decrypts the message received from the device.
+func (m *SessionManager) Decrypt(addr Address, msg Message, ad []byte) ([]byte, error) {
+	s, err := m.Session(addr)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("no session with device %d of %x", addr.DeviceID, addr.Identity)
+	}
+	return s.RatchetDecrypt(msg, ad)
+}
+
+// maxSeqNum is the highest sequence number of message keys storages must accept.
+const maxSeqNum = ^uint(0) >> 1
+
+// deleteStale deletes the stored session with the device, if any, along with its message keys
+// if the storage implements SessionDeleter, so that they neither outlive the session nor count
+// against the keys of the session replacing it.
+func (m *SessionManager) deleteStale(addr Address) error {
+	d, ok := m.storage.(SessionDeleter)
+	if !ok {
+		return nil
+	}
+	if err := d.Delete(addr.SessionID()); err != nil {
+		return fmt.Errorf("can't delete stale session: %w", err)
+	}
+	return nil
+}
+
+// add registers the device of the new session in the storage. Message keys left under
+// the session id in the keys storage of the session, i.e. those of a replaced session, are deleted.
+func (m *SessionManager) add(addr Address, s Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ss, ok := s.(*sessionState); ok {
+		if err := ss.MkSkipped.DeleteOldMks(addr.SessionID(), maxSeqNum); err != nil {
+			return fmt.Errorf("can't delete message keys of stale session: %w", err)
+		}
+	}
+
+	ids, err := m.devices.LoadDevices(addr.Identity)
+	if err != nil {
+		return fmt.Errorf("can't load devices: %w", err)
+	}
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= addr.DeviceID })
+	if i == len(ids) || ids[i] != addr.DeviceID {
+		ids = append(ids[:i], append([]uint32{addr.DeviceID}, ids[i:]...)...)
+		if err := m.devices.SaveDevices(addr.Identity, ids); err != nil {
+			return fmt.Errorf("can't save devices: %w", err)
+		}
+	}
+
+	m.cacheLocked(addr, s)
+	return nil
+}
+
+func (m *SessionManager) cacheLocked(addr Address, s Session) {
+	devices, ok := m.sessions[string(addr.Identity)]
+	if !ok {
+		devices = make(map[uint32]Session)
+		m.sessions[string(addr.Identity)] = devices
+	}
+	devices[addr.DeviceID] = s
+}
@@ -0,0 +1,275 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var bobIdentity = []byte("bob")
+
+// newBobDevice creates a session of Bob's device and a matching session in Alice's manager.
+func newBobDevice(t *testing.T, m *SessionManager, deviceID uint32) Session {
+	pair, err := DefaultCrypto{}.GenerateDH()
+	require.NoError(t, err)
+
+	bob, err := New([]byte("bob"), sk, pair, nil)
+	require.NoError(t, err)
+
+	_, err = m.Initiate(Address{Identity: bobIdentity, DeviceID: deviceID}, sk, pair.PublicKey())
+	require.NoError(t, err)
+
+	return bob
+}
+
+func TestNewSessionManager_NoStorage(t *testing.T) {
+	// Act.
+	_, err := NewSessionManager(nil)
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+func TestNewSessionManager_NoDeviceStorage(t *testing.T) {
+	// Act.
+	_, err := NewSessionManager(&sessionStorageInMemory{})
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+func TestSessionManager_Encrypt(t *testing.T) {
+	// Arrange.
+	m, err := NewSessionManager(&managerStorageInMemory{})
+	require.NoError(t, err)
+
+	devices := map[uint32]Session{
+		1: newBobDevice(t, m, 1),
+		2: newBobDevice(t, m, 2),
+	}
+
+	// Act.
+	msgs, err := m.Encrypt(bobIdentity, []byte("Hi Bob!"), nil)
+
+	// Assert.
+	require.NoError(t, err)
+	requireDevices(t, m, 1, 2)
+	require.Len(t, msgs, 2)
+	for id, bob := range devices {
+		d, err := bob.RatchetDecrypt(msgs[id], nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hi Bob!"), d)
+
+		reply, err := bob.RatchetEncrypt([]byte("Hi Alice!"), nil)
+		require.NoError(t, err)
+
+		d, err = m.Decrypt(Address{Identity: bobIdentity, DeviceID: id}, reply, nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hi Alice!"), d)
+	}
+}
+
+func TestSessionManager_Encrypt_NoDevices(t *testing.T) {
+	// Arrange.
+	m, err := NewSessionManager(&managerStorageInMemory{})
+	require.NoError(t, err)
+
+	// Act.
+	_, err = m.Encrypt(bobIdentity, []byte("Hi Bob!"), nil)
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+func TestSessionManager_StaleSessionReplacement(t *testing.T) {
+	// Arrange.
+	m, err := NewSessionManager(&managerStorageInMemory{})
+	require.NoError(t, err)
+	stale := newBobDevice(t, m, 1)
+
+	// Act.
+	fresh := newBobDevice(t, m, 1)
+	msgs, err := m.Encrypt(bobIdentity, []byte("Hi Bob!"), nil)
+	require.NoError(t, err)
+
+	// Assert.
+	requireDevices(t, m, 1)
+
+	_, err = stale.RatchetDecrypt(msgs[1], nil)
+	require.NotNil(t, err)
+
+	d, err := fresh.RatchetDecrypt(msgs[1], nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi Bob!"), d)
+}
+
+func TestSessionManager_StaleSessionReplacement_DeletesKeys(t *testing.T) {
+	// Arrange.
+	var (
+		ks   = &KeysStorageInMemory{}
+		addr = Address{Identity: []byte("alice"), DeviceID: 1}
+	)
+	m, err := NewSessionManager(&managerStorageInMemory{}, WithKeysStorage(ks))
+	require.NoError(t, err)
+	_, err = m.Accept(addr, sk, bobPair)
+	require.NoError(t, err)
+
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	require.NoError(t, err)
+	var last Message
+	for i := 0; i < 3; i++ {
+		last, err = alice.RatchetEncrypt([]byte("Hi Bob!"), nil)
+		require.NoError(t, err)
+	}
+	_, err = m.Decrypt(addr, last, nil)
+	require.NoError(t, err)
+	require.NotZero(t, countKeys(t, ks))
+
+	// Act.
+	_, err = m.Accept(addr, sk, bobPair)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Zero(t, countKeys(t, ks))
+}
+
+func countKeys(t *testing.T, ks KeysStorage) int {
+	all, err := ks.All()
+	require.NoError(t, err)
+	n := 0
+	for _, keys := range all {
+		n += len(keys)
+	}
+	return n
+}
+
+func TestSessionManager_RemoveDevice(t *testing.T) {
+	// Arrange.
+	store := &managerStorageInMemory{}
+	m, err := NewSessionManager(store)
+	require.NoError(t, err)
+	newBobDevice(t, m, 1)
+	newBobDevice(t, m, 2)
+
+	// Act.
+	err = m.RemoveDevice(Address{Identity: bobIdentity, DeviceID: 1})
+
+	// Assert.
+	require.NoError(t, err)
+	requireDevices(t, m, 2)
+
+	msgs, err := m.Encrypt(bobIdentity, []byte("Hi Bob!"), nil)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	s, err := m.Session(Address{Identity: bobIdentity, DeviceID: 1})
+	require.NoError(t, err)
+	require.Nil(t, s)
+}
+
+func TestSessionManager_Restart(t *testing.T) {
+	// Arrange.
+	store := &managerStorageInMemory{}
+	m, err := NewSessionManager(store)
+	require.NoError(t, err)
+	bob := newBobDevice(t, m, 7)
+
+	// Act.
+	restarted, err := NewSessionManager(store)
+	require.NoError(t, err)
+
+	msgs, err := restarted.Encrypt(bobIdentity, []byte("Hi Bob!"), nil)
+
+	// Assert.
+	require.NoError(t, err)
+	requireDevices(t, restarted, 7)
+
+	d, err := bob.RatchetDecrypt(msgs[7], nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi Bob!"), d)
+
+	s, err := restarted.Session(Address{Identity: bobIdentity, DeviceID: 7})
+	require.NoError(t, err)
+	require.NotNil(t, s)
+}
+
+func TestSessionManager_Encrypt_PartialFailure(t *testing.T) {
+	// Arrange.
+	store := &managerStorageInMemory{}
+	m, err := NewSessionManager(store)
+	require.NoError(t, err)
+	bob := newBobDevice(t, m, 1)
+	newBobDevice(t, m, 2)
+	store.failSave = Address{Identity: bobIdentity, DeviceID: 2}.SessionID()
+
+	// Act.
+	msgs, err := m.Encrypt(bobIdentity, []byte("Hi Bob!"), nil)
+
+	// Assert.
+	require.ErrorIs(t, err, errSaveFailed)
+	require.Len(t, msgs, 1)
+
+	d, err := bob.RatchetDecrypt(msgs[1], nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi Bob!"), d)
+}
+
+func TestAddress_SessionID(t *testing.T) {
+	// Act.
+	a := Address{Identity: []byte("ab"), DeviceID: 1}.SessionID()
+	b := Address{Identity: []byte("a"), DeviceID: 1}.SessionID()
+
+	// Assert.
+	require.NotEqual(t, a, b)
+}
+
+func requireDevices(t *testing.T, m *SessionManager, ids ...uint32) {
+	devices, err := m.Devices(bobIdentity)
+	require.NoError(t, err)
+	require.Equal(t, ids, devices)
+}
+
+var errSaveFailed = errors.New("save failed")
+
+// managerStorageInMemory is a session storage implementing DeviceStorage and SessionDeleter.
+type managerStorageInMemory struct {
+	sessionStorageInMemory
+
+	devices map[string][]uint32
+
+	// failSave is the id of the session which fails to be saved.
+	failSave []byte
+}
+
+func (s *managerStorageInMemory) Save(id []byte, state *State) error {
+	if s.failSave != nil && bytes.Equal(id, s.failSave) {
+		return errSaveFailed
+	}
+	return s.sessionStorageInMemory.Save(id, state)
+}
+
+func (s *managerStorageInMemory) Delete(id []byte) error {
+	delete(s.states, string(id))
+	return nil
+}
+
+func (s *managerStorageInMemory) SaveDevices(identity []byte, deviceIDs []uint32) error {
+	if s.devices == nil {
+		s.devices = make(map[string][]uint32)
+	}
+	ids := append([]uint32{}, deviceIDs...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	s.devices[string(identity)] = ids
+	return nil
+}
+
+func (s *managerStorageInMemory) LoadDevices(identity []byte) ([]uint32, error) {
+	ids := s.devices[string(identity)]
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return append([]uint32{}, ids...), nil
+}
@@ -7,3 +7,10 @@ type SessionStorage interface {
 	// Load state by id
 	Load(id []byte) (*State, error)
 }
+
+// SessionDeleter is implemented by session storages able to delete sessions.
+// SessionManager uses it to drop sessions of removed devices.
+type SessionDeleter interface {
+	// Delete the state and the skipped message keys of the session keyed by id.
+	Delete(id []byte) error
+}
@@ -69,9 +69,12 @@ func TestSession_RatchetEncrypt_Basic(t *testing.T) {
 	require.NotEqual(t, oldCKs, s.SendCh.CK)
 	require.EqualValues(t, 1, s.SendCh.N)
 	require.Equal(t, MessageHeader{
-		DH: s.DHs.PublicKey(),
-		N:  0,
-		PN: 0,
+		Version:    ProtocolVersion,
+		MaxVersion: ProtocolVersion,
+		Suite:      CryptoSuiteDefault,
+		DH:         s.DHs.PublicKey(),
+		N:          0,
+		PN:         0,
 	}, m.Header)
 	require.NotEmpty(t, m.Ciphertext)
 }
@@ -0,0 +1,165 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// signalMACSize is the length of the truncated MAC appended to Signal messages.
+const signalMACSize = 8
+
+// SignalCrypto is an implementation of Crypto compatible with libsignal:
+//
+//  1. KDF_RK is HKDF-SHA-256 with "WhisperRatchet" info, no header key is derived.
+//  2. KDF_CK is HMAC-SHA-256 with 0x01 for the message key and 0x02 for the next chain key.
+//  3. ENCRYPT is AES-256-CBC with PKCS#7 padding and HMAC-SHA-256 truncated to 8 bytes, keys and IV
+//     are derived from the message key with HKDF-SHA-256 and "WhisperMessageKeys" info.
+//
+// The MAC covers the serialized SignalMessage, so the associated data passed to sessions must be
+// the sender's identity key followed by the receiver's one, both 33 bytes long, and messages must be
+// sent in the SignalMessage format. Messages decoded by SignalMessage.Decode are authenticated as
+// received. SignalCrypto doesn't support header encryption.
+type SignalCrypto struct {
+	DefaultCrypto
+}
+
+// Suite returns CryptoSuiteSignal.
+func (c SignalCrypto) Suite() CryptoSuite {
+	return CryptoSuiteSignal
+}
+
+// KdfRK returns the next root key and chain key. The header key is always nil.
+func (c SignalCrypto) KdfRK(rk, dhOut Key) (Key, Key, Key) {
+	var (
+		r   = hkdf.New(sha256.New, dhOut, rk, []byte("WhisperRatchet"))
+		buf = make([]byte, 64)
+	)
+
+	// The only error here is an entropy limit which won't be reached for such a short buffer.
+	_, _ = io.ReadFull(r, buf)
+
+	return Key(buf[:32]), Key(buf[32:]), nil
+}
+
+// KdfCK returns the next chain key and the message key seed.
+func (c SignalCrypto) KdfCK(ck Key) (Key, Key) {
+	const (
+		mkInput = 0x01
+		ckInput = 0x02
+	)
+
+	h := hmac.New(sha256.New, ck)
+
+	_, _ = h.Write([]byte{ckInput})
+	chainKey := Key(h.Sum(nil))
+	h.Reset()
+
+	_, _ = h.Write([]byte{mkInput})
+	msgKey := Key(h.Sum(nil))
+
+	return chainKey, msgKey
+}
+
+// AssociatedData returns the MAC input preceding the ciphertext: ad, the version byte and
+// the serialized header of the SignalMessage.
+func (c SignalCrypto) AssociatedData(ad []byte, h MessageHeader) []byte {
+	buf := append(append([]byte{}, ad...), signalMessageVersionByte)
+	return appendSignalHeader(buf, h)
+}
+
+// Encrypt returns the AES-256-CBC ciphertext followed by the truncated MAC.
+func (c SignalCrypto) Encrypt(mk Key, plaintext, ad []byte) ([]byte, error) {
+	encKey, macKey, iv := c.deriveMessageKeys(mk)
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	var (
+		block, _   = aes.NewCipher(encKey) // No error will occur here as encKey is guaranteed to be 32 bytes.
+		ciphertext = make([]byte, len(padded))
+	)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	return append(ciphertext, c.computeMAC(macKey, ciphertext, ad)...), nil
+}
+
+// Decrypt verifies the truncated MAC and returns the decrypted plaintext.
+func (c SignalCrypto) Decrypt(mk Key, authCiphertext, ad []byte) ([]byte, error) {
+	return c.decrypt(mk, authCiphertext, func(macKey, ciphertext []byte) []byte {
+		return c.computeMAC(macKey, ciphertext, ad)
+	})
+}
+
+// decryptReceived verifies the truncated MAC over ad followed by the received SignalMessage
+// without the MAC, so that messages encoded differently by other implementations are accepted.
+func (c SignalCrypto) decryptReceived(mk Key, authCiphertext, ad, received []byte) ([]byte, error) {
+	return c.decrypt(mk, authCiphertext, func(macKey, ciphertext []byte) []byte {
+		if !bytes.Contains(received, ciphertext) {
+			// The ciphertext isn't the received one, fail the check.
+			return nil
+		}
+		h := hmac.New(sha256.New, macKey)
+		_, _ = h.Write(ad)
+		_, _ = h.Write(received)
+		return h.Sum(nil)[:signalMACSize]
+	})
+}
+
+// decrypt checks the MAC returned by mac and decrypts the ciphertext.
+func (c SignalCrypto) decrypt(mk Key, authCiphertext []byte, mac func(macKey, ciphertext []byte) []byte) ([]byte, error) {
+	l := len(authCiphertext) - signalMACSize
+	if l < aes.BlockSize || l%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: invalid ciphertext length %d", ErrAuthFailed, len(authCiphertext))
+	}
+	ciphertext := authCiphertext[:l]
+
+	encKey, macKey, iv := c.deriveMessageKeys(mk)
+	if !hmac.Equal(mac(macKey, ciphertext), authCiphertext[l:]) {
+		return nil, ErrAuthFailed
+	}
+
+	var (
+		block, _  = aes.NewCipher(encKey) // No error will occur here as encKey is guaranteed to be 32 bytes.
+		plaintext = make([]byte, l)
+	)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[l-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, fmt.Errorf("%w: invalid padding", ErrAuthFailed)
+	}
+	for _, b := range plaintext[l-padding:] {
+		if int(b) != padding {
+			return nil, fmt.Errorf("%w: invalid padding", ErrAuthFailed)
+		}
+	}
+	return plaintext[:l-padding], nil
+}
+
+// deriveMessageKeys derives the cipher key, the MAC key and the IV out of the message key seed.
+func (c SignalCrypto) deriveMessageKeys(mk Key) ([]byte, []byte, []byte) {
+	var (
+		r   = hkdf.New(sha256.New, mk, make([]byte, 32), []byte("WhisperMessageKeys"))
+		buf = make([]byte, 80)
+	)
+
+	// The only error here is an entropy limit which won't be reached for such a short buffer.
+	_, _ = io.ReadFull(r, buf)
+
+	return buf[0:32], buf[32:64], buf[64:80]
+}
+
+// computeMAC returns the MAC of the serialized SignalMessage, which is ad followed by the ciphertext field.
+func (c SignalCrypto) computeMAC(macKey, ciphertext, ad []byte) []byte {
+	h := hmac.New(sha256.New, macKey)
+	_, _ = h.Write(ad)
+	_, _ = h.Write(appendProtoBytes(nil, signalFieldCiphertext, ciphertext))
+	return h.Sum(nil)[:signalMACSize]
+}
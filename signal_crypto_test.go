@@ -0,0 +1,275 @@
+package doubleratchet
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func TestSignalCrypto_KdfCK(t *testing.T) {
+	// Arrange.
+	// The seed and the next chain key are from libsignal's ChainKeyTest, message keys were recorded.
+	seed := mustHex(t, "8ab72d6f4cc5ac0d387eaf463378ddb28edd07385b1cb01250c715982e7ad48f")
+
+	// Act.
+	ck, mk := SignalCrypto{}.KdfCK(seed)
+	encKey, macKey, iv := SignalCrypto{}.deriveMessageKeys(mk)
+
+	// Assert.
+	require.Equal(t, "28e8f8fee54b801eef7c5cfb2f17f32c7b334485bbb70fac6ec10342a246d15d", ck.String())
+	require.Equal(t, "bf51e9d75e0e31031051f82a2491ffc084fa298b7793bd9db620056febf45217", hex.EncodeToString(encKey))
+	require.Equal(t, "c6c77d6a73a354337a56435e34607dfe48e3ace14e77314dc6abc172e7a7030b", hex.EncodeToString(macKey))
+	require.Equal(t, "afa8207986b692a116d4b40bbff72d6c", hex.EncodeToString(iv))
+}
+
+func TestSignalCrypto_KdfRK(t *testing.T) {
+	// Act.
+	rk, ck, hk := SignalCrypto{}.KdfRK(sk, bobPair.PublicKey())
+
+	// Assert.
+	require.Len(t, rk, 32)
+	require.Len(t, ck, 32)
+	require.Nil(t, hk)
+	require.NotEqual(t, rk, ck)
+}
+
+func TestSignalCrypto_EncryptDecrypt(t *testing.T) {
+	for _, pt := range [][]byte{nil, []byte("1337"), make([]byte, 16), make([]byte, 33)} {
+		// Act.
+		ct, err := SignalCrypto{}.Encrypt(sk, pt, []byte("ad"))
+		require.NoError(t, err)
+		d, err := SignalCrypto{}.Decrypt(sk, ct, []byte("ad"))
+
+		// Assert.
+		require.NoError(t, err)
+		require.Equal(t, len(pt), len(d))
+		require.Equal(t, (len(pt)/16+1)*16+signalMACSize, len(ct))
+
+		_, err = SignalCrypto{}.Decrypt(sk, ct, []byte("other"))
+		require.True(t, errors.Is(err, ErrAuthFailed), err)
+		_, err = SignalCrypto{}.Decrypt(sk, ct[1:], []byte("ad"))
+		require.True(t, errors.Is(err, ErrAuthFailed), err)
+	}
+}
+
+func TestSignalMessage_Vector(t *testing.T) {
+	// Arrange.
+	// Recorded with this implementation and cross-checked with OpenSSL AES-256-CBC and HMAC-SHA-256,
+	// see TestSignalMessage_LibsignalVector for a message serialized by libsignal.
+	var (
+		mk = mustHex(t, "8ab72d6f4cc5ac0d387eaf463378ddb28edd07385b1cb01250c715982e7ad48f")
+		ad = append(append([]byte{0x05}, make([]byte, 32)...), append([]byte{0x05}, make([]byte, 32)...)...)
+		h  = MessageHeader{Version: 1, MaxVersion: 1, Suite: CryptoSuiteSignal, DH: bobPair.PublicKey(), N: 3, PN: 300}
+		c  = SignalCrypto{}
+	)
+
+	// Act.
+	ct, err := c.Encrypt(mk, []byte("Hi Bob!"), c.AssociatedData(ad, h))
+	require.NoError(t, err)
+	sm, err := NewSignalMessage(Message{Header: h, Ciphertext: ct})
+	require.NoError(t, err)
+	m, err := sm.Decode()
+	require.NoError(t, err)
+
+	// Assert.
+	require.Equal(t, ""+
+		"33"+
+		"0a21"+"05"+bobPair.PublicKey().String()+
+		"1003"+
+		"18ac02"+
+		"2210"+"6d39ba6cc81504901f71ec0435ecff42"+
+		"e8b9bc0df5dbb096", hex.EncodeToString(sm))
+	require.Equal(t, h, m.Header)
+	require.Equal(t, ct, m.Ciphertext)
+
+	d, err := c.Decrypt(mk, m.Ciphertext, c.AssociatedData(ad, m.Header))
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi Bob!"), d)
+}
+
+// libsignalVector is a SignalMessage with "Hi Bob!" serialized and authenticated by go.mau.fi/libsignal
+// v0.2.1, a Go port of libsignal-protocol-java: the chain key at index 3 is the seed of TestSignalCrypto_KdfCK,
+// the ratchet key is bobPair's public key, the previous counter is 300, the sender's identity key is
+// alicePair's public key and the receiver's one is sk. It is printed by the following program built against
+// go.mau.fi/libsignal v0.2.1 (key32 decodes a hex string into a [32]byte):
+//
+//	seed, _ := hex.DecodeString("8ab72d6f4cc5ac0d387eaf463378ddb28edd07385b1cb01250c715982e7ad48f")
+//	ck := chain.NewKey(kdf.DeriveSecrets, seed, 3)
+//	mk := ck.MessageKeys()
+//	ct, _ := cipher.EncryptCbc(mk.Iv(), mk.CipherKey(), []byte("Hi Bob!"))
+//	sm, _ := protocol.NewSignalMessage(3, ck.Index(), 300, mk.MacKey(),
+//		ecc.NewDjbECPublicKey(key32("e3beb94e7017370c018fa97eef04fb23acea28f7a956cc1d46f3b51d7d7d5e2c")), ct,
+//		identity.NewKey(ecc.NewDjbECPublicKey(key32("3b935764d147f10fc71301c6f9ed49a4ad599287b100f14a8e434da72e3df872"))),
+//		identity.NewKey(ecc.NewDjbECPublicKey(key32("eb08107c33540020e94f6c84e439505a2f60be810a788beb1e2c098d4b4dc140"))),
+//		serialize.NewProtoBufSerializer().SignalMessage)
+//	fmt.Println(hex.EncodeToString(sm.Serialize()))
+const libsignalVector = "" +
+	"33" +
+	"0a21" + "05" + "e3beb94e7017370c018fa97eef04fb23acea28f7a956cc1d46f3b51d7d7d5e2c" +
+	"1003" +
+	"18ac02" +
+	"2210" + "1f9f701cd1d8c6fa4730c064712d7ed4" +
+	"57c579266b5ae6ea"
+
+// libsignalAD returns the MAC prefix of libsignalVector: the sender's and the receiver's identity keys.
+func libsignalAD() []byte {
+	return append(append([]byte{0x05}, alicePair.PublicKey()...), append([]byte{0x05}, sk...)...)
+}
+
+func TestSignalMessage_LibsignalVector(t *testing.T) {
+	// Arrange.
+	var (
+		c     = SignalCrypto{}
+		_, mk = c.KdfCK(mustHex(t, "8ab72d6f4cc5ac0d387eaf463378ddb28edd07385b1cb01250c715982e7ad48f"))
+	)
+
+	// Act.
+	m, err := SignalMessage(mustHex(t, libsignalVector)).Decode()
+	require.NoError(t, err)
+	d, err := decryptMessage(c, mk, m, libsignalAD())
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi Bob!"), d)
+	require.Equal(t, bobPair.PublicKey(), m.Header.DH)
+	require.EqualValues(t, 3, m.Header.N)
+	require.EqualValues(t, 300, m.Header.PN)
+
+	sm, err := NewSignalMessage(m)
+	require.NoError(t, err)
+	require.Equal(t, libsignalVector, hex.EncodeToString(sm))
+}
+
+func TestSignalMessage_DecryptAsReceived(t *testing.T) {
+	// Arrange.
+	var (
+		c      = SignalCrypto{}
+		_, mk  = c.KdfCK(mustHex(t, "8ab72d6f4cc5ac0d387eaf463378ddb28edd07385b1cb01250c715982e7ad48f"))
+		ad     = libsignalAD()
+		ct     = mustHex(t, "1f9f701cd1d8c6fa4730c064712d7ed4")
+		header = append([]byte{0x05}, bobPair.PublicKey()...)
+	)
+	// Valid for protobuf, but differs from the encoding of NewSignalMessage: fields are reordered,
+	// the counter is a non-minimal varint and there are unknown fields.
+	received := []byte{signalMessageVersionByte}
+	received = appendProtoBytes(received, signalFieldCiphertext, ct)
+	received = append(received, 0x10, 0x83, 0x00)
+	received = append(received, 0x28, 0x01)
+	received = appendProtoBytes(received, signalFieldRatchetKey, header)
+	received = appendProtoVarint(received, signalFieldPreviousCounter, 300)
+
+	_, macKey, _ := c.deriveMessageKeys(mk)
+	h := hmac.New(sha256.New, macKey)
+	h.Write(ad)
+	h.Write(received)
+	sm := SignalMessage(append(received, h.Sum(nil)[:signalMACSize]...))
+
+	// Act.
+	m, err := sm.Decode()
+	require.NoError(t, err)
+	d, err := decryptMessage(c, mk, m, ad)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi Bob!"), d)
+
+	_, err = c.Decrypt(mk, m.Ciphertext, c.AssociatedData(ad, m.Header))
+	require.True(t, errors.Is(err, ErrAuthFailed), "the re-encoding isn't authenticated")
+
+	m.Ciphertext = append(make([]byte, aes.BlockSize), m.Ciphertext[aes.BlockSize:]...)
+	_, err = decryptMessage(c, mk, m, ad)
+	require.True(t, errors.Is(err, ErrAuthFailed), "the ciphertext must be the received one")
+}
+
+func TestSignalMessage_Decode_Invalid(t *testing.T) {
+	// Arrange.
+	sm, err := NewSignalMessage(Message{Header: MessageHeader{DH: bobPair.PublicKey(), N: 1}, Ciphertext: make([]byte, 24)})
+	require.NoError(t, err)
+
+	cases := map[string][]byte{
+		"empty":            nil,
+		"version":          append([]byte{0x23}, sm[1:]...),
+		"truncated":        append(append([]byte{}, sm[:20]...), sm[len(sm)-signalMACSize:]...),
+		"no ratchet key":   append([]byte{0x33, 0x10, 0x01, 0x22, 0x00}, make([]byte, signalMACSize)...),
+		"short key":        append([]byte{0x33, 0x0a, 0x01, 0x05, 0x10, 0x01, 0x22, 0x00}, make([]byte, signalMACSize)...),
+		"bad wire type":    append([]byte{0x33, 0x0f}, make([]byte, signalMACSize)...),
+		"counter overflow": append([]byte{0x33, 0x10, 0xff, 0xff, 0xff, 0xff, 0x7f}, make([]byte, signalMACSize)...),
+	}
+	for name, data := range cases {
+		// Act.
+		_, err := SignalMessage(data).Decode()
+
+		// Assert.
+		require.True(t, errors.Is(err, ErrMalformedHeader), "%s: %v", name, err)
+	}
+}
+
+func TestSignalMessage_Decode_UnknownFields(t *testing.T) {
+	// Arrange.
+	m := Message{Header: MessageHeader{Version: 1, MaxVersion: 1, Suite: CryptoSuiteSignal, DH: bobPair.PublicKey(), N: 1, PN: 2}, Ciphertext: make([]byte, 24)}
+	sm, err := NewSignalMessage(m)
+	require.NoError(t, err)
+	l := len(sm) - signalMACSize
+	withUnknown := append(append(append([]byte{}, sm[:l]...), 0x28, 0x01, 0x32, 0x01, 0xff), sm[l:]...)
+
+	// Act.
+	decoded, err := SignalMessage(withUnknown).Decode()
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, m.Header, decoded.Header)
+	require.Equal(t, m.Ciphertext, decoded.Ciphertext)
+}
+
+func TestSignalCrypto_Session(t *testing.T) {
+	// Arrange.
+	var (
+		c          = SignalCrypto{}
+		aliceIdent = append([]byte{0x05}, make([]byte, 32)...)
+		bobIdent   = append([]byte{0x05}, sk...)
+		aliceToBob = append(append([]byte{}, aliceIdent...), bobIdent...)
+		bobToAlice = append(append([]byte{}, bobIdent...), aliceIdent...)
+	)
+	bobPair, err := c.GenerateDH()
+	require.NoError(t, err)
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithCrypto(c))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithCrypto(c))
+	require.NoError(t, err)
+
+	// Act.
+	for i := 0; i < 3; i++ {
+		m, err := alice.RatchetEncrypt([]byte("Hi Bob!"), aliceToBob)
+		require.NoError(t, err)
+		sm, err := NewSignalMessage(m)
+		require.NoError(t, err)
+		decoded, err := sm.Decode()
+		require.NoError(t, err)
+		d, err := bob.RatchetDecrypt(decoded, aliceToBob)
+
+		// Assert.
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hi Bob!"), d)
+
+		m, err = bob.RatchetEncrypt([]byte("Hi Alice!"), bobToAlice)
+		require.NoError(t, err)
+		sm, err = NewSignalMessage(m)
+		require.NoError(t, err)
+		decoded, err = sm.Decode()
+		require.NoError(t, err)
+		d, err = alice.RatchetDecrypt(decoded, bobToAlice)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hi Alice!"), d)
+	}
+}
@@ -0,0 +1,171 @@
+package doubleratchet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// SignalMessageVersion is the version of the SignalMessage format.
+const SignalMessageVersion = 3
+
+// signalMessageVersionByte holds the message version and the highest supported one.
+const signalMessageVersionByte = SignalMessageVersion<<4 | SignalMessageVersion
+
+// signalProtocolVersion is the protocol version of decoded messages as SignalMessage
+// doesn't carry one.
+const signalProtocolVersion = 1
+
+// signalKeyType is the prefix of serialized Curve25519 public keys.
+const signalKeyType = 0x05
+
+// Protobuf field numbers of the SignalMessage.
+const (
+	signalFieldRatchetKey      = 1
+	signalFieldCounter         = 2
+	signalFieldPreviousCounter = 3
+	signalFieldCiphertext      = 4
+)
+
+// Protobuf wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// SignalMessage is a message in the libsignal wire format: the version byte, the protobuf-encoded
+// header and ciphertext, and the truncated MAC. Use it together with SignalCrypto.
+type SignalMessage []byte
+
+// NewSignalMessage serializes m encrypted with SignalCrypto.
+func NewSignalMessage(m Message) (SignalMessage, error) {
+	if m.Header.PQ != nil {
+		return nil, fmt.Errorf("post-quantum header can't be encoded as SignalMessage")
+	}
+	if m.Header.Version > signalProtocolVersion {
+		return nil, fmt.Errorf("protocol version %d can't be encoded as SignalMessage", m.Header.Version)
+	}
+	if len(m.Header.DH) != 32 {
+		return nil, fmt.Errorf("%w: ratchet key length %d", ErrMalformedHeader, len(m.Header.DH))
+	}
+	if len(m.Ciphertext) < signalMACSize {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+	var (
+		l   = len(m.Ciphertext) - signalMACSize
+		buf = appendSignalHeader([]byte{signalMessageVersionByte}, m.Header)
+	)
+	buf = appendProtoBytes(buf, signalFieldCiphertext, m.Ciphertext[:l])
+	return append(buf, m.Ciphertext[l:]...), nil
+}
+
+// Decode the message out of the wire format. Unknown fields are skipped. The header gets
+// protocol version 1 and the Signal suite. The message keeps the received bytes, so that sessions
+// with SignalCrypto verify the MAC over them rather than over a re-encoding.
+func (sm SignalMessage) Decode() (Message, error) {
+	if len(sm) < 1+signalMACSize {
+		return Message{}, fmt.Errorf("%w: SignalMessage is too short", ErrMalformedHeader)
+	}
+	if v := sm[0] >> 4; v != SignalMessageVersion {
+		return Message{}, fmt.Errorf("%w: unsupported SignalMessage version %d", ErrMalformedHeader, v)
+	}
+
+	var (
+		m = Message{Header: MessageHeader{
+			Version:    signalProtocolVersion,
+			MaxVersion: signalProtocolVersion,
+			Suite:      CryptoSuiteSignal,
+		}}
+		ciphertext []byte
+		seen       = make(map[uint64]bool)
+		data       = sm[1 : len(sm)-signalMACSize]
+	)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return Message{}, fmt.Errorf("%w: invalid field key", ErrMalformedHeader)
+		}
+		data = data[n:]
+
+		field, wireType := key>>3, key&7
+		var (
+			x     uint64
+			value []byte
+		)
+		switch wireType {
+		case protoVarint:
+			if x, n = binary.Uvarint(data); n <= 0 {
+				return Message{}, fmt.Errorf("%w: invalid varint of field %d", ErrMalformedHeader, field)
+			}
+		case protoBytes:
+			l, ln := binary.Uvarint(data)
+			if ln <= 0 || l > uint64(len(data)-ln) {
+				return Message{}, fmt.Errorf("%w: invalid length of field %d", ErrMalformedHeader, field)
+			}
+			value, n = data[ln:ln+int(l)], ln+int(l)
+		case protoFixed64:
+			n = 8
+		case protoFixed32:
+			n = 4
+		default:
+			return Message{}, fmt.Errorf("%w: unsupported wire type %d", ErrMalformedHeader, wireType)
+		}
+		if n > len(data) {
+			return Message{}, fmt.Errorf("%w: field %d is truncated", ErrMalformedHeader, field)
+		}
+		data = data[n:]
+
+		switch field {
+		case signalFieldRatchetKey:
+			if wireType != protoBytes || len(value) != 33 || value[0] != signalKeyType {
+				return Message{}, fmt.Errorf("%w: invalid ratchet key", ErrMalformedHeader)
+			}
+			m.Header.DH = append(Key{}, value[1:]...)
+		case signalFieldCounter, signalFieldPreviousCounter:
+			if wireType != protoVarint || x > 1<<32-1 {
+				return Message{}, fmt.Errorf("%w: invalid counter", ErrMalformedHeader)
+			}
+			if field == signalFieldCounter {
+				m.Header.N = uint32(x)
+			} else {
+				m.Header.PN = uint32(x)
+			}
+		case signalFieldCiphertext:
+			if wireType != protoBytes {
+				return Message{}, fmt.Errorf("%w: invalid ciphertext", ErrMalformedHeader)
+			}
+			ciphertext = value
+		default:
+			continue
+		}
+		seen[field] = true
+	}
+	for _, f := range []uint64{signalFieldRatchetKey, signalFieldCounter, signalFieldCiphertext} {
+		if !seen[f] {
+			return Message{}, fmt.Errorf("%w: field %d is missing", ErrMalformedHeader, f)
+		}
+	}
+
+	m.Ciphertext = append(append([]byte{}, ciphertext...), sm[len(sm)-signalMACSize:]...)
+	m.received = append([]byte{}, sm[:len(sm)-signalMACSize]...)
+	return m, nil
+}
+
+// appendSignalHeader appends the protobuf-encoded header fields of the SignalMessage.
+func appendSignalHeader(buf []byte, h MessageHeader) []byte {
+	buf = appendProtoBytes(buf, signalFieldRatchetKey, append([]byte{signalKeyType}, h.DH...))
+	buf = appendProtoVarint(buf, signalFieldCounter, uint64(h.N))
+	return appendProtoVarint(buf, signalFieldPreviousCounter, uint64(h.PN))
+}
+
+func appendProtoVarint(buf []byte, field, x uint64) []byte {
+	buf = binary.AppendUvarint(buf, field<<3|protoVarint)
+	return binary.AppendUvarint(buf, x)
+}
+
+func appendProtoBytes(buf []byte, field uint64, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, field<<3|protoBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
@@ -0,0 +1,75 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations are applied in order, each of them exactly once. Never modify an existing
+// migration, append a new one instead.
+var migrations = []string{
+	`CREATE TABLE doubleratchet_sessions (
+		id BLOB NOT NULL PRIMARY KEY,
+		state BLOB NOT NULL
+	);
+
+	CREATE TABLE doubleratchet_keys (
+		session_id BLOB NOT NULL,
+		public_key BLOB NOT NULL,
+		msg_num INTEGER NOT NULL,
+		message_key BLOB NOT NULL,
+		seq_num INTEGER NOT NULL,
+		PRIMARY KEY (public_key, msg_num)
+	);
+
+	CREATE INDEX doubleratchet_keys_session_key_msg_num ON doubleratchet_keys (session_id, public_key, msg_num);
+	CREATE INDEX doubleratchet_keys_session_seq_num ON doubleratchet_keys (session_id, seq_num);`,
+
+	`ALTER TABLE doubleratchet_sessions ADD COLUMN version INTEGER NOT NULL DEFAULT 0;`,
+
+	`ALTER TABLE doubleratchet_keys ADD COLUMN pending INTEGER NOT NULL DEFAULT 0;`,
+
+	// Keys stored before the creation time is recorded are backfilled by a later migration.
+	`ALTER TABLE doubleratchet_keys ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;`,
+
+	`CREATE TABLE doubleratchet_devices (
+		identity BLOB NOT NULL,
+		device_id INTEGER NOT NULL,
+		PRIMARY KEY (identity, device_id)
+	);`,
+
+	// Keys stored before the creation time is recorded are considered created now, so that
+	// they aren't expired at once. Keys are timestamped in nanoseconds.
+	`UPDATE doubleratchet_keys SET created_at = CAST(strftime('%s', 'now') AS INTEGER) * 1000000000 WHERE created_at = 0;`,
+}
+
+// migrate brings the database schema to the latest version.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS doubleratchet_migrations (version INTEGER NOT NULL PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("can't create migrations table: %s", err)
+	}
+
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM doubleratchet_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("can't get schema version: %s", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("can't apply migration %d: %s", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO doubleratchet_migrations (version) VALUES (?)`, i+1); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("can't record migration %d: %s", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+// Package sqlstore implements doubleratchet.SessionStorage, doubleratchet.DeviceStorage,
+// doubleratchet.PendingKeysStorage, doubleratchet.ExpiringKeysStorage, doubleratchet.ChainKeysStorage
+// and doubleratchet.SessionKeysStorage on top of database/sql. Queries are written in the SQLite dialect.
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/status-im/doubleratchet"
+)
+
+// querier is a subset of methods shared by *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Store keeps sessions and skipped message keys in an SQL database.
+type Store struct {
+	db *sql.DB
+	q  querier
+
+	// root is the store bound to db, loaded states refer to it.
+	root *Store
+
+	// ttl is how long message keys are kept since they are derived, used by PruneExpired.
+	ttl time.Duration
+}
+
+// option is a store option.
+type option func(*Store) error
+
+// WithKeyTTL specifies how long message keys are kept since they are derived, see PruneExpired.
+// nolint: golint
+func WithKeyTTL(ttl time.Duration) option {
+	return func(s *Store) error {
+		if ttl <= 0 {
+			return fmt.Errorf("ttl must be positive")
+		}
+		s.ttl = ttl
+		return nil
+	}
+}
+
+// New creates a store and migrates the database schema to the latest version.
+func New(db *sql.DB, opts ...option) (*Store, error) {
+	s := &Store{db: db, q: db}
+	s.root = s
+	for i := range opts {
+		if err := opts[i](s); err != nil {
+			return nil, fmt.Errorf("failed to apply option: %s", err)
+		}
+	}
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Tx is a store bound to a database transaction.
+type Tx struct {
+	*Store
+	tx *sql.Tx
+}
+
+// Commit commits the transaction.
+func (t *Tx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback aborts the transaction.
+func (t *Tx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// Begin starts a transaction. It makes Store a doubleratchet.TransactionalStorage so that
+// sessions save their state and skipped message keys atomically.
+func (s *Store) Begin() (doubleratchet.StorageTx, error) {
+	return s.begin()
+}
+
+func (s *Store) begin() (*Tx, error) {
+	if s.db == nil {
+		return nil, fmt.Errorf("nested transactions aren't supported")
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Store: &Store{q: tx, root: s.root}, tx: tx}, nil
+}
+
+// Update runs fn within a single transaction. All changes made by fn through the given store
+// are committed at once if fn returns nil and rolled back otherwise.
+func (s *Store) Update(fn func(*Store) error) error {
+	if s.db == nil {
+		// Already within a transaction.
+		return fn(s)
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx.Store); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Save state keyed by id. Stale states are rejected with *doubleratchet.VersionConflictError,
+// see doubleratchet.CheckVersion. The version is checked by the same statement which writes
+// the state, so concurrent writers can't overwrite each other.
+func (s *Store) Save(id []byte, state *doubleratchet.State) error {
+	data, err := state.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("can't encode state: %w", err)
+	}
+
+	if state.Version == 0 {
+		_, err := s.q.Exec(`INSERT OR REPLACE INTO doubleratchet_sessions (id, state, version) VALUES (?, ?, ?)`, id, data, state.Version)
+		return err
+	}
+
+	res, err := s.q.Exec(
+		`UPDATE doubleratchet_sessions SET state = ?, version = ? WHERE id = ? AND version = ?`,
+		data, state.Version, id, state.Version-1,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 && state.Version == 1 {
+		// The first change of a session which hasn't been stored yet.
+		res, err = s.q.Exec(`INSERT OR IGNORE INTO doubleratchet_sessions (id, state, version) VALUES (?, ?, ?)`, id, data, state.Version)
+		if err != nil {
+			return err
+		}
+		if n, err = res.RowsAffected(); err != nil {
+			return err
+		}
+	}
+	if n == 1 {
+		return nil
+	}
+
+	var stored uint64
+	err = s.q.QueryRow(`SELECT version FROM doubleratchet_sessions WHERE id = ?`, id).Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return &doubleratchet.VersionConflictError{ID: id, Version: state.Version, Stored: stored}
+}
+
+// Load state by id. The loaded state uses the store for skipped message keys.
+func (s *Store) Load(id []byte) (*doubleratchet.State, error) {
+	var data []byte
+	err := s.q.QueryRow(`SELECT state FROM doubleratchet_sessions WHERE id = ?`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := &doubleratchet.State{MkSkipped: s.root}
+	if err := state.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("can't decode state: %w", err)
+	}
+	return state, nil
+}
+
+// Delete the state and the skipped message keys of the session keyed by id.
+func (s *Store) Delete(id []byte) error {
+	return s.Update(func(s *Store) error {
+		if _, err := s.q.Exec(`DELETE FROM doubleratchet_keys WHERE session_id = ?`, id); err != nil {
+			return err
+		}
+		_, err := s.q.Exec(`DELETE FROM doubleratchet_sessions WHERE id = ?`, id)
+		return err
+	})
+}
+
+// SaveDevices replaces the list of devices of the party with the given identity.
+func (s *Store) SaveDevices(identity []byte, deviceIDs []uint32) error {
+	return s.Update(func(s *Store) error {
+		if _, err := s.q.Exec(`DELETE FROM doubleratchet_devices WHERE identity = ?`, identity); err != nil {
+			return err
+		}
+		for _, id := range deviceIDs {
+			if _, err := s.q.Exec(`INSERT OR IGNORE INTO doubleratchet_devices (identity, device_id) VALUES (?, ?)`, identity, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadDevices returns sorted ids of the party's devices, nil if there are none.
+func (s *Store) LoadDevices(identity []byte) ([]uint32, error) {
+	rows, err := s.q.Query(`SELECT device_id FROM doubleratchet_devices WHERE identity = ? ORDER BY device_id`, identity)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uint32
+	for rows.Next() {
+		var id uint32
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Get returns a message key by the given key and message number.
+func (s *Store) Get(k doubleratchet.Key, msgNum uint) (doubleratchet.Key, bool, error) {
+	var mk []byte
+	err := s.q.QueryRow(`SELECT message_key FROM doubleratchet_keys WHERE public_key = ? AND msg_num = ?`, []byte(k), msgNum).Scan(&mk)
+	if err == sql.ErrNoRows {
+		return doubleratchet.Key{}, false, nil
+	} else if err != nil {
+		return doubleratchet.Key{}, false, err
+	}
+	return mk, true, nil
+}
+
+// Put saves the given mk under the specified key and msgNum.
+func (s *Store) Put(sessionID []byte, k doubleratchet.Key, msgNum uint, mk doubleratchet.Key, seqNum uint, createdAt time.Time) error {
+	return s.put(sessionID, k, msgNum, mk, seqNum, createdAt, false)
+}
+
+// PutPending saves the key of the decrypted message, replacing the skipped one if any.
+// The replaced key keeps its creation time.
+func (s *Store) PutPending(sessionID []byte, k doubleratchet.Key, msgNum uint, mk doubleratchet.Key, seqNum uint, createdAt time.Time) error {
+	return s.put(sessionID, k, msgNum, mk, seqNum, createdAt, true)
+}
+
+func (s *Store) put(sessionID []byte, k doubleratchet.Key, msgNum uint, mk doubleratchet.Key, seqNum uint, createdAt time.Time, pending bool) error {
+	query := `INSERT OR REPLACE INTO doubleratchet_keys (session_id, public_key, msg_num, message_key, seq_num, pending, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	if pending {
+		query = `INSERT INTO doubleratchet_keys (session_id, public_key, msg_num, message_key, seq_num, pending, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (public_key, msg_num) DO UPDATE SET
+				session_id = excluded.session_id, message_key = excluded.message_key, seq_num = excluded.seq_num, pending = excluded.pending`
+	}
+	_, err := s.q.Exec(query, sessionID, []byte(k), msgNum, []byte(mk), seqNum, pending, createdAt.UnixNano())
+	return err
+}
+
+// DeleteExpiredMks deletes message keys of a session created before the specified time.
+func (s *Store) DeleteExpiredMks(sessionID []byte, createdBefore time.Time) error {
+	_, err := s.q.Exec(`DELETE FROM doubleratchet_keys WHERE session_id = ? AND created_at < ?`, sessionID, createdBefore.UnixNano())
+	return err
+}
+
+// PruneExpired deletes message keys of all sessions created more than the TTL set with WithKeyTTL
+// before now.
+func (s *Store) PruneExpired(now time.Time) error {
+	ttl := s.root.ttl
+	if ttl == 0 {
+		return fmt.Errorf("key TTL isn't set")
+	}
+	_, err := s.q.Exec(`DELETE FROM doubleratchet_keys WHERE created_at < ?`, now.Add(-ttl).UnixNano())
+	return err
+}
+
+// DeleteMk ensures there's no message key under the specified key and msgNum.
+func (s *Store) DeleteMk(k doubleratchet.Key, msgNum uint) error {
+	_, err := s.q.Exec(`DELETE FROM doubleratchet_keys WHERE public_key = ? AND msg_num = ?`, []byte(k), msgNum)
+	return err
+}
+
+// DeleteChain deletes all message keys stored under the specified key.
+func (s *Store) DeleteChain(k doubleratchet.Key) error {
+	_, err := s.q.Exec(`DELETE FROM doubleratchet_keys WHERE public_key = ?`, []byte(k))
+	return err
+}
+
+// DeletePending ensures there's no key awaiting confirmation under the specified key and msgNum.
+func (s *Store) DeletePending(k doubleratchet.Key, msgNum uint) error {
+	_, err := s.q.Exec(`DELETE FROM doubleratchet_keys WHERE public_key = ? AND msg_num = ? AND pending = 1`, []byte(k), msgNum)
+	return err
+}
+
+// DeleteOldKeys deletes keys of the given state up to the specified sequence number for a session.
+func (s *Store) DeleteOldKeys(sessionID []byte, state doubleratchet.KeyState, deleteUntilSeqKey uint) error {
+	// SQLite integers are signed.
+	until := uint64(deleteUntilSeqKey)
+	if until > math.MaxInt64 {
+		until = math.MaxInt64
+	}
+	_, err := s.q.Exec(
+		`DELETE FROM doubleratchet_keys WHERE session_id = ? AND pending = ? AND seq_num <= ?`,
+		sessionID, state == doubleratchet.KeyPending, until,
+	)
+	return err
+}
+
+// Pending returns decrypted messages of a session awaiting confirmation, the oldest first.
+func (s *Store) Pending(sessionID []byte) ([]doubleratchet.PendingMessage, error) {
+	rows, err := s.q.Query(`SELECT public_key, msg_num FROM doubleratchet_keys WHERE session_id = ? AND pending = 1 ORDER BY seq_num`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var response []doubleratchet.PendingMessage
+	for rows.Next() {
+		var m doubleratchet.PendingMessage
+		if err := rows.Scan((*[]byte)(&m.DH), &m.N); err != nil {
+			return nil, err
+		}
+		response = append(response, m)
+	}
+	return response, rows.Err()
+}
+
+// DeleteOldMks deletes old message keys for a session.
+func (s *Store) DeleteOldMks(sessionID []byte, deleteUntilSeqKey uint) error {
+	_, err := s.q.Exec(`DELETE FROM doubleratchet_keys WHERE session_id = ? AND seq_num <= ?`, sessionID, deleteUntilSeqKey)
+	return err
+}
+
+// TruncateMks truncates the number of keys to maxKeys.
+func (s *Store) TruncateMks(sessionID []byte, maxKeys int) error {
+	_, err := s.q.Exec(
+		`DELETE FROM doubleratchet_keys WHERE session_id = ? AND seq_num NOT IN (
+			SELECT seq_num FROM doubleratchet_keys WHERE session_id = ? ORDER BY seq_num DESC LIMIT ?
+		)`,
+		sessionID, sessionID, maxKeys,
+	)
+	return err
+}
+
+// Count returns number of message keys stored under the specified key.
+func (s *Store) Count(k doubleratchet.Key) (uint, error) {
+	var n uint
+	err := s.q.QueryRow(`SELECT COUNT(*) FROM doubleratchet_keys WHERE public_key = ?`, []byte(k)).Scan(&n)
+	return n, err
+}
+
+// All returns all the keys
+func (s *Store) All() (map[string]map[uint]doubleratchet.Key, error) {
+	return s.keys(`SELECT public_key, msg_num, message_key FROM doubleratchet_keys`)
+}
+
+// SessionKeys returns the keys of a session indexed like All.
+func (s *Store) SessionKeys(sessionID []byte) (map[string]map[uint]doubleratchet.Key, error) {
+	return s.keys(`SELECT public_key, msg_num, message_key FROM doubleratchet_keys WHERE session_id = ?`, sessionID)
+}
+
+// keys returns the keys selected by the query indexed like All.
+func (s *Store) keys(query string, args ...interface{}) (map[string]map[uint]doubleratchet.Key, error) {
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	response := make(map[string]map[uint]doubleratchet.Key)
+	for rows.Next() {
+		var (
+			pubKey, mk []byte
+			msgNum     uint
+		)
+		if err := rows.Scan(&pubKey, &msgNum, &mk); err != nil {
+			return nil, err
+		}
+		index := fmt.Sprintf("%x", doubleratchet.Key(pubKey))
+		if _, ok := response[index]; !ok {
+			response[index] = make(map[uint]doubleratchet.Key)
+		}
+		response[index][msgNum] = mk
+	}
+	return response, rows.Err()
+}
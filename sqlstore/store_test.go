@@ -0,0 +1,737 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/status-im/doubleratchet"
+)
+
+var (
+	sk      = doubleratchet.Key{0xeb, 0x8, 0x10, 0x7c, 0x33, 0x54, 0x0, 0x20, 0xe9, 0x4f, 0x6c, 0x84, 0xe4, 0x39, 0x50, 0x5a, 0x2f, 0x60, 0xbe, 0x81, 0xa, 0x78, 0x8b, 0xeb, 0x1e, 0x2c, 0x9, 0x8d, 0x4b, 0x4d, 0xc1, 0x40}
+	pubKey1 = doubleratchet.Key{0xe3, 0xbe, 0xb9, 0x4e, 0x70, 0x17, 0x37, 0xc, 0x1, 0x8f, 0xa9, 0x7e, 0xef, 0x4, 0xfb, 0x23, 0xac, 0xea, 0x28, 0xf7, 0xa9, 0x56, 0xcc, 0x1d, 0x46, 0xf3, 0xb5, 0x1d, 0x7d, 0x7d, 0x5e, 0x2c}
+	pubKey2 = doubleratchet.Key{0x3b, 0x93, 0x57, 0x64, 0xd1, 0x47, 0xf1, 0xf, 0xc7, 0x13, 0x1, 0xc6, 0xf9, 0xed, 0x49, 0xa4, 0xad, 0x59, 0x92, 0x87, 0xb1, 0x0, 0xf1, 0x4a, 0x8e, 0x43, 0x4d, 0xa7, 0x2e, 0x3d, 0xf8, 0x72}
+	mk      = doubleratchet.Key{0x9c, 0x1e, 0x68, 0xab, 0x9d, 0x45, 0xf5, 0x82, 0x35, 0xc4, 0x2, 0xa8, 0x82, 0xa1, 0x46, 0x55, 0x35, 0x41, 0xf1, 0x9d, 0x87, 0x2b, 0x59, 0x24, 0x39, 0x3b, 0x91, 0xf7, 0xda, 0x46, 0x56, 0xf}
+)
+
+func newTestStore(t *testing.T, opts ...option) *Store {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "doubleratchet.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	s, err := New(db, opts...)
+	require.NoError(t, err)
+	return s
+}
+
+func TestNew_MigrationsAreIdempotent(t *testing.T) {
+	// Arrange.
+	s := newTestStore(t)
+
+	// Act.
+	_, err := New(s.db)
+
+	// Assert.
+	require.NoError(t, err)
+
+	var version int
+	require.NoError(t, s.db.QueryRow(`SELECT MAX(version) FROM doubleratchet_migrations`).Scan(&version))
+	require.Equal(t, len(migrations), version)
+}
+
+func TestNew_BackfillsCreationTime(t *testing.T) {
+	// Arrange.
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "doubleratchet.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	all := migrations
+	migrations = all[:len(all)-1]
+	_, err = New(db)
+	migrations = all
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO doubleratchet_keys (session_id, public_key, msg_num, message_key, seq_num, created_at) VALUES (?, ?, 0, ?, 0, 0)`,
+		[]byte("session-1"), []byte(pubKey1), []byte(mk))
+	require.NoError(t, err)
+	before := time.Now().Truncate(time.Second)
+
+	// Act.
+	s, err := New(db, WithKeyTTL(time.Hour))
+
+	// Assert.
+	require.NoError(t, err)
+	var createdAt int64
+	require.NoError(t, db.QueryRow(`SELECT created_at FROM doubleratchet_keys`).Scan(&createdAt))
+	require.False(t, time.Unix(0, createdAt).Before(before))
+
+	require.NoError(t, s.PruneExpired(time.Now()))
+	_, ok, err := s.Get(pubKey1, 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestStore_Keys(t *testing.T) {
+	// Arrange.
+	s := newTestStore(t)
+
+	t.Run("get non-existent", func(t *testing.T) {
+		// Act.
+		_, ok, err := s.Get(pubKey1, 0)
+
+		// Assert.
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("put and get existing", func(t *testing.T) {
+		// Act.
+		err := s.Put([]byte("session-id"), pubKey1, 0, mk, 1, time.Now())
+		require.NoError(t, err)
+
+		k, ok, err := s.Get(pubKey1, 0)
+
+		// Assert.
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, mk, k)
+	})
+
+	t.Run("get all", func(t *testing.T) {
+		// Act.
+		all, err := s.All()
+		index := fmt.Sprintf("%x", pubKey1)
+
+		// Assert.
+		require.NoError(t, err)
+		require.Len(t, all, 1)
+		require.Len(t, all[index], 1)
+		require.Equal(t, mk, all[index][0])
+	})
+
+	t.Run("count", func(t *testing.T) {
+		// Act.
+		cnt, err := s.Count(pubKey1)
+
+		// Assert.
+		require.NoError(t, err)
+		require.EqualValues(t, 1, cnt)
+	})
+
+	t.Run("delete existing message key", func(t *testing.T) {
+		// Act.
+		err := s.DeleteMk(pubKey1, 0)
+		require.NoError(t, err)
+
+		cnt, err := s.Count(pubKey1)
+
+		// Assert.
+		require.NoError(t, err)
+		require.EqualValues(t, 0, cnt)
+	})
+}
+
+func TestStore_TruncateMks(t *testing.T) {
+	// Arrange.
+	s := newTestStore(t)
+	for i := uint(0); i < 5; i++ {
+		require.NoError(t, s.Put([]byte("session-1"), pubKey1, i, mk, i, time.Now()))
+		require.NoError(t, s.Put([]byte("session-2"), pubKey2, i, mk, i, time.Now()))
+	}
+
+	// Act.
+	err := s.TruncateMks([]byte("session-1"), 2)
+
+	// Assert.
+	require.NoError(t, err)
+
+	cnt, err := s.Count(pubKey1)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, cnt)
+
+	_, ok, err := s.Get(pubKey1, 4)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	cnt, err = s.Count(pubKey2)
+	require.NoError(t, err)
+	require.EqualValues(t, 5, cnt)
+}
+
+func TestStore_DeleteOldMks(t *testing.T) {
+	// Arrange.
+	s := newTestStore(t)
+	for i := uint(0); i < 5; i++ {
+		require.NoError(t, s.Put([]byte("session-1"), pubKey1, i, mk, i, time.Now()))
+		require.NoError(t, s.Put([]byte("session-2"), pubKey2, i, mk, i, time.Now()))
+	}
+
+	// Act.
+	err := s.DeleteOldMks([]byte("session-1"), 2)
+
+	// Assert.
+	require.NoError(t, err)
+
+	cnt, err := s.Count(pubKey1)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, cnt)
+
+	cnt, err = s.Count(pubKey2)
+	require.NoError(t, err)
+	require.EqualValues(t, 5, cnt)
+}
+
+func TestStore_PendingKeys(t *testing.T) {
+	// Arrange.
+	s := newTestStore(t)
+	for i := uint(0); i < 4; i++ {
+		require.NoError(t, s.Put([]byte("session-1"), pubKey1, i, mk, i, time.Now()))
+	}
+	require.NoError(t, s.PutPending([]byte("session-1"), pubKey1, 3, mk, 5, time.Now()))
+	require.NoError(t, s.PutPending([]byte("session-1"), pubKey1, 1, mk, 4, time.Now()))
+	require.NoError(t, s.PutPending([]byte("session-2"), pubKey2, 0, mk, 0, time.Now()))
+
+	// Act.
+	pending, err := s.Pending([]byte("session-1"))
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []doubleratchet.PendingMessage{{DH: pubKey1, N: 1}, {DH: pubKey1, N: 3}}, pending)
+
+	require.NoError(t, s.DeletePending(pubKey1, 0))
+	require.NoError(t, s.DeletePending(pubKey1, 1))
+	cnt, err := s.Count(pubKey1)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, cnt)
+
+	require.NoError(t, s.DeleteOldKeys([]byte("session-1"), doubleratchet.KeySkipped, ^uint(0)))
+	pending, err = s.Pending([]byte("session-1"))
+	require.NoError(t, err)
+	require.Equal(t, []doubleratchet.PendingMessage{{DH: pubKey1, N: 3}}, pending)
+
+	require.NoError(t, s.DeleteOldKeys([]byte("session-1"), doubleratchet.KeyPending, ^uint(0)))
+	cnt, err = s.Count(pubKey1)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, cnt)
+	cnt, err = s.Count(pubKey2)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, cnt)
+}
+
+func TestStore_ExpiredKeys(t *testing.T) {
+	// Arrange.
+	var (
+		s   = newTestStore(t, WithKeyTTL(time.Hour))
+		now = time.Now()
+	)
+	require.NoError(t, s.Put([]byte("session-1"), pubKey1, 0, mk, 0, now.Add(-3*time.Hour)))
+	require.NoError(t, s.Put([]byte("session-1"), pubKey1, 1, mk, 1, now.Add(-time.Minute)))
+	require.NoError(t, s.Put([]byte("session-2"), pubKey2, 0, mk, 0, now.Add(-3*time.Hour)))
+	require.NoError(t, s.PutPending([]byte("session-2"), pubKey2, 1, mk, 1, now.Add(-90*time.Minute)))
+
+	// Act.
+	err := s.DeleteExpiredMks([]byte("session-1"), now.Add(-time.Hour))
+
+	// Assert.
+	require.NoError(t, err)
+	cnt, err := s.Count(pubKey1)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, cnt)
+	cnt, err = s.Count(pubKey2)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, cnt)
+
+	require.NoError(t, s.PruneExpired(now))
+	cnt, err = s.Count(pubKey1)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, cnt)
+	cnt, err = s.Count(pubKey2)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, cnt)
+}
+
+func TestStore_PruneExpired_NoTTL(t *testing.T) {
+	// Act.
+	err := newTestStore(t).PruneExpired(time.Now())
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+func TestStore_PutPending_KeepsCreationTime(t *testing.T) {
+	// Arrange.
+	var (
+		s   = newTestStore(t, WithKeyTTL(time.Hour))
+		now = time.Now()
+	)
+	require.NoError(t, s.Put([]byte("session-1"), pubKey1, 0, mk, 0, now.Add(-2*time.Hour)))
+
+	// Act.
+	err := s.PutPending([]byte("session-1"), pubKey1, 0, mk, 1, now)
+
+	// Assert.
+	require.NoError(t, err)
+	pending, err := s.Pending([]byte("session-1"))
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+
+	require.NoError(t, s.PruneExpired(now))
+	_, ok, err := s.Get(pubKey1, 0)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestStore_SessionKeys(t *testing.T) {
+	// Arrange.
+	s := newTestStore(t)
+	require.NoError(t, s.Put([]byte("session-1"), pubKey1, 0, mk, 0, time.Now()))
+	require.NoError(t, s.PutPending([]byte("session-1"), pubKey1, 1, mk, 1, time.Now()))
+	require.NoError(t, s.Put([]byte("session-2"), pubKey2, 0, mk, 0, time.Now()))
+
+	// Act.
+	keys, err := s.SessionKeys([]byte("session-1"))
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, map[string]map[uint]doubleratchet.Key{fmt.Sprintf("%x", pubKey1): {0: mk, 1: mk}}, keys)
+}
+
+func TestStore_DeleteChain(t *testing.T) {
+	// Arrange.
+	s := newTestStore(t)
+	require.NoError(t, s.Put([]byte("session-1"), pubKey1, 0, mk, 0, time.Now()))
+	require.NoError(t, s.PutPending([]byte("session-1"), pubKey1, 1, mk, 1, time.Now()))
+	require.NoError(t, s.Put([]byte("session-1"), pubKey2, 0, mk, 2, time.Now()))
+
+	// Act.
+	err := s.DeleteChain(pubKey1)
+
+	// Assert.
+	require.NoError(t, err)
+	cnt, err := s.Count(pubKey1)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, cnt)
+	cnt, err = s.Count(pubKey2)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, cnt)
+}
+
+func TestStore_Update(t *testing.T) {
+	// Arrange.
+	s := newTestStore(t)
+
+	t.Run("rollback", func(t *testing.T) {
+		// Act.
+		err := s.Update(func(tx *Store) error {
+			require.NoError(t, tx.Put([]byte("session-id"), pubKey1, 0, mk, 0, time.Now()))
+			return errors.New("failure")
+		})
+
+		// Assert.
+		require.NotNil(t, err)
+
+		cnt, err := s.Count(pubKey1)
+		require.NoError(t, err)
+		require.EqualValues(t, 0, cnt)
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		// Act.
+		err := s.Update(func(tx *Store) error {
+			if err := tx.Put([]byte("session-id"), pubKey1, 0, mk, 0, time.Now()); err != nil {
+				return err
+			}
+			return tx.Put([]byte("session-id"), pubKey1, 1, mk, 1, time.Now())
+		})
+
+		// Assert.
+		require.NoError(t, err)
+
+		cnt, err := s.Count(pubKey1)
+		require.NoError(t, err)
+		require.EqualValues(t, 2, cnt)
+	})
+}
+
+func TestStore_Sessions(t *testing.T) {
+	// Arrange.
+	var (
+		s          = newTestStore(t)
+		keyPair, _ = doubleratchet.DefaultCrypto{}.GenerateDH()
+	)
+
+	bob, err := doubleratchet.New([]byte("bob"), sk, keyPair, s, doubleratchet.WithKeysStorage(s))
+	require.NoError(t, err)
+
+	alice, err := doubleratchet.NewWithRemoteKey([]byte("alice"), sk, keyPair.PublicKey(), s, doubleratchet.WithKeysStorage(s))
+	require.NoError(t, err)
+
+	m0, err := alice.RatchetEncrypt([]byte("delayed"), nil)
+	require.NoError(t, err)
+
+	m1, err := alice.RatchetEncrypt([]byte("Bob!"), nil)
+	require.NoError(t, err)
+
+	_, err = bob.RatchetDecrypt(m1, nil)
+	require.NoError(t, err)
+
+	// Act.
+	loadedBob, err := doubleratchet.Load([]byte("bob"), s)
+	require.NoError(t, err)
+
+	loadedAlice, err := doubleratchet.Load([]byte("alice"), s)
+	require.NoError(t, err)
+
+	// Assert.
+	d, err := loadedBob.RatchetDecrypt(m0, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("delayed"), d)
+
+	m2, err := loadedBob.RatchetEncrypt([]byte("Alice?"), nil)
+	require.NoError(t, err)
+
+	d, err = loadedAlice.RatchetDecrypt(m2, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Alice?"), d)
+
+	missing, err := doubleratchet.Load([]byte("missing"), s)
+	require.NoError(t, err)
+	require.Nil(t, missing)
+}
+
+func TestStore_Begin(t *testing.T) {
+	// Arrange.
+	s := newTestStore(t)
+
+	t.Run("rollback", func(t *testing.T) {
+		// Act.
+		tx, err := s.Begin()
+		require.NoError(t, err)
+		require.NoError(t, tx.Put([]byte("session-id"), pubKey1, 0, mk, 0, time.Now()))
+		require.NoError(t, tx.Save([]byte("session-id"), &doubleratchet.State{}))
+		require.NoError(t, tx.Rollback())
+
+		// Assert.
+		cnt, err := s.Count(pubKey1)
+		require.NoError(t, err)
+		require.EqualValues(t, 0, cnt)
+
+		state, err := s.Load([]byte("session-id"))
+		require.NoError(t, err)
+		require.Nil(t, state)
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		// Act.
+		tx, err := s.Begin()
+		require.NoError(t, err)
+		require.NoError(t, tx.Put([]byte("session-id"), pubKey1, 0, mk, 0, time.Now()))
+		require.NoError(t, tx.Save([]byte("session-id"), &doubleratchet.State{}))
+		require.NoError(t, tx.Commit())
+
+		// Assert.
+		cnt, err := s.Count(pubKey1)
+		require.NoError(t, err)
+		require.EqualValues(t, 1, cnt)
+
+		state, err := s.Load([]byte("session-id"))
+		require.NoError(t, err)
+		require.NotNil(t, state)
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		// Act.
+		tx, err := s.Begin()
+		require.NoError(t, err)
+		defer func() { _ = tx.Rollback() }()
+
+		_, err = tx.(*Tx).Begin()
+
+		// Assert.
+		require.NotNil(t, err)
+	})
+}
+
+func TestStore_RatchetDecryptIsAtomic(t *testing.T) {
+	// Arrange.
+	var (
+		s          = newTestStore(t)
+		keyPair, _ = doubleratchet.DefaultCrypto{}.GenerateDH()
+	)
+
+	bob, err := doubleratchet.New([]byte("bob"), sk, keyPair, s, doubleratchet.WithKeysStorage(s))
+	require.NoError(t, err)
+
+	alice, err := doubleratchet.NewWithRemoteKey([]byte("alice"), sk, keyPair.PublicKey(), nil)
+	require.NoError(t, err)
+
+	_, err = alice.RatchetEncrypt([]byte("delayed"), nil)
+	require.NoError(t, err)
+
+	m1, err := alice.RatchetEncrypt([]byte("Bob!"), nil)
+	require.NoError(t, err)
+
+	// Make saving of sessions fail after skipped keys are inserted.
+	_, err = s.db.Exec(`CREATE TRIGGER fail_save BEFORE UPDATE ON doubleratchet_sessions BEGIN SELECT RAISE(ABORT, 'save failed'); END`)
+	require.NoError(t, err)
+
+	// Act.
+	_, err = bob.RatchetDecrypt(m1, nil)
+
+	// Assert.
+	require.NotNil(t, err)
+
+	all, err := s.All()
+	require.NoError(t, err)
+	require.Empty(t, all)
+
+	_, err = s.db.Exec(`DROP TRIGGER fail_save`)
+	require.NoError(t, err)
+
+	d, err := bob.RatchetDecrypt(m1, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Bob!"), d)
+
+	all, err = s.All()
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+}
+
+func TestStore_Delete(t *testing.T) {
+	// Arrange.
+	var (
+		store      = newTestStore(t)
+		keyPair, _ = doubleratchet.DefaultCrypto{}.GenerateDH()
+	)
+	_, err := doubleratchet.New([]byte("bob"), sk, keyPair, store, doubleratchet.WithKeysStorage(store))
+	require.NoError(t, err)
+	require.NoError(t, store.Put([]byte("bob"), doubleratchet.Key{1}, 1, doubleratchet.Key{2}, 0, time.Now()))
+
+	// Act.
+	err = store.Delete([]byte("bob"))
+
+	// Assert.
+	require.NoError(t, err)
+
+	loaded, err := store.Load([]byte("bob"))
+	require.NoError(t, err)
+	require.Nil(t, loaded)
+
+	_, ok, err := store.Get(doubleratchet.Key{1}, 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestStore_Devices(t *testing.T) {
+	// Arrange.
+	s := newTestStore(t)
+	require.NoError(t, s.SaveDevices([]byte("bob"), []uint32{3, 1}))
+	require.NoError(t, s.SaveDevices([]byte("carol"), []uint32{1}))
+
+	// Act.
+	err := s.SaveDevices([]byte("bob"), []uint32{2, 3})
+
+	// Assert.
+	require.NoError(t, err)
+	ids, err := s.LoadDevices([]byte("bob"))
+	require.NoError(t, err)
+	require.Equal(t, []uint32{2, 3}, ids)
+
+	ids, err = s.LoadDevices([]byte("carol"))
+	require.NoError(t, err)
+	require.Equal(t, []uint32{1}, ids)
+
+	ids, err = s.LoadDevices([]byte("dave"))
+	require.NoError(t, err)
+	require.Nil(t, ids)
+
+	_, err = doubleratchet.NewSessionManager(s)
+	require.NoError(t, err)
+}
+
+func TestStore_SessionManager_StaleSessionReplacement(t *testing.T) {
+	// Arrange.
+	var (
+		s          = newTestStore(t)
+		addr       = doubleratchet.Address{Identity: []byte("alice"), DeviceID: 1}
+		keyPair, _ = doubleratchet.DefaultCrypto{}.GenerateDH()
+	)
+	m, err := doubleratchet.NewSessionManager(s, doubleratchet.WithKeysStorage(s))
+	require.NoError(t, err)
+	_, err = m.Accept(addr, sk, keyPair)
+	require.NoError(t, err)
+
+	alice, err := doubleratchet.NewWithRemoteKey([]byte("alice"), sk, keyPair.PublicKey(), nil)
+	require.NoError(t, err)
+	var last doubleratchet.Message
+	for i := 0; i < 5; i++ {
+		last, err = alice.RatchetEncrypt([]byte("Hi Bob!"), nil)
+		require.NoError(t, err)
+	}
+	_, err = m.Decrypt(addr, last, nil)
+	require.NoError(t, err)
+
+	count := func() int {
+		var n int
+		require.NoError(t, s.db.QueryRow(`SELECT COUNT(*) FROM doubleratchet_keys WHERE session_id = ?`, addr.SessionID()).Scan(&n))
+		return n
+	}
+	require.NotZero(t, count())
+
+	// Act.
+	_, err = m.Accept(addr, sk, keyPair)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Zero(t, count())
+}
+
+func TestStore_Save_VersionConflict(t *testing.T) {
+	// Arrange.
+	var (
+		s          = newTestStore(t)
+		keyPair, _ = doubleratchet.DefaultCrypto{}.GenerateDH()
+	)
+	_, err := doubleratchet.NewWithRemoteKey([]byte("alice"), sk, keyPair.PublicKey(), s, doubleratchet.WithKeysStorage(s))
+	require.NoError(t, err)
+
+	first, err := doubleratchet.Load([]byte("alice"), s)
+	require.NoError(t, err)
+	second, err := doubleratchet.Load([]byte("alice"), s)
+	require.NoError(t, err)
+
+	_, err = first.RatchetEncrypt([]byte("first"), nil)
+	require.NoError(t, err)
+
+	// Act.
+	_, err = second.RatchetEncrypt([]byte("second"), nil)
+
+	// Assert.
+	var conflict *doubleratchet.VersionConflictError
+	require.True(t, errors.As(err, &conflict))
+
+	state, err := s.Load([]byte("alice"))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, state.Version)
+	require.EqualValues(t, 1, state.SendCh.N)
+}
+
+func TestStore_Save_ConcurrentWriters(t *testing.T) {
+	// Arrange.
+	var (
+		path       = filepath.Join(t.TempDir(), "doubleratchet.db")
+		keyPair, _ = doubleratchet.DefaultCrypto{}.GenerateDH()
+		writers    = 8
+		rounds     = 20
+		stores     []*Store
+	)
+	for i := 0; i < writers; i++ {
+		db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = db.Close() })
+		s, err := New(db)
+		require.NoError(t, err)
+		stores = append(stores, s)
+	}
+	_, err := doubleratchet.NewWithRemoteKey([]byte("alice"), sk, keyPair.PublicKey(), stores[0])
+	require.NoError(t, err)
+
+	for round := 0; round < rounds; round++ {
+		state, err := stores[0].Load([]byte("alice"))
+		require.NoError(t, err)
+		state.Version++
+
+		// Act.
+		var (
+			wg    sync.WaitGroup
+			start = make(chan struct{})
+			errs  = make([]error, writers)
+		)
+		for i, s := range stores {
+			wg.Add(1)
+			go func(i int, s *Store) {
+				defer wg.Done()
+				<-start
+				errs[i] = s.Save([]byte("alice"), state)
+			}(i, s)
+		}
+		close(start)
+		wg.Wait()
+
+		// Assert.
+		saved := 0
+		for _, err := range errs {
+			if err == nil {
+				saved++
+				continue
+			}
+			var conflict *doubleratchet.VersionConflictError
+			require.True(t, errors.As(err, &conflict), err)
+		}
+		require.Equal(t, 1, saved, "round %d", round)
+	}
+}
+
+func TestStore_SessionLocker(t *testing.T) {
+	// Arrange.
+	var (
+		s          = newTestStore(t)
+		keyPair, _ = doubleratchet.DefaultCrypto{}.GenerateDH()
+	)
+	l, err := doubleratchet.NewFileLocker(t.TempDir())
+	require.NoError(t, err)
+
+	bob, err := doubleratchet.New([]byte("bob"), sk, keyPair, nil)
+	require.NoError(t, err)
+	_, err = doubleratchet.NewWithRemoteKey([]byte("alice"), sk, keyPair.PublicKey(), s, doubleratchet.WithSessionLocker(l))
+	require.NoError(t, err)
+
+	// Another process works with its own connection.
+	db, err := sql.Open("sqlite3", dbPath(t, s))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	other, err := New(db)
+	require.NoError(t, err)
+
+	app, err := doubleratchet.Load([]byte("alice"), s, doubleratchet.WithSessionLocker(l))
+	require.NoError(t, err)
+	service, err := doubleratchet.Load([]byte("alice"), other, doubleratchet.WithSessionLocker(l))
+	require.NoError(t, err)
+
+	// Act.
+	var msgs []doubleratchet.Message
+	for i := 0; i < 3; i++ {
+		for _, session := range []doubleratchet.Session{app, service} {
+			m, err := session.RatchetEncrypt([]byte("hi"), nil)
+			require.NoError(t, err)
+			msgs = append(msgs, m)
+		}
+	}
+
+	// Assert.
+	for i, m := range msgs {
+		require.EqualValues(t, i, m.Header.N)
+
+		d, err := bob.RatchetDecrypt(m, nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hi"), d)
+	}
+}
+
+// dbPath returns the path of the SQLite database file of the store.
+func dbPath(t *testing.T, s *Store) string {
+	var (
+		seq        int
+		name, path string
+	)
+	err := s.db.QueryRow(`PRAGMA database_list`).Scan(&seq, &name, &path)
+	require.NoError(t, err)
+	return path
+}
@@ -1,11 +1,9 @@
 package doubleratchet
 
-// TODO: During each DH ratchet step a new ratchet key pair and sending chain are generated.
-// As the sending chain is not needed right away, these steps could be deferred until the party
-// is about to send a new message.
-
 import (
+	"bytes"
 	"fmt"
+	"time"
 )
 
 // The double ratchet state.
@@ -46,14 +44,59 @@ type State struct {
 	// for example if MaxKeep is 5 we only keep the last 5 messages keys, deleting everything n - 5.
 	MaxKeep uint
 
+	// How long we keep keys of decrypted messages awaiting confirmation, counted the same way
+	// as MaxKeep. Zero stands for MaxKeep. Only applies to PendingKeysStorage.
+	MaxKeepPending uint
+
+	// How long message keys are kept since they are derived, 0 if there's no limit.
+	// The keys storage must implement ExpiringKeysStorage, see WithSkippedKeyTTL.
+	SkippedKeyTTL time.Duration
+
+	// Clock returns the current time, time.Now if nil. See WithClock.
+	Clock func() time.Time
+
 	// Max number of message keys per session, older keys will be deleted in FIFO fashion
 	MaxMessageKeysPerSession int
 
-	// The number of the current ratchet step.
+	// The number of the current ratchet step, incremented on every DH ratchet step.
 	Step uint
 
+	// How many ratchet steps skipped keys of a receiving chain are kept, counted since the chain
+	// was replaced. Zero disables the limit, see WithMaxKeepSteps.
+	MaxKeepSteps uint
+
+	// Receiving chains with stored message keys and the steps they belong to, the oldest first.
+	// Only tracked with MaxKeepSteps.
+	SkippedChains []skippedChain
+
 	// KeysCount the number of keys generated for decrypting
 	KeysCount uint
+
+	// Sparse post-quantum ratchet, see WithPostQuantumRatchet.
+	PQ pqRatchet
+
+	// Version of the state incremented every time it's changed, see CheckVersion.
+	Version uint64
+
+	// Locker serializes changes of the session across processes, see WithSessionLocker.
+	Locker SessionLocker
+
+	// DeferSendRatchet postpones generation of the ratchet key pair and the sending chain
+	// until the next message is sent, see WithDeferredSendRatchet.
+	DeferSendRatchet bool
+
+	// PendingSendRatchet is set when the sending half of the last DH ratchet step is deferred.
+	PendingSendRatchet bool
+
+	// Range of supported protocol versions, see WithProtocolVersions. Zero values stand for
+	// 1 and ProtocolVersion respectively.
+	MinVersion, MaxVersion uint8
+
+	// PeerMaxVersion is the highest protocol version advertised by the other party, 0 if unknown yet.
+	PeerMaxVersion uint8
+
+	// Recently decrypted messages, see WithReplayProtection.
+	Replay replayWindow
 }
 
 func DefaultState(sharedKey Key) State {
@@ -71,6 +114,7 @@ func DefaultState(sharedKey Key) State {
 		MaxSkip:                  1000,
 		MaxMessageKeysPerSession: 2000,
 		MaxKeep:                  2000,
+		MaxKeepSteps:             100,
 		KeysCount:                0,
 	}
 }
@@ -93,34 +137,75 @@ func newState(sharedKey Key, opts ...option) (State, error) {
 	if err := s.applyOptions(opts); err != nil {
 		return State{}, err
 	}
+	if _, ok := s.MkSkipped.(ExpiringKeysStorage); s.SkippedKeyTTL != 0 && !ok {
+		return State{}, fmt.Errorf("SkippedKeyTTL requires ExpiringKeysStorage")
+	}
 
 	return s, nil
 }
 
-// dhRatchet performs a single ratchet step.
+// dhRatchet performs a single ratchet step. With DeferSendRatchet only the receiving chain
+// is updated, the sending one is left to sendRatchet called on the next message to send.
+// checkRatchetKey verifies that the ratchet key of the header has the length of the session's keys.
+func (s *State) checkRatchetKey(h MessageHeader) error {
+	if len(h.DH) != len(s.DHs.PublicKey()) {
+		return fmt.Errorf("%w: ratchet key length %d", ErrMalformedHeader, len(h.DH))
+	}
+	return nil
+}
+
 func (s *State) dhRatchet(m MessageHeader) error {
-	s.PN = s.SendCh.N
 	s.DHr = m.DH
-	s.HKs = s.NHKs
 	s.HKr = s.NHKr
+	s.Step++
 
 	recvSecret, err := s.Crypto.DH(s.DHs, s.DHr)
 	if err != nil {
-		return fmt.Errorf("failed to generate dh recieve ratchet secret: %s", err)
+		return fmt.Errorf("failed to generate dh recieve ratchet secret: %w", err)
+	}
+	recvInput, err := s.PQ.recvInput(recvSecret, m.PQ)
+	if err != nil {
+		return err
 	}
-	s.RecvCh, s.NHKr = s.RootCh.step(recvSecret)
+	s.RecvCh, s.NHKr = s.RootCh.step(recvInput)
 
-	s.DHs, err = s.Crypto.GenerateDH()
+	if s.DeferSendRatchet {
+		s.PendingSendRatchet = true
+		return nil
+	}
+	return s.sendRatchet()
+}
+
+// sendRatchet generates a new ratchet key pair and the sending chain, the second half of a DH ratchet step.
+// The state isn't modified on error.
+func (s *State) sendRatchet() error {
+	dhs, err := s.Crypto.GenerateDH()
 	if err != nil {
-		return fmt.Errorf("failed to generate dh pair: %s", err)
+		return fmt.Errorf("failed to generate dh pair: %w", err)
 	}
 
-	sendSecret, err := s.Crypto.DH(s.DHs, s.DHr)
+	sendSecret, err := s.Crypto.DH(dhs, s.DHr)
 	if err != nil {
-		return fmt.Errorf("failed to generate dh send ratchet secret: %s", err)
+		return fmt.Errorf("failed to generate dh send ratchet secret: %w", err)
 	}
-	s.SendCh, s.NHKs = s.RootCh.step(sendSecret)
 
+	s.PN = s.SendCh.N
+	s.HKs = s.NHKs
+	s.DHs = dhs
+	s.SendCh, s.NHKs = s.RootCh.step(s.PQ.sendInput(sendSecret))
+	s.PendingSendRatchet = false
+
+	return nil
+}
+
+// ensureSendingChain performs the pending sending half of the last DH ratchet step, if any.
+func (s *State) ensureSendingChain() error {
+	if !s.PendingSendRatchet {
+		return nil
+	}
+	if err := s.sendRatchet(); err != nil {
+		return fmt.Errorf("can't perform deferred ratchet step: %w", err)
+	}
 	return nil
 }
 
@@ -129,26 +214,43 @@ type skippedKey struct {
 	nr  uint
 	mk  Key
 	seq uint
+
+	// created is the time the key has been derived at.
+	created time.Time
+
+	// step is the ratchet step of the receiving chain.
+	step uint
+
+	// pending is set for the key of the decrypted message.
+	pending bool
+
+	// drop is set for the skipped key of the decrypted message which must be deleted.
+	drop bool
 }
 
 // skipMessageKeys skips message keys in the current receiving chain.
 func (s *State) skipMessageKeys(key Key, until uint) ([]skippedKey, error) {
 	if until < uint(s.RecvCh.N) {
-		return nil, fmt.Errorf("bad until: probably an out-of-order message that was deleted")
+		return nil, fmt.Errorf("%w: message %d, next one is %d", ErrMessageKeyDeleted, until, s.RecvCh.N)
 	}
 
 	if uint(s.RecvCh.N)+s.MaxSkip < until {
-		return nil, fmt.Errorf("too many messages")
+		return nil, fmt.Errorf("%w: %d to skip, %d allowed", ErrTooManySkipped, until-uint(s.RecvCh.N), s.MaxSkip)
 	}
 
-	skipped := []skippedKey{}
+	var (
+		skipped = []skippedKey{}
+		now     = s.now()
+	)
 	for uint(s.RecvCh.N) < until {
 		mk := s.RecvCh.step()
 		skipped = append(skipped, skippedKey{
-			key: key,
-			nr:  uint(s.RecvCh.N - 1),
-			mk:  mk,
-			seq: s.KeysCount,
+			key:     key,
+			nr:      uint(s.RecvCh.N - 1),
+			mk:      mk,
+			seq:     s.KeysCount,
+			created: now,
+			step:    s.Step,
 		})
 		// Increment key count
 		s.KeysCount++
@@ -157,22 +259,95 @@ func (s *State) skipMessageKeys(key Key, until uint) ([]skippedKey, error) {
 	return skipped, nil
 }
 
-func (s *State) applyChanges(sc State, sessionID []byte, skipped []skippedKey) error {
-	*s = sc
+// applyChanges stores and deletes the skipped keys and prunes the keys storage.
+func (s *State) applyChanges(sessionID []byte, skipped []skippedKey) error {
+	ps, categorized := s.MkSkipped.(PendingKeysStorage)
 	for _, skipped := range skipped {
-		if err := s.MkSkipped.Put(sessionID, skipped.key, skipped.nr, skipped.mk, skipped.seq); err != nil {
+		if skipped.drop {
+			if err := s.MkSkipped.DeleteMk(skipped.key, skipped.nr); err != nil {
+				return err
+			}
+			continue
+		}
+		put := s.MkSkipped.Put
+		if skipped.pending && categorized {
+			put = ps.PutPending
+		}
+		if err := put(sessionID, skipped.key, skipped.nr, skipped.mk, skipped.seq, skipped.created); err != nil {
 			return err
 		}
+		s.trackChain(skipped.key, skipped.step)
 	}
 
 	if err := s.MkSkipped.TruncateMks(sessionID, s.MaxMessageKeysPerSession); err != nil {
 		return err
 	}
-	if s.KeysCount >= s.MaxKeep {
-		if err := s.MkSkipped.DeleteOldMks(sessionID, s.KeysCount-s.MaxKeep); err != nil {
-			return err
+	if err := s.deleteExpiredKeys(sessionID); err != nil {
+		return err
+	}
+	if err := s.deleteAbandonedChains(); err != nil {
+		return err
+	}
+	return s.deleteOldKeys(sessionID)
+}
+
+// skippedChain is a receiving chain with stored message keys.
+type skippedChain struct {
+	// Key the message keys are stored under, i.e. the ratchet public key or the header key.
+	Key  Key  `json:"key"`
+	Step uint `json:"step"`
+}
+
+// trackChain records the receiving chain of a stored message key.
+func (s *State) trackChain(key Key, step uint) {
+	if s.MaxKeepSteps == 0 {
+		return
+	}
+	for _, c := range s.SkippedChains {
+		if bytes.Equal(c.Key, key) {
+			return
 		}
 	}
+	chains := make([]skippedChain, 0, len(s.SkippedChains)+1)
+	chains = append(chains, s.SkippedChains...)
+	s.SkippedChains = append(chains, skippedChain{Key: key, Step: step})
+}
 
+// deleteAbandonedChains deletes message keys of receiving chains older than MaxKeepSteps.
+func (s *State) deleteAbandonedChains() error {
+	if s.MaxKeepSteps == 0 {
+		return nil
+	}
+	var kept []skippedChain
+	for _, c := range s.SkippedChains {
+		if c.Step+s.MaxKeepSteps >= s.Step {
+			kept = append(kept, c)
+			continue
+		}
+		if err := deleteChain(s.MkSkipped, c.Key); err != nil {
+			return err
+		}
+	}
+	s.SkippedChains = kept
 	return nil
 }
+
+// now returns the current time of the state's clock.
+func (s *State) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock()
+	}
+	return time.Now()
+}
+
+// deleteExpiredKeys deletes message keys derived more than SkippedKeyTTL ago.
+func (s *State) deleteExpiredKeys(sessionID []byte) error {
+	if s.SkippedKeyTTL == 0 {
+		return nil
+	}
+	es, ok := s.MkSkipped.(ExpiringKeysStorage)
+	if !ok {
+		return fmt.Errorf("SkippedKeyTTL requires ExpiringKeysStorage")
+	}
+	return es.DeleteExpiredMks(sessionID, s.now().Add(-s.SkippedKeyTTL))
+}
@@ -0,0 +1,600 @@
+package doubleratchet
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// StateEncodingVersion is the version of the State serialization format.
+// It's the first byte of the binary encoding and the "version" field of the JSON one.
+const StateEncodingVersion = 1
+
+// Field tags of the binary State encoding. Tags must never be reused or renumbered,
+// unknown tags are skipped while decoding so that new fields can be added without
+// breaking older readers.
+const (
+	stateFieldSuite                    = 1
+	stateFieldDHr                      = 2
+	stateFieldDHsPrivate               = 3
+	stateFieldDHsPublic                = 4
+	stateFieldRootCK                   = 5
+	stateFieldSendCK                   = 6
+	stateFieldSendN                    = 7
+	stateFieldRecvCK                   = 8
+	stateFieldRecvN                    = 9
+	stateFieldPN                       = 10
+	stateFieldMaxSkip                  = 11
+	stateFieldHKr                      = 12
+	stateFieldNHKr                     = 13
+	stateFieldHKs                      = 14
+	stateFieldNHKs                     = 15
+	stateFieldMaxKeep                  = 16
+	stateFieldMaxMessageKeysPerSession = 17
+	stateFieldStep                     = 18
+	stateFieldKeysCount                = 19
+	stateFieldPQ                       = 20
+	stateFieldVersion                  = 21
+	stateFieldDeferSendRatchet         = 22
+	stateFieldPendingSendRatchet       = 23
+	stateFieldMinVersion               = 24
+	stateFieldMaxVersion               = 25
+	stateFieldPeerMaxVersion           = 26
+	stateFieldReplay                   = 27
+	stateFieldMaxKeepPending           = 28
+	stateFieldSkippedKeyTTL            = 29
+	stateFieldMaxKeepSteps             = 30
+	stateFieldSkippedChain             = 31
+)
+
+// Field tags of the nested binary encoding of the post-quantum ratchet state.
+const (
+	pqFieldChunkSize    = 1
+	pqFieldEpoch        = 2
+	pqFieldOwner        = 3
+	pqFieldDK           = 4
+	pqFieldSecret       = 5
+	pqFieldOut          = 6
+	pqFieldOutKind      = 7
+	pqFieldOutCount     = 8
+	pqFieldInKind       = 9
+	pqFieldInTotal      = 10
+	pqFieldInChunk      = 11
+	pqFieldSendMixEpoch = 12
+)
+
+// Field tags of the nested binary encoding of the replay window.
+const (
+	replayFieldSize        = 1
+	replayFieldAtLeastOnce = 2
+	replayFieldSeen        = 3
+)
+
+// stateEncoding is a plain representation of State shared by the binary and JSON encodings.
+type stateEncoding struct {
+	Version                  uint8          `json:"version"`
+	Suite                    CryptoSuite    `json:"suite"`
+	DHr                      Key            `json:"dhr,omitempty"`
+	DHsPrivate               Key            `json:"dhs_private,omitempty"`
+	DHsPublic                Key            `json:"dhs_public,omitempty"`
+	RootCK                   Key            `json:"root_ck,omitempty"`
+	SendCK                   Key            `json:"send_ck,omitempty"`
+	SendN                    uint32         `json:"send_n"`
+	RecvCK                   Key            `json:"recv_ck,omitempty"`
+	RecvN                    uint32         `json:"recv_n"`
+	PN                       uint32         `json:"pn"`
+	MaxSkip                  uint           `json:"max_skip"`
+	HKr                      Key            `json:"hkr,omitempty"`
+	NHKr                     Key            `json:"nhkr,omitempty"`
+	HKs                      Key            `json:"hks,omitempty"`
+	NHKs                     Key            `json:"nhks,omitempty"`
+	MaxKeep                  uint           `json:"max_keep"`
+	MaxMessageKeysPerSession int            `json:"max_message_keys_per_session"`
+	Step                     uint           `json:"step"`
+	KeysCount                uint           `json:"keys_count"`
+	PQ                       *pqRatchet     `json:"pq,omitempty"`
+	StateVersion             uint64         `json:"state_version,omitempty"`
+	DeferSendRatchet         bool           `json:"defer_send_ratchet,omitempty"`
+	PendingSendRatchet       bool           `json:"pending_send_ratchet,omitempty"`
+	MinVersion               uint8          `json:"min_version,omitempty"`
+	MaxVersion               uint8          `json:"max_version,omitempty"`
+	PeerMaxVersion           uint8          `json:"peer_max_version,omitempty"`
+	Replay                   *replayWindow  `json:"replay,omitempty"`
+	MaxKeepPending           uint           `json:"max_keep_pending,omitempty"`
+	SkippedKeyTTL            time.Duration  `json:"skipped_key_ttl,omitempty"`
+	MaxKeepSteps             uint           `json:"max_keep_steps,omitempty"`
+	SkippedChains            []skippedChain `json:"skipped_chains,omitempty"`
+}
+
+func (s State) toEncoding() stateEncoding {
+	e := stateEncoding{
+		Version:                  StateEncodingVersion,
+		Suite:                    suiteOf(s.Crypto),
+		DHr:                      s.DHr,
+		RootCK:                   s.RootCh.CK,
+		SendCK:                   s.SendCh.CK,
+		SendN:                    s.SendCh.N,
+		RecvCK:                   s.RecvCh.CK,
+		RecvN:                    s.RecvCh.N,
+		PN:                       s.PN,
+		MaxSkip:                  s.MaxSkip,
+		HKr:                      s.HKr,
+		NHKr:                     s.NHKr,
+		HKs:                      s.HKs,
+		NHKs:                     s.NHKs,
+		MaxKeep:                  s.MaxKeep,
+		MaxMessageKeysPerSession: s.MaxMessageKeysPerSession,
+		Step:                     s.Step,
+		KeysCount:                s.KeysCount,
+		StateVersion:             s.Version,
+		DeferSendRatchet:         s.DeferSendRatchet,
+		PendingSendRatchet:       s.PendingSendRatchet,
+		MinVersion:               s.MinVersion,
+		MaxVersion:               s.MaxVersion,
+		PeerMaxVersion:           s.PeerMaxVersion,
+		MaxKeepPending:           s.MaxKeepPending,
+		SkippedKeyTTL:            s.SkippedKeyTTL,
+		MaxKeepSteps:             s.MaxKeepSteps,
+		SkippedChains:            append([]skippedChain(nil), s.SkippedChains...),
+	}
+	if s.DHs != nil {
+		e.DHsPrivate = s.DHs.PrivateKey()
+		e.DHsPublic = s.DHs.PublicKey()
+	}
+	if s.PQ.Enabled {
+		pq := s.PQ.clone()
+		e.PQ = &pq
+	}
+	if s.Replay.enabled() || s.Replay.AtLeastOnce {
+		replay := s.Replay.clone()
+		e.Replay = &replay
+	}
+	return e
+}
+
+// fromEncoding replaces s with the decoded state. Crypto is resolved from the suite identifier,
+// unless the suite is unknown, in which case the current s.Crypto is kept. MkSkipped, Locker
+// and Clock are not a part of the encoding and are kept as well.
+func (s *State) fromEncoding(e stateEncoding) error {
+	if e.Version != StateEncodingVersion {
+		return fmt.Errorf("unsupported state encoding version %d", e.Version)
+	}
+
+	c := cryptoForSuite(e.Suite)
+	if c == nil {
+		c = s.Crypto
+	}
+	ks := s.MkSkipped
+	if ks == nil {
+		ks = &KeysStorageInMemory{}
+	}
+
+	*s = State{
+		Crypto:                   c,
+		DHr:                      e.DHr,
+		DHs:                      dhPair{privateKey: e.DHsPrivate, publicKey: e.DHsPublic},
+		RootCh:                   kdfRootChain{Crypto: c, CK: e.RootCK},
+		SendCh:                   kdfChain{Crypto: c, CK: e.SendCK, N: e.SendN},
+		RecvCh:                   kdfChain{Crypto: c, CK: e.RecvCK, N: e.RecvN},
+		PN:                       e.PN,
+		MkSkipped:                ks,
+		MaxSkip:                  e.MaxSkip,
+		HKr:                      e.HKr,
+		NHKr:                     e.NHKr,
+		HKs:                      e.HKs,
+		NHKs:                     e.NHKs,
+		MaxKeep:                  e.MaxKeep,
+		MaxMessageKeysPerSession: e.MaxMessageKeysPerSession,
+		Step:                     e.Step,
+		KeysCount:                e.KeysCount,
+		Version:                  e.StateVersion,
+		Locker:                   s.Locker,
+		DeferSendRatchet:         e.DeferSendRatchet,
+		PendingSendRatchet:       e.PendingSendRatchet,
+		MinVersion:               e.MinVersion,
+		MaxVersion:               e.MaxVersion,
+		PeerMaxVersion:           e.PeerMaxVersion,
+		MaxKeepPending:           e.MaxKeepPending,
+		SkippedKeyTTL:            e.SkippedKeyTTL,
+		MaxKeepSteps:             e.MaxKeepSteps,
+		SkippedChains:            e.SkippedChains,
+		Clock:                    s.Clock,
+	}
+	if e.PQ != nil {
+		s.PQ = *e.PQ
+		s.PQ.Enabled = true
+	}
+	if e.Replay != nil {
+		s.Replay = *e.Replay
+	}
+	return nil
+}
+
+// MarshalBinary encodes the state into a versioned binary form: a version byte followed by
+// (tag, length, value) fields. Keys storage isn't a part of the encoding.
+func (s State) MarshalBinary() ([]byte, error) {
+	var (
+		e   = s.toEncoding()
+		buf = []byte{e.Version}
+	)
+
+	putBytes := func(tag uint64, v []byte) {
+		buf = appendField(buf, tag, v)
+	}
+	putUint := func(tag uint64, v uint64) {
+		buf = appendUintField(buf, tag, v)
+	}
+
+	putUint(stateFieldSuite, uint64(e.Suite))
+	putBytes(stateFieldDHr, e.DHr)
+	putBytes(stateFieldDHsPrivate, e.DHsPrivate)
+	putBytes(stateFieldDHsPublic, e.DHsPublic)
+	putBytes(stateFieldRootCK, e.RootCK)
+	putBytes(stateFieldSendCK, e.SendCK)
+	putUint(stateFieldSendN, uint64(e.SendN))
+	putBytes(stateFieldRecvCK, e.RecvCK)
+	putUint(stateFieldRecvN, uint64(e.RecvN))
+	putUint(stateFieldPN, uint64(e.PN))
+	putUint(stateFieldMaxSkip, uint64(e.MaxSkip))
+	putBytes(stateFieldHKr, e.HKr)
+	putBytes(stateFieldNHKr, e.NHKr)
+	putBytes(stateFieldHKs, e.HKs)
+	putBytes(stateFieldNHKs, e.NHKs)
+	putUint(stateFieldMaxKeep, uint64(e.MaxKeep))
+	putBytes(stateFieldMaxMessageKeysPerSession, binary.AppendVarint(nil, int64(e.MaxMessageKeysPerSession)))
+	putUint(stateFieldStep, uint64(e.Step))
+	putUint(stateFieldKeysCount, uint64(e.KeysCount))
+	if e.PQ != nil {
+		putBytes(stateFieldPQ, e.PQ.marshalBinary())
+	}
+	putUint(stateFieldVersion, e.StateVersion)
+	if e.DeferSendRatchet {
+		putUint(stateFieldDeferSendRatchet, 1)
+	}
+	if e.PendingSendRatchet {
+		putUint(stateFieldPendingSendRatchet, 1)
+	}
+	if e.MinVersion != 0 {
+		putUint(stateFieldMinVersion, uint64(e.MinVersion))
+	}
+	if e.MaxVersion != 0 {
+		putUint(stateFieldMaxVersion, uint64(e.MaxVersion))
+	}
+	if e.PeerMaxVersion != 0 {
+		putUint(stateFieldPeerMaxVersion, uint64(e.PeerMaxVersion))
+	}
+	if e.Replay != nil {
+		putBytes(stateFieldReplay, e.Replay.marshalBinary())
+	}
+	if e.MaxKeepPending != 0 {
+		putUint(stateFieldMaxKeepPending, uint64(e.MaxKeepPending))
+	}
+	if e.SkippedKeyTTL > 0 {
+		putUint(stateFieldSkippedKeyTTL, uint64(e.SkippedKeyTTL))
+	}
+	if e.MaxKeepSteps != 0 {
+		putUint(stateFieldMaxKeepSteps, uint64(e.MaxKeepSteps))
+	}
+	for _, c := range e.SkippedChains {
+		// Step followed by the key.
+		putBytes(stateFieldSkippedChain, append(binary.AppendUvarint(nil, uint64(c.Step)), c.Key...))
+	}
+
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the state encoded with MarshalBinary. Keys storage of s is kept intact,
+// the in-memory one is used if there's none.
+func (s *State) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("state encoding is empty")
+	}
+
+	e := stateEncoding{Version: data[0]}
+	if e.Version != StateEncodingVersion {
+		return fmt.Errorf("unsupported state encoding version %d", e.Version)
+	}
+
+	if err := readFields(data[1:], e.setField); err != nil {
+		return fmt.Errorf("malformed state: %w", err)
+	}
+
+	return s.fromEncoding(e)
+}
+
+// appendField appends a (tag, length, value) field to buf, empty values are omitted.
+func appendField(buf []byte, tag uint64, v []byte) []byte {
+	if len(v) == 0 {
+		return buf
+	}
+	buf = binary.AppendUvarint(buf, tag)
+	buf = binary.AppendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+// appendUintField appends a field with the uvarint-encoded value to buf.
+func appendUintField(buf []byte, tag uint64, v uint64) []byte {
+	return appendField(buf, tag, binary.AppendUvarint(nil, v))
+}
+
+// readFields calls set for every (tag, length, value) field of data.
+func readFields(data []byte, set func(tag uint64, v []byte) error) error {
+	for rest := data; len(rest) > 0; {
+		tag, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return fmt.Errorf("malformed field tag")
+		}
+		rest = rest[n:]
+
+		l, n := binary.Uvarint(rest)
+		if n <= 0 || l > uint64(len(rest)-n) {
+			return fmt.Errorf("malformed length of field %d", tag)
+		}
+		v := rest[n : n+int(l)]
+		rest = rest[n+int(l):]
+
+		if err := set(tag, v); err != nil {
+			return fmt.Errorf("malformed field %d: %w", tag, err)
+		}
+	}
+	return nil
+}
+
+// uvarintValue decodes the value of a field appended with appendUintField.
+func uvarintValue(v []byte) (uint64, error) {
+	x, n := binary.Uvarint(v)
+	if n != len(v) {
+		return 0, fmt.Errorf("invalid varint")
+	}
+	return x, nil
+}
+
+// setField decodes a single binary field into e. Unknown fields are ignored.
+func (e *stateEncoding) setField(tag uint64, v []byte) error {
+	uintValue := func() (uint64, error) {
+		return uvarintValue(v)
+	}
+	keyValue := func() Key {
+		return append(Key{}, v...)
+	}
+
+	var (
+		x   uint64
+		err error
+	)
+	switch tag {
+	case stateFieldSuite:
+		x, err = uintValue()
+		e.Suite = CryptoSuite(x)
+	case stateFieldDHr:
+		e.DHr = keyValue()
+	case stateFieldDHsPrivate:
+		e.DHsPrivate = keyValue()
+	case stateFieldDHsPublic:
+		e.DHsPublic = keyValue()
+	case stateFieldRootCK:
+		e.RootCK = keyValue()
+	case stateFieldSendCK:
+		e.SendCK = keyValue()
+	case stateFieldSendN:
+		x, err = uintValue()
+		e.SendN = uint32(x)
+	case stateFieldRecvCK:
+		e.RecvCK = keyValue()
+	case stateFieldRecvN:
+		x, err = uintValue()
+		e.RecvN = uint32(x)
+	case stateFieldPN:
+		x, err = uintValue()
+		e.PN = uint32(x)
+	case stateFieldMaxSkip:
+		x, err = uintValue()
+		e.MaxSkip = uint(x)
+	case stateFieldHKr:
+		e.HKr = keyValue()
+	case stateFieldNHKr:
+		e.NHKr = keyValue()
+	case stateFieldHKs:
+		e.HKs = keyValue()
+	case stateFieldNHKs:
+		e.NHKs = keyValue()
+	case stateFieldMaxKeep:
+		x, err = uintValue()
+		e.MaxKeep = uint(x)
+	case stateFieldMaxMessageKeysPerSession:
+		i, n := binary.Varint(v)
+		if n != len(v) {
+			return fmt.Errorf("invalid varint")
+		}
+		e.MaxMessageKeysPerSession = int(i)
+	case stateFieldStep:
+		x, err = uintValue()
+		e.Step = uint(x)
+	case stateFieldKeysCount:
+		x, err = uintValue()
+		e.KeysCount = uint(x)
+	case stateFieldVersion:
+		e.StateVersion, err = uintValue()
+	case stateFieldDeferSendRatchet:
+		x, err = uintValue()
+		e.DeferSendRatchet = x != 0
+	case stateFieldPendingSendRatchet:
+		x, err = uintValue()
+		e.PendingSendRatchet = x != 0
+	case stateFieldMinVersion:
+		x, err = uintValue()
+		e.MinVersion = uint8(x)
+	case stateFieldMaxVersion:
+		x, err = uintValue()
+		e.MaxVersion = uint8(x)
+	case stateFieldPeerMaxVersion:
+		x, err = uintValue()
+		e.PeerMaxVersion = uint8(x)
+	case stateFieldMaxKeepPending:
+		x, err = uintValue()
+		e.MaxKeepPending = uint(x)
+	case stateFieldSkippedKeyTTL:
+		x, err = uintValue()
+		e.SkippedKeyTTL = time.Duration(x)
+	case stateFieldMaxKeepSteps:
+		x, err = uintValue()
+		e.MaxKeepSteps = uint(x)
+	case stateFieldSkippedChain:
+		step, n := binary.Uvarint(v)
+		if n <= 0 {
+			return fmt.Errorf("invalid step")
+		}
+		e.SkippedChains = append(e.SkippedChains, skippedChain{Key: append(Key{}, v[n:]...), Step: uint(step)})
+	case stateFieldPQ:
+		e.PQ = &pqRatchet{Enabled: true}
+		err = e.PQ.unmarshalBinary(v)
+	case stateFieldReplay:
+		e.Replay = &replayWindow{}
+		err = e.Replay.unmarshalBinary(v)
+	}
+	return err
+}
+
+// marshalBinary encodes the post-quantum ratchet state as a nested set of fields.
+func (p pqRatchet) marshalBinary() []byte {
+	var buf []byte
+	buf = appendUintField(buf, pqFieldChunkSize, uint64(p.ChunkSize))
+	buf = appendUintField(buf, pqFieldEpoch, uint64(p.Epoch))
+	if p.Owner {
+		buf = appendUintField(buf, pqFieldOwner, 1)
+	}
+	buf = appendField(buf, pqFieldDK, p.DK)
+	buf = appendField(buf, pqFieldSecret, p.Secret)
+	buf = appendField(buf, pqFieldOut, p.Out)
+	buf = appendUintField(buf, pqFieldOutKind, uint64(p.OutKind))
+	buf = appendUintField(buf, pqFieldOutCount, uint64(p.OutCount))
+	buf = appendUintField(buf, pqFieldInKind, uint64(p.InKind))
+	buf = appendUintField(buf, pqFieldInTotal, uint64(p.InTotal))
+	for i, chunk := range p.In {
+		if chunk != nil {
+			// Chunk index followed by the chunk.
+			buf = appendField(buf, pqFieldInChunk, append(binary.AppendUvarint(nil, uint64(i)), chunk...))
+		}
+	}
+	buf = appendUintField(buf, pqFieldSendMixEpoch, uint64(p.SendMixEpoch))
+	return buf
+}
+
+// unmarshalBinary decodes the post-quantum ratchet state encoded with marshalBinary.
+func (p *pqRatchet) unmarshalBinary(data []byte) error {
+	var chunks [][]byte
+	err := readFields(data, func(tag uint64, v []byte) error {
+		var (
+			x   uint64
+			err error
+		)
+		switch tag {
+		case pqFieldChunkSize:
+			x, err = uvarintValue(v)
+			p.ChunkSize = int(x)
+		case pqFieldEpoch:
+			x, err = uvarintValue(v)
+			p.Epoch = uint32(x)
+		case pqFieldOwner:
+			x, err = uvarintValue(v)
+			p.Owner = x != 0
+		case pqFieldDK:
+			p.DK = append([]byte{}, v...)
+		case pqFieldSecret:
+			p.Secret = append([]byte{}, v...)
+		case pqFieldOut:
+			p.Out = append([]byte{}, v...)
+		case pqFieldOutKind:
+			x, err = uvarintValue(v)
+			p.OutKind = uint8(x)
+		case pqFieldOutCount:
+			x, err = uvarintValue(v)
+			p.OutCount = uint32(x)
+		case pqFieldInKind:
+			x, err = uvarintValue(v)
+			p.InKind = uint8(x)
+		case pqFieldInTotal:
+			x, err = uvarintValue(v)
+			p.InTotal = uint16(x)
+		case pqFieldInChunk:
+			chunks = append(chunks, v)
+		case pqFieldSendMixEpoch:
+			x, err = uvarintValue(v)
+			p.SendMixEpoch = uint32(x)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.ChunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", p.ChunkSize)
+	}
+	if len(chunks) > 0 {
+		p.In = make([][]byte, p.InTotal)
+	}
+	for _, v := range chunks {
+		i, n := binary.Uvarint(v)
+		if n <= 0 || i >= uint64(len(p.In)) {
+			return fmt.Errorf("invalid chunk index")
+		}
+		p.In[i] = append([]byte{}, v[n:]...)
+	}
+	return nil
+}
+
+// marshalBinary encodes the replay window as a nested set of fields.
+func (w replayWindow) marshalBinary() []byte {
+	var buf []byte
+	buf = appendUintField(buf, replayFieldSize, uint64(w.Size))
+	if w.AtLeastOnce {
+		buf = appendUintField(buf, replayFieldAtLeastOnce, 1)
+	}
+	for _, m := range w.Seen {
+		// Message number followed by the ratchet key.
+		buf = appendField(buf, replayFieldSeen, append(binary.AppendUvarint(nil, uint64(m.N)), m.DH...))
+	}
+	return buf
+}
+
+// unmarshalBinary decodes the replay window encoded with marshalBinary.
+func (w *replayWindow) unmarshalBinary(data []byte) error {
+	return readFields(data, func(tag uint64, v []byte) error {
+		var (
+			x   uint64
+			err error
+		)
+		switch tag {
+		case replayFieldSize:
+			x, err = uvarintValue(v)
+			w.Size = int(x)
+		case replayFieldAtLeastOnce:
+			x, err = uvarintValue(v)
+			w.AtLeastOnce = x != 0
+		case replayFieldSeen:
+			n, l := binary.Uvarint(v)
+			if l <= 0 || n > 1<<32-1 {
+				return fmt.Errorf("invalid message number")
+			}
+			w.Seen = append(w.Seen, seenMessage{DH: append(Key{}, v[l:]...), N: uint32(n)})
+		}
+		return err
+	})
+}
+
+// MarshalJSON encodes the state into a versioned JSON object. Keys storage isn't a part of the encoding.
+func (s State) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.toEncoding())
+}
+
+// UnmarshalJSON decodes the state encoded with MarshalJSON. Keys storage of s is kept intact,
+// the in-memory one is used if there's none.
+func (s *State) UnmarshalJSON(data []byte) error {
+	var e stateEncoding
+	if err := json.Unmarshal(data, &e); err != nil {
+		return err
+	}
+	return s.fromEncoding(e)
+}
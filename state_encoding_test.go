@@ -0,0 +1,191 @@
+package doubleratchet
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestState_MarshalBinary_RoundTrip(t *testing.T) {
+	// Arrange.
+	var (
+		bob, _   = New([]byte("bob"), sk, bobPair, nil)
+		alice, _ = NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+		h        = SessionTestHelper{t, alice, bob}
+	)
+	h.AliceToBob("Bob!", nil)
+	h.BobToAlice("Alice?", nil)
+	h.AliceToBob("How are you?", nil)
+
+	state := alice.(*sessionState).State
+	state.HKs = sharedHka
+	state.NHKr = sharedNhkb
+	state.Step = 3
+	state.MinVersion, state.MaxVersion, state.PeerMaxVersion = 1, 2, 2
+	state.SkippedKeyTTL = time.Hour
+	state.MaxKeepSteps = 5
+	state.SkippedChains = []skippedChain{{Key: bobPair.PublicKey(), Step: 1}, {Key: sharedHka, Step: 2}}
+
+	// Act.
+	data, err := state.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded State
+	err = decoded.UnmarshalBinary(data)
+
+	// Assert.
+	require.NoError(t, err)
+	require.EqualValues(t, StateEncodingVersion, data[0])
+	require.Equal(t, state.toEncoding(), decoded.toEncoding())
+	require.Equal(t, DefaultCrypto{}, decoded.Crypto)
+	require.Equal(t, DefaultCrypto{}, decoded.RootCh.Crypto)
+	require.Equal(t, DefaultCrypto{}, decoded.SendCh.Crypto)
+	require.Equal(t, DefaultCrypto{}, decoded.RecvCh.Crypto)
+	require.NotNil(t, decoded.MkSkipped)
+}
+
+func TestState_MarshalJSON_RoundTrip(t *testing.T) {
+	// Arrange.
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithMaxSkip(10), WithMaxMessageKeysPerSession(20))
+	require.NoError(t, err)
+
+	state := bob.(*sessionState).State
+
+	// Act.
+	data, err := json.Marshal(state)
+	require.NoError(t, err)
+
+	var decoded State
+	err = json.Unmarshal(data, &decoded)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"version":1`)
+	require.Equal(t, state.toEncoding(), decoded.toEncoding())
+	require.EqualValues(t, 10, decoded.MaxSkip)
+	require.EqualValues(t, 20, decoded.MaxMessageKeysPerSession)
+}
+
+func TestState_UnmarshalBinary_ContinuesCommunication(t *testing.T) {
+	// Arrange.
+	var (
+		ks       = &KeysStorageInMemory{}
+		bob, _   = New([]byte("bob"), sk, bobPair, nil, WithKeysStorage(ks))
+		alice, _ = NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+		h        = SessionTestHelper{t, alice, bob}
+	)
+	m0, err := alice.RatchetEncrypt([]byte("delayed"), nil)
+	require.NoError(t, err)
+	h.AliceToBob("Bob!", nil)
+
+	data, err := bob.(*sessionState).State.MarshalBinary()
+	require.NoError(t, err)
+
+	// Act.
+	decoded := State{MkSkipped: ks}
+	err = decoded.UnmarshalBinary(data)
+	require.NoError(t, err)
+
+	// Assert.
+	h.bob = &sessionState{id: []byte("bob"), State: decoded}
+	h.BobToAlice("Alice?", nil)
+	h.AliceToBob("How are you?", nil)
+
+	d, err := h.bob.RatchetDecrypt(m0, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("delayed"), d)
+}
+
+func TestState_UnmarshalBinary_UnknownSuite(t *testing.T) {
+	// Arrange.
+	state, err := newState(sk, WithCrypto(unknownCrypto{}))
+	require.NoError(t, err)
+
+	data, err := state.MarshalBinary()
+	require.NoError(t, err)
+
+	t.Run("crypto isn't specified", func(t *testing.T) {
+		// Act.
+		var decoded State
+		err := decoded.UnmarshalBinary(data)
+
+		// Assert.
+		require.NoError(t, err)
+		require.Nil(t, decoded.Crypto)
+	})
+
+	t.Run("crypto is specified", func(t *testing.T) {
+		// Act.
+		decoded := State{Crypto: unknownCrypto{}}
+		err := decoded.UnmarshalBinary(data)
+
+		// Assert.
+		require.NoError(t, err)
+		require.Equal(t, unknownCrypto{}, decoded.Crypto)
+		require.Equal(t, unknownCrypto{}, decoded.SendCh.Crypto)
+	})
+}
+
+func TestState_UnmarshalBinary_UnknownField(t *testing.T) {
+	// Arrange.
+	state, err := newState(sk)
+	require.NoError(t, err)
+
+	data, err := state.MarshalBinary()
+	require.NoError(t, err)
+
+	// Act.
+	var decoded State
+	err = decoded.UnmarshalBinary(append(data, 100, 3, 1, 2, 3))
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, state.toEncoding(), decoded.toEncoding())
+}
+
+func TestState_UnmarshalBinary_Malformed(t *testing.T) {
+	state, err := newState(sk)
+	require.NoError(t, err)
+
+	data, err := state.MarshalBinary()
+	require.NoError(t, err)
+
+	for name, input := range map[string][]byte{
+		"empty":               nil,
+		"unsupported version": append([]byte{StateEncodingVersion + 1}, data[1:]...),
+		"truncated":           data[:len(data)-1],
+		"bad length":          {StateEncodingVersion, stateFieldRootCK, 0xff},
+		"bad varint":          {StateEncodingVersion, stateFieldSendN, 2, 0xff, 0xff},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Act.
+			var decoded State
+			err := decoded.UnmarshalBinary(input)
+
+			// Assert.
+			require.NotNil(t, err)
+		})
+	}
+}
+
+func TestLoad_UnknownCrypto(t *testing.T) {
+	// Arrange.
+	store := &sessionStorageInMemory{}
+	require.NoError(t, store.Save([]byte("id"), &State{}))
+
+	// Act.
+	_, err := Load([]byte("id"), store)
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+type unknownCrypto struct {
+	DefaultCrypto
+}
+
+func (c unknownCrypto) Suite() CryptoSuite {
+	return CryptoSuiteUnknown
+}
@@ -0,0 +1,93 @@
+package doubleratchet
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// TransactionalStorage is implemented by session storages able to apply changes atomically.
+// When the session storage implements it, sessions save the state together with skipped
+// message keys inserts and pruning in a single transaction.
+type TransactionalStorage interface {
+	// Begin starts a new transaction.
+	Begin() (StorageTx, error)
+}
+
+// StorageTx is a transaction started by TransactionalStorage. Changes made through it
+// must be invisible until Commit is called and discarded on Rollback.
+type StorageTx interface {
+	SessionStorage
+	KeysStorage
+
+	// Commit applies all changes made within the transaction.
+	Commit() error
+
+	// Rollback discards all changes made within the transaction.
+	Rollback() error
+}
+
+// commitChanges applies sc with the skipped keys to s and saves it to the storage.
+// s is left untouched if any of the steps fails. Unless the storage implements
+// TransactionalStorage, changes of the keys storage made before the failure are kept.
+func commitChanges(id []byte, storage SessionStorage, s *State, sc State, skipped []skippedKey) error {
+	ts, ok := storage.(TransactionalStorage)
+	if !ok {
+		if err := sc.applyChanges(id, skipped); err != nil {
+			return err
+		}
+		if storage != nil {
+			if err := storage.Save(id, &sc); err != nil {
+				return err
+			}
+		}
+		*s = sc
+		return nil
+	}
+
+	tx, err := ts.Begin()
+	if err != nil {
+		return fmt.Errorf("can't begin transaction: %w", err)
+	}
+
+	// Skipped keys go through the transaction only if they are kept by the same storage.
+	ks := sc.MkSkipped
+	if sameStorage(storage, ks) {
+		sc.MkSkipped = tx
+	}
+	if err := sc.applyChanges(id, skipped); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	sc.MkSkipped = ks
+
+	if err := tx.Save(id, &sc); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("can't commit transaction: %w", err)
+	}
+
+	*s = sc
+	return nil
+}
+
+// saveChanges saves sc to the storage and applies it to s. s is left untouched if the save fails.
+func saveChanges(id []byte, storage SessionStorage, s *State, sc State) error {
+	if storage != nil {
+		if err := storage.Save(id, &sc); err != nil {
+			return err
+		}
+	}
+	*s = sc
+	return nil
+}
+
+// sameStorage reports whether ks is the session storage ss itself.
+func sameStorage(ss SessionStorage, ks KeysStorage) bool {
+	other, ok := ss.(KeysStorage)
+	if !ok || !reflect.TypeOf(other).Comparable() {
+		return false
+	}
+	return other == ks
+}
@@ -0,0 +1,284 @@
+package doubleratchet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSession_RatchetDecrypt_Transactional(t *testing.T) {
+	// Arrange.
+	var (
+		storage  = &txStorageInMemory{}
+		bobI, _  = New([]byte("bob"), sk, bobPair, storage, WithKeysStorage(storage))
+		bob      = bobI.(*sessionState)
+		alice, _ = NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	)
+
+	_, err := alice.RatchetEncrypt([]byte("delayed"), nil)
+	require.NoError(t, err)
+
+	m1, err := alice.RatchetEncrypt([]byte("Bob!"), nil)
+	require.NoError(t, err)
+
+	t.Run("failed save rolls back skipped keys", func(t *testing.T) {
+		// Act.
+		storage.failSave = true
+		_, err := bob.RatchetDecrypt(m1, nil)
+		storage.failSave = false
+
+		// Assert.
+		require.NotNil(t, err)
+		require.Nil(t, bob.DHr)
+		require.EqualValues(t, 0, bob.RecvCh.N)
+
+		all, err := storage.All()
+		require.NoError(t, err)
+		require.Empty(t, all)
+
+		saved, err := storage.Load([]byte("bob"))
+		require.NoError(t, err)
+		require.Nil(t, saved.DHr)
+	})
+
+	t.Run("successful save commits everything", func(t *testing.T) {
+		// Act.
+		d, err := bob.RatchetDecrypt(m1, nil)
+
+		// Assert.
+		require.NoError(t, err)
+		require.Equal(t, []byte("Bob!"), d)
+		require.EqualValues(t, 2, bob.RecvCh.N)
+
+		cnt, err := storage.Count(bob.DHr)
+		require.NoError(t, err)
+		require.EqualValues(t, 2, cnt)
+
+		saved, err := storage.Load([]byte("bob"))
+		require.NoError(t, err)
+		require.Equal(t, bob.DHr, saved.DHr)
+		require.Equal(t, storage, saved.MkSkipped)
+	})
+}
+
+func TestSessionHE_RatchetDecrypt_Transactional(t *testing.T) {
+	// Arrange.
+	var (
+		storage  = &txStorageInMemory{}
+		bobI, _  = NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, storage, WithKeysStorage(storage))
+		bob      = bobI.(*sessionHE)
+		alice, _ = NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil)
+	)
+
+	_, err := alice.RatchetEncrypt([]byte("delayed"), nil)
+	require.NoError(t, err)
+
+	m1, err := alice.RatchetEncrypt([]byte("Bob!"), nil)
+	require.NoError(t, err)
+
+	// Act.
+	storage.failSave = true
+	_, err = bob.RatchetDecrypt(m1, nil)
+	storage.failSave = false
+
+	// Assert.
+	require.NotNil(t, err)
+	require.Nil(t, bob.HKr)
+
+	all, err := storage.All()
+	require.NoError(t, err)
+	require.Empty(t, all)
+}
+
+func TestSession_RatchetDecrypt_CommitConflict(t *testing.T) {
+	// Arrange.
+	var (
+		storage  = &txStorageInMemory{}
+		bob, _   = New([]byte("bob"), sk, bobPair, storage, WithKeysStorage(storage))
+		alice, _ = NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	)
+	m, err := alice.RatchetEncrypt([]byte("Bob!"), nil)
+	require.NoError(t, err)
+
+	// Act.
+	storage.commitErr = &VersionConflictError{ID: []byte("bob"), Version: 1, Stored: 1}
+	_, err = bob.RatchetDecrypt(m, nil)
+
+	// Assert.
+	var conflict *VersionConflictError
+	require.True(t, errors.As(err, &conflict), err)
+}
+
+func TestSession_RatchetDecrypt_FailedSave(t *testing.T) {
+	// Arrange.
+	var (
+		storage  = &failingSessionStorage{}
+		bobI, _  = New([]byte("bob"), sk, bobPair, storage)
+		bob      = bobI.(*sessionState)
+		alice, _ = NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil)
+	)
+	m, err := alice.RatchetEncrypt([]byte("Bob!"), nil)
+	require.NoError(t, err)
+	before := bob.State.toEncoding()
+
+	// Act.
+	storage.failSave = true
+	_, err = bob.RatchetDecrypt(m, nil)
+	storage.failSave = false
+
+	// Assert.
+	require.Error(t, err)
+	require.Equal(t, before, bob.State.toEncoding())
+
+	saved, err := storage.Load([]byte("bob"))
+	require.NoError(t, err)
+	require.Equal(t, saved.Version, bob.Version)
+
+	d, err := bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Bob!"), d)
+}
+
+func TestSameStorage(t *testing.T) {
+	var (
+		storage = &txStorageInMemory{}
+		ks      = &KeysStorageInMemory{}
+	)
+
+	require.True(t, sameStorage(storage, storage))
+	require.False(t, sameStorage(storage, ks))
+	require.False(t, sameStorage(&sessionStorageInMemory{}, ks))
+}
+
+// txStorageInMemory is a transactional session and keys storage for tests.
+type txStorageInMemory struct {
+	sessionStorageInMemory
+	KeysStorageInMemory
+
+	failSave  bool
+	commitErr error
+}
+
+func (s *txStorageInMemory) Begin() (StorageTx, error) {
+	tx := &txInMemory{parent: s}
+	for id, state := range s.states {
+		_ = tx.sessionStorageInMemory.Save([]byte(id), &state)
+	}
+	for index, keys := range s.keys {
+		for n, k := range keys {
+			if tx.keys == nil {
+				tx.keys = make(map[string]map[uint]InMemoryKey)
+			}
+			if tx.keys[index] == nil {
+				tx.keys[index] = make(map[uint]InMemoryKey)
+			}
+			tx.keys[index][n] = k
+		}
+	}
+	return tx, nil
+}
+
+func TestSession_RatchetEncrypt_FailedSave(t *testing.T) {
+	// Arrange.
+	var (
+		storage = &failingVersionedStorage{}
+		bob, _  = New([]byte("bob"), sk, bobPair, nil)
+	)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), storage)
+	require.NoError(t, err)
+	_, err = alice.RatchetEncrypt([]byte("first"), nil)
+	require.NoError(t, err)
+
+	// Act.
+	storage.failSave = true
+	_, err = alice.RatchetEncrypt([]byte("lost"), nil)
+	storage.failSave = false
+	require.Error(t, err)
+	m, err := alice.RatchetEncrypt([]byte("second"), nil)
+
+	// Assert.
+	require.NoError(t, err)
+	require.EqualValues(t, 1, m.Header.N)
+	d, err := bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), d)
+}
+
+func TestSessionHE_RatchetEncrypt_FailedSave(t *testing.T) {
+	// Arrange.
+	var (
+		storage = &failingVersionedStorage{}
+		bob, _  = NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil)
+	)
+	alice, err := NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), storage)
+	require.NoError(t, err)
+
+	// Act.
+	storage.failSave = true
+	_, err = alice.RatchetEncrypt([]byte("lost"), nil)
+	storage.failSave = false
+	require.Error(t, err)
+	m, err := alice.RatchetEncrypt([]byte("first"), nil)
+
+	// Assert.
+	require.NoError(t, err)
+	d, err := bob.RatchetDecrypt(m, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), d)
+}
+
+// failingSessionStorage is a session storage which fails to save when asked to.
+type failingSessionStorage struct {
+	sessionStorageInMemory
+
+	failSave bool
+}
+
+func (s *failingSessionStorage) Save(id []byte, state *State) error {
+	if s.failSave {
+		return errors.New("save failed")
+	}
+	return s.sessionStorageInMemory.Save(id, state)
+}
+
+// failingVersionedStorage is a versioned session storage which fails to save when asked to.
+type failingVersionedStorage struct {
+	versionedStorageInMemory
+
+	failSave bool
+}
+
+func (s *failingVersionedStorage) Save(id []byte, state *State) error {
+	if s.failSave {
+		return errors.New("save failed")
+	}
+	return s.versionedStorageInMemory.Save(id, state)
+}
+
+type txInMemory struct {
+	sessionStorageInMemory
+	KeysStorageInMemory
+
+	parent *txStorageInMemory
+}
+
+func (tx *txInMemory) Save(id []byte, state *State) error {
+	if tx.parent.failSave {
+		return errors.New("save failed")
+	}
+	return tx.sessionStorageInMemory.Save(id, state)
+}
+
+func (tx *txInMemory) Commit() error {
+	if tx.parent.commitErr != nil {
+		return tx.parent.commitErr
+	}
+	tx.parent.states = tx.states
+	tx.parent.keys = tx.keys
+	return nil
+}
+
+func (tx *txInMemory) Rollback() error {
+	return nil
+}
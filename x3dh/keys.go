@@ -0,0 +1,183 @@
+package x3dh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/status-im/doubleratchet"
+)
+
+// PublicIdentityKey is a long-term Ed25519 public key of a party.
+type PublicIdentityKey []byte
+
+// dh returns the X25519 form of the identity key used in DH calculations.
+func (k PublicIdentityKey) dh() (doubleratchet.Key, error) {
+	if len(k) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid identity key length: %d", len(k))
+	}
+	p, err := new(edwards25519.Point).SetBytes(k)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity key: %s", err)
+	}
+	return p.BytesMontgomery(), nil
+}
+
+// IdentityKey is a long-term Ed25519 key pair of a party. It signs prekeys and
+// its X25519 form takes part in the key agreement.
+type IdentityKey struct {
+	private ed25519.PrivateKey
+}
+
+// GenerateIdentityKey creates a new identity key.
+func GenerateIdentityKey() (IdentityKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return IdentityKey{}, fmt.Errorf("couldn't generate identity key: %s", err)
+	}
+	return IdentityKey{private: priv}, nil
+}
+
+// NewIdentityKey restores an identity key from its 32-byte seed.
+func NewIdentityKey(seed []byte) (IdentityKey, error) {
+	if len(seed) != ed25519.SeedSize {
+		return IdentityKey{}, fmt.Errorf("invalid identity key seed length: %d", len(seed))
+	}
+	return IdentityKey{private: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// Seed returns the seed the identity key can be restored from with NewIdentityKey.
+func (k IdentityKey) Seed() []byte {
+	return k.private.Seed()
+}
+
+// Public returns the public part of the identity key.
+func (k IdentityKey) Public() PublicIdentityKey {
+	return PublicIdentityKey(k.private.Public().(ed25519.PublicKey))
+}
+
+// sign signs the message with the identity key.
+func (k IdentityKey) sign(message []byte) []byte {
+	return ed25519.Sign(k.private, message)
+}
+
+// dh returns the X25519 form of the identity key pair used in DH calculations.
+func (k IdentityKey) dh() (doubleratchet.DHPair, error) {
+	h := sha512.Sum512(k.private.Seed())
+	privKey := h[:32]
+	privKey[0] &= 248
+	privKey[31] &= 127
+	privKey[31] |= 64
+
+	pubKey, err := curve25519.X25519(privKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return keyPair{privateKey: privKey, publicKey: pubKey}, nil
+}
+
+// SignedPreKey is a medium-term key pair signed by the identity key of its owner.
+// The responder uses it as the initial ratchet key pair of the Double Ratchet session.
+type SignedPreKey struct {
+	ID        uint32
+	KeyPair   doubleratchet.DHPair
+	Signature []byte
+}
+
+// GenerateSignedPreKey creates a new prekey signed by the identity key ik.
+func GenerateSignedPreKey(id uint32, ik IdentityKey) (SignedPreKey, error) {
+	kp, err := doubleratchet.DefaultCrypto{}.GenerateDH()
+	if err != nil {
+		return SignedPreKey{}, err
+	}
+	return SignedPreKey{
+		ID:        id,
+		KeyPair:   kp,
+		Signature: ik.sign(kp.PublicKey()),
+	}, nil
+}
+
+// OneTimePreKey is a key pair used in a single key agreement.
+type OneTimePreKey struct {
+	ID      uint32
+	KeyPair doubleratchet.DHPair
+}
+
+// GenerateOneTimePreKeys creates n one-time prekeys with sequential identifiers starting from firstID.
+func GenerateOneTimePreKeys(firstID uint32, n int) ([]OneTimePreKey, error) {
+	keys := make([]OneTimePreKey, n)
+	for i := range keys {
+		kp, err := doubleratchet.DefaultCrypto{}.GenerateDH()
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = OneTimePreKey{ID: firstID + uint32(i), KeyPair: kp}
+	}
+	return keys, nil
+}
+
+// PreKeyBundle is published by the responder so that initiators could start sessions with it
+// while it's offline.
+type PreKeyBundle struct {
+	IdentityKey PublicIdentityKey `json:"identity_key"`
+
+	SignedPreKeyID        uint32            `json:"signed_pre_key_id"`
+	SignedPreKey          doubleratchet.Key `json:"signed_pre_key"`
+	SignedPreKeySignature []byte            `json:"signed_pre_key_signature"`
+
+	// OneTimePreKey is optional and empty if the responder ran out of one-time prekeys.
+	OneTimePreKeyID uint32            `json:"one_time_pre_key_id,omitempty"`
+	OneTimePreKey   doubleratchet.Key `json:"one_time_pre_key,omitempty"`
+
+	// KEMPreKey is an ML-KEM-768 encapsulation key required by InitiatePQ,
+	// see NewPQPreKeyBundle.
+	KEMPreKeyID        uint32 `json:"kem_pre_key_id,omitempty"`
+	KEMPreKey          []byte `json:"kem_pre_key,omitempty"`
+	KEMPreKeySignature []byte `json:"kem_pre_key_signature,omitempty"`
+}
+
+// NewPreKeyBundle creates a bundle out of the responder's keys. opk may be nil.
+func NewPreKeyBundle(ik IdentityKey, spk SignedPreKey, opk *OneTimePreKey) PreKeyBundle {
+	b := PreKeyBundle{
+		IdentityKey:           ik.Public(),
+		SignedPreKeyID:        spk.ID,
+		SignedPreKey:          spk.KeyPair.PublicKey(),
+		SignedPreKeySignature: spk.Signature,
+	}
+	if opk != nil {
+		b.OneTimePreKeyID = opk.ID
+		b.OneTimePreKey = opk.KeyPair.PublicKey()
+	}
+	return b
+}
+
+// Verify checks signatures of the signed prekey and the KEM prekey if it's present.
+func (b PreKeyBundle) Verify() error {
+	if len(b.IdentityKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid identity key length: %d", len(b.IdentityKey))
+	}
+	if !ed25519.Verify(ed25519.PublicKey(b.IdentityKey), b.SignedPreKey, b.SignedPreKeySignature) {
+		return fmt.Errorf("invalid signed prekey signature")
+	}
+	if len(b.KEMPreKey) != 0 && !ed25519.Verify(ed25519.PublicKey(b.IdentityKey), b.KEMPreKey, b.KEMPreKeySignature) {
+		return fmt.Errorf("invalid KEM prekey signature")
+	}
+	return nil
+}
+
+type keyPair struct {
+	privateKey doubleratchet.Key
+	publicKey  doubleratchet.Key
+}
+
+func (p keyPair) PrivateKey() doubleratchet.Key {
+	return p.privateKey
+}
+
+func (p keyPair) PublicKey() doubleratchet.Key {
+	return p.publicKey
+}
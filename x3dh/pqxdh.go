@@ -0,0 +1,108 @@
+package x3dh
+
+import (
+	"crypto/mlkem"
+	"fmt"
+)
+
+// DefaultPQInfo is the default application-specific KDF info of the post-quantum key agreement.
+// It differs from DefaultInfo so that classic and hybrid shared keys never collide.
+const DefaultPQInfo = "doubleratchet-pqxdh-x25519-sha256-mlkem768"
+
+// KEMPreKey is an ML-KEM-768 key pair signed by the identity key of its owner.
+// It may be used either as a last-resort key or as a one-time key, in the latter case
+// the owner must delete it after the first use.
+type KEMPreKey struct {
+	ID               uint32
+	DecapsulationKey *mlkem.DecapsulationKey768
+	Signature        []byte
+}
+
+// GenerateKEMPreKey creates a new KEM prekey signed by the identity key ik.
+func GenerateKEMPreKey(id uint32, ik IdentityKey) (KEMPreKey, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return KEMPreKey{}, fmt.Errorf("couldn't generate KEM key: %s", err)
+	}
+	return KEMPreKey{
+		ID:               id,
+		DecapsulationKey: dk,
+		Signature:        ik.sign(dk.EncapsulationKey().Bytes()),
+	}, nil
+}
+
+// NewPQPreKeyBundle creates a bundle for the post-quantum key agreement. opk may be nil.
+func NewPQPreKeyBundle(ik IdentityKey, spk SignedPreKey, kpk KEMPreKey, opk *OneTimePreKey) PreKeyBundle {
+	b := NewPreKeyBundle(ik, spk, opk)
+	b.KEMPreKeyID = kpk.ID
+	b.KEMPreKey = kpk.DecapsulationKey.EncapsulationKey().Bytes()
+	b.KEMPreKeySignature = kpk.Signature
+	return b
+}
+
+// InitiatePQ performs the hybrid (PQXDH-style) key agreement on the initiator's side.
+// On top of X3DH, the initiator encapsulates a secret to the responder's ML-KEM-768 prekey, so
+// the shared key is protected until both X25519 and ML-KEM-768 are broken:
+//
+//	SK = HKDF-SHA-256(salt = 32 zero bytes, ikm = 32 0xFF bytes || DH1 || DH2 || DH3 [|| DH4] || SS, info)
+//
+// where SS is the ML-KEM shared secret. Unlike Initiate, a bundle without the KEM prekey is rejected.
+func InitiatePQ(ik IdentityKey, bundle PreKeyBundle, opts ...option) (InitiatorResult, InitialMessage, error) {
+	c, err := newConfig(DefaultPQInfo, opts)
+	if err != nil {
+		return InitiatorResult{}, InitialMessage{}, err
+	}
+	if len(bundle.KEMPreKey) == 0 {
+		return InitiatorResult{}, InitialMessage{}, fmt.Errorf("bundle has no KEM prekey")
+	}
+
+	dhs, m, err := initiateDH(ik, bundle)
+	if err != nil {
+		return InitiatorResult{}, InitialMessage{}, err
+	}
+
+	ek, err := mlkem.NewEncapsulationKey768(bundle.KEMPreKey)
+	if err != nil {
+		return InitiatorResult{}, InitialMessage{}, fmt.Errorf("invalid KEM prekey: %s", err)
+	}
+	ss, ct := ek.Encapsulate()
+	m.KEMPreKeyID = bundle.KEMPreKeyID
+	m.KEMCiphertext = ct
+
+	return InitiatorResult{
+		SharedKey:      kdf(c.info, append(dhs, ss)...),
+		RemoteKey:      bundle.SignedPreKey,
+		AssociatedData: associatedData(ik.Public(), bundle.IdentityKey),
+	}, m, nil
+}
+
+// RespondPQ performs the hybrid key agreement on the responder's side. kpk must be the KEM prekey
+// referred by m, opk is treated the same way as by Respond.
+func RespondPQ(ik IdentityKey, spk SignedPreKey, kpk KEMPreKey, opk *OneTimePreKey, m InitialMessage, opts ...option) (ResponderResult, error) {
+	c, err := newConfig(DefaultPQInfo, opts)
+	if err != nil {
+		return ResponderResult{}, err
+	}
+	if len(m.KEMCiphertext) == 0 {
+		return ResponderResult{}, fmt.Errorf("initial message has no KEM ciphertext")
+	}
+	if m.KEMPreKeyID != kpk.ID {
+		return ResponderResult{}, fmt.Errorf("KEM prekey %d is used instead of %d", m.KEMPreKeyID, kpk.ID)
+	}
+
+	dhs, err := respondDH(ik, spk, opk, m)
+	if err != nil {
+		return ResponderResult{}, err
+	}
+
+	ss, err := kpk.DecapsulationKey.Decapsulate(m.KEMCiphertext)
+	if err != nil {
+		return ResponderResult{}, fmt.Errorf("can't decapsulate: %s", err)
+	}
+
+	return ResponderResult{
+		SharedKey:      kdf(c.info, append(dhs, ss)...),
+		KeyPair:        spk.KeyPair,
+		AssociatedData: associatedData(m.IdentityKey, ik.Public()),
+	}, nil
+}
@@ -0,0 +1,133 @@
+package x3dh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/status-im/doubleratchet"
+)
+
+func TestInitiatePQRespondPQ(t *testing.T) {
+	// Arrange.
+	r := newResponder(t)
+	kpk, err := GenerateKEMPreKey(7, r.ik)
+	require.NoError(t, err)
+
+	aliceIK, err := GenerateIdentityKey()
+	require.NoError(t, err)
+
+	// Act.
+	ires, m, err := InitiatePQ(aliceIK, NewPQPreKeyBundle(r.ik, r.spk, kpk, &r.opks[0]))
+	require.NoError(t, err)
+
+	rres, err := RespondPQ(r.ik, r.spk, kpk, &r.opks[0], m)
+	require.NoError(t, err)
+
+	// Assert.
+	require.EqualValues(t, 7, m.KEMPreKeyID)
+	require.NotEmpty(t, m.KEMCiphertext)
+	require.Equal(t, ires.SharedKey, rres.SharedKey)
+	require.Equal(t, ires.AssociatedData, rres.AssociatedData)
+
+	alice, err := doubleratchet.NewWithRemoteKey([]byte("alice"), ires.SharedKey, ires.RemoteKey, nil)
+	require.NoError(t, err)
+
+	bob, err := doubleratchet.New([]byte("bob"), rres.SharedKey, rres.KeyPair, nil)
+	require.NoError(t, err)
+
+	msg, err := alice.RatchetEncrypt([]byte("Hi Bob!"), ires.AssociatedData)
+	require.NoError(t, err)
+
+	d, err := bob.RatchetDecrypt(msg, rres.AssociatedData)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi Bob!"), d)
+}
+
+func TestInitiatePQ_DiffersFromClassic(t *testing.T) {
+	// Arrange.
+	r := newResponder(t)
+	kpk, err := GenerateKEMPreKey(7, r.ik)
+	require.NoError(t, err)
+
+	aliceIK, err := GenerateIdentityKey()
+	require.NoError(t, err)
+
+	_, m, err := InitiatePQ(aliceIK, NewPQPreKeyBundle(r.ik, r.spk, kpk, nil))
+	require.NoError(t, err)
+
+	// Act.
+	_, err = Respond(r.ik, r.spk, nil, m)
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+func TestInitiatePQ_Errors(t *testing.T) {
+	// Arrange.
+	r := newResponder(t)
+	kpk, err := GenerateKEMPreKey(7, r.ik)
+	require.NoError(t, err)
+
+	aliceIK, err := GenerateIdentityKey()
+	require.NoError(t, err)
+
+	t.Run("no KEM prekey", func(t *testing.T) {
+		_, _, err := InitiatePQ(aliceIK, NewPreKeyBundle(r.ik, r.spk, nil))
+		require.NotNil(t, err)
+	})
+
+	t.Run("invalid KEM prekey signature", func(t *testing.T) {
+		b := NewPQPreKeyBundle(r.ik, r.spk, kpk, nil)
+		b.KEMPreKeySignature = r.spk.Signature
+
+		_, _, err := InitiatePQ(aliceIK, b)
+		require.NotNil(t, err)
+	})
+
+	t.Run("malformed KEM prekey", func(t *testing.T) {
+		b := NewPQPreKeyBundle(r.ik, r.spk, kpk, nil)
+		b.KEMPreKey = b.KEMPreKey[:100]
+		b.KEMPreKeySignature = r.ik.sign(b.KEMPreKey)
+
+		_, _, err := InitiatePQ(aliceIK, b)
+		require.NotNil(t, err)
+	})
+}
+
+func TestRespondPQ_Errors(t *testing.T) {
+	// Arrange.
+	r := newResponder(t)
+	kpk, err := GenerateKEMPreKey(7, r.ik)
+	require.NoError(t, err)
+
+	aliceIK, err := GenerateIdentityKey()
+	require.NoError(t, err)
+
+	_, m, err := InitiatePQ(aliceIK, NewPQPreKeyBundle(r.ik, r.spk, kpk, nil))
+	require.NoError(t, err)
+
+	t.Run("wrong KEM prekey", func(t *testing.T) {
+		other, err := GenerateKEMPreKey(8, r.ik)
+		require.NoError(t, err)
+
+		_, err = RespondPQ(r.ik, r.spk, other, nil, m)
+		require.NotNil(t, err)
+	})
+
+	t.Run("classic message", func(t *testing.T) {
+		_, classic, err := Initiate(aliceIK, NewPreKeyBundle(r.ik, r.spk, nil))
+		require.NoError(t, err)
+
+		_, err = RespondPQ(r.ik, r.spk, kpk, nil, classic)
+		require.NotNil(t, err)
+	})
+
+	t.Run("malformed ciphertext", func(t *testing.T) {
+		malformed := m
+		malformed.KEMCiphertext = m.KEMCiphertext[:10]
+
+		_, err := RespondPQ(r.ik, r.spk, kpk, nil, malformed)
+		require.NotNil(t, err)
+	})
+}
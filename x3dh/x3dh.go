@@ -0,0 +1,268 @@
+// Package x3dh implements the X3DH key agreement protocol which establishes the shared key
+// and initial ratchet keys for Double Ratchet sessions.
+//
+// The responder publishes a PreKeyBundle. The initiator calls Initiate with it and creates
+// its session with doubleratchet.NewWithRemoteKey(id, res.SharedKey, res.RemoteKey, ...),
+// then sends InitialMessage along with its first Double Ratchet message. The responder calls
+// Respond and creates its session with doubleratchet.New(id, res.SharedKey, res.KeyPair, ...).
+// Both parties pass res.AssociatedData (or data prefixed by it) to RatchetEncrypt and RatchetDecrypt.
+//
+// InitiatePQ and RespondPQ additionally mix an ML-KEM-768 shared secret into the shared key
+// to protect sessions against harvest-now-decrypt-later attacks.
+package x3dh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/status-im/doubleratchet"
+)
+
+// DefaultInfo is the default application-specific KDF info.
+const DefaultInfo = "doubleratchet-x3dh"
+
+// InitialMessage is sent by the initiator to let the responder calculate the same shared key.
+type InitialMessage struct {
+	IdentityKey  PublicIdentityKey `json:"identity_key"`
+	EphemeralKey doubleratchet.Key `json:"ephemeral_key"`
+
+	SignedPreKeyID uint32 `json:"signed_pre_key_id"`
+
+	// OneTimePreKeyID is meaningful only if HasOneTimePreKey is true.
+	HasOneTimePreKey bool   `json:"has_one_time_pre_key"`
+	OneTimePreKeyID  uint32 `json:"one_time_pre_key_id"`
+
+	// KEM fields are set only by InitiatePQ.
+	KEMPreKeyID   uint32 `json:"kem_pre_key_id,omitempty"`
+	KEMCiphertext []byte `json:"kem_ciphertext,omitempty"`
+}
+
+// InitiatorResult holds the arguments for doubleratchet.NewWithRemoteKey.
+type InitiatorResult struct {
+	// SharedKey is the sharedKey argument of doubleratchet.NewWithRemoteKey.
+	SharedKey doubleratchet.Key
+
+	// RemoteKey is the remoteKey argument of doubleratchet.NewWithRemoteKey.
+	RemoteKey doubleratchet.Key
+
+	// AssociatedData binds messages to identities of both parties.
+	AssociatedData []byte
+}
+
+// ResponderResult holds the arguments for doubleratchet.New.
+type ResponderResult struct {
+	// SharedKey is the sharedKey argument of doubleratchet.New.
+	SharedKey doubleratchet.Key
+
+	// KeyPair is the keyPair argument of doubleratchet.New.
+	KeyPair doubleratchet.DHPair
+
+	// AssociatedData binds messages to identities of both parties.
+	AssociatedData []byte
+}
+
+type config struct {
+	info []byte
+}
+
+// option is an Initiate and Respond option.
+type option func(*config) error
+
+// WithInfo specifies the application-specific KDF info. Both parties must use the same value.
+// nolint: golint
+func WithInfo(info []byte) option {
+	return func(c *config) error {
+		if len(info) == 0 {
+			return fmt.Errorf("info mustn't be empty")
+		}
+		c.info = info
+		return nil
+	}
+}
+
+func newConfig(info string, opts []option) (config, error) {
+	c := config{info: []byte(info)}
+	for i := range opts {
+		if err := opts[i](&c); err != nil {
+			return config{}, fmt.Errorf("failed to apply option: %s", err)
+		}
+	}
+	return c, nil
+}
+
+// Initiate performs the key agreement on the initiator's side using the responder's bundle.
+func Initiate(ik IdentityKey, bundle PreKeyBundle, opts ...option) (InitiatorResult, InitialMessage, error) {
+	c, err := newConfig(DefaultInfo, opts)
+	if err != nil {
+		return InitiatorResult{}, InitialMessage{}, err
+	}
+
+	dhs, m, err := initiateDH(ik, bundle)
+	if err != nil {
+		return InitiatorResult{}, InitialMessage{}, err
+	}
+
+	return InitiatorResult{
+		SharedKey:      kdf(c.info, dhs...),
+		RemoteKey:      bundle.SignedPreKey,
+		AssociatedData: associatedData(ik.Public(), bundle.IdentityKey),
+	}, m, nil
+}
+
+// initiateDH verifies the bundle and calculates DH outputs on the initiator's side.
+func initiateDH(ik IdentityKey, bundle PreKeyBundle) ([][]byte, InitialMessage, error) {
+	if err := bundle.Verify(); err != nil {
+		return nil, InitialMessage{}, err
+	}
+
+	ikPair, err := ik.dh()
+	if err != nil {
+		return nil, InitialMessage{}, err
+	}
+	remoteIK, err := bundle.IdentityKey.dh()
+	if err != nil {
+		return nil, InitialMessage{}, err
+	}
+	ek, err := doubleratchet.DefaultCrypto{}.GenerateDH()
+	if err != nil {
+		return nil, InitialMessage{}, err
+	}
+
+	var dhs [][]byte
+	for _, in := range []struct {
+		priv, pub doubleratchet.Key
+	}{
+		{ikPair.PrivateKey(), bundle.SignedPreKey},
+		{ek.PrivateKey(), remoteIK},
+		{ek.PrivateKey(), bundle.SignedPreKey},
+	} {
+		out, err := dh(in.priv, in.pub)
+		if err != nil {
+			return nil, InitialMessage{}, err
+		}
+		dhs = append(dhs, out)
+	}
+
+	m := InitialMessage{
+		IdentityKey:    ik.Public(),
+		EphemeralKey:   ek.PublicKey(),
+		SignedPreKeyID: bundle.SignedPreKeyID,
+	}
+	if len(bundle.OneTimePreKey) != 0 {
+		out, err := dh(ek.PrivateKey(), bundle.OneTimePreKey)
+		if err != nil {
+			return nil, InitialMessage{}, err
+		}
+		dhs = append(dhs, out)
+		m.HasOneTimePreKey = true
+		m.OneTimePreKeyID = bundle.OneTimePreKeyID
+	}
+
+	return dhs, m, nil
+}
+
+// Respond performs the key agreement on the responder's side. opk must be the one-time prekey
+// referred by m or nil if m doesn't refer any. The caller must delete the one-time prekey afterwards.
+func Respond(ik IdentityKey, spk SignedPreKey, opk *OneTimePreKey, m InitialMessage, opts ...option) (ResponderResult, error) {
+	c, err := newConfig(DefaultInfo, opts)
+	if err != nil {
+		return ResponderResult{}, err
+	}
+	if len(m.KEMCiphertext) != 0 {
+		return ResponderResult{}, fmt.Errorf("post-quantum initial message must be handled by RespondPQ")
+	}
+
+	dhs, err := respondDH(ik, spk, opk, m)
+	if err != nil {
+		return ResponderResult{}, err
+	}
+
+	return ResponderResult{
+		SharedKey:      kdf(c.info, dhs...),
+		KeyPair:        spk.KeyPair,
+		AssociatedData: associatedData(m.IdentityKey, ik.Public()),
+	}, nil
+}
+
+// respondDH checks prekeys referred by m and calculates DH outputs on the responder's side.
+func respondDH(ik IdentityKey, spk SignedPreKey, opk *OneTimePreKey, m InitialMessage) ([][]byte, error) {
+	if m.SignedPreKeyID != spk.ID {
+		return nil, fmt.Errorf("signed prekey %d is used instead of %d", m.SignedPreKeyID, spk.ID)
+	}
+	if m.HasOneTimePreKey != (opk != nil) || (opk != nil && opk.ID != m.OneTimePreKeyID) {
+		return nil, fmt.Errorf("one-time prekey mismatch")
+	}
+
+	ikPair, err := ik.dh()
+	if err != nil {
+		return nil, err
+	}
+	remoteIK, err := m.IdentityKey.dh()
+	if err != nil {
+		return nil, err
+	}
+
+	var dhs [][]byte
+	for _, in := range []struct {
+		priv, pub doubleratchet.Key
+	}{
+		{spk.KeyPair.PrivateKey(), remoteIK},
+		{ikPair.PrivateKey(), m.EphemeralKey},
+		{spk.KeyPair.PrivateKey(), m.EphemeralKey},
+	} {
+		out, err := dh(in.priv, in.pub)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, out)
+	}
+	if opk != nil {
+		out, err := dh(opk.KeyPair.PrivateKey(), m.EphemeralKey)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, out)
+	}
+
+	return dhs, nil
+}
+
+// dh calculates X25519 rejecting low-order public keys.
+func dh(priv, pub doubleratchet.Key) ([]byte, error) {
+	out, err := curve25519.X25519(priv, pub)
+	if err != nil {
+		return nil, fmt.Errorf("can't calculate dh: %s", err)
+	}
+	return out, nil
+}
+
+// kdf derives the 32-byte shared key from the concatenated DH outputs as specified by X3DH:
+// HKDF-SHA-256 over 32 0xFF bytes followed by the DH outputs with a zero-filled salt.
+func kdf(info []byte, dhs ...[]byte) doubleratchet.Key {
+	ikm := bytes.Repeat([]byte{0xff}, 32)
+	for _, out := range dhs {
+		ikm = append(ikm, out...)
+	}
+
+	var (
+		r  = hkdf.New(sha256.New, ikm, make([]byte, sha256.Size), info)
+		sk = make(doubleratchet.Key, 32)
+	)
+
+	// The only error here is an entropy limit which won't be reached for such a short buffer.
+	_, _ = io.ReadFull(r, sk)
+
+	return sk
+}
+
+// associatedData returns the encoded identity keys of the initiator and the responder.
+func associatedData(initiator, responder PublicIdentityKey) []byte {
+	ad := make([]byte, 0, len(initiator)+len(responder))
+	ad = append(ad, initiator...)
+	return append(ad, responder...)
+}
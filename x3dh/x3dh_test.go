@@ -0,0 +1,207 @@
+package x3dh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/status-im/doubleratchet"
+)
+
+type responder struct {
+	ik   IdentityKey
+	spk  SignedPreKey
+	opks []OneTimePreKey
+}
+
+func newResponder(t *testing.T) responder {
+	ik, err := GenerateIdentityKey()
+	require.NoError(t, err)
+
+	spk, err := GenerateSignedPreKey(1, ik)
+	require.NoError(t, err)
+
+	opks, err := GenerateOneTimePreKeys(10, 2)
+	require.NoError(t, err)
+
+	return responder{ik: ik, spk: spk, opks: opks}
+}
+
+func TestIdentityKey_DH(t *testing.T) {
+	// Arrange.
+	ik, err := GenerateIdentityKey()
+	require.NoError(t, err)
+
+	// Act.
+	pair, err := ik.dh()
+	require.NoError(t, err)
+
+	pub, err := ik.Public().dh()
+	require.NoError(t, err)
+
+	// Assert.
+	require.Equal(t, pair.PublicKey(), pub)
+
+	derived, err := curve25519.X25519(pair.PrivateKey(), curve25519.Basepoint)
+	require.NoError(t, err)
+	require.EqualValues(t, pub, derived)
+}
+
+func TestNewIdentityKey(t *testing.T) {
+	// Arrange.
+	ik, err := GenerateIdentityKey()
+	require.NoError(t, err)
+
+	// Act.
+	restored, err := NewIdentityKey(ik.Seed())
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, ik.Public(), restored.Public())
+
+	_, err = NewIdentityKey([]byte{1, 2, 3})
+	require.NotNil(t, err)
+}
+
+func TestGenerateOneTimePreKeys(t *testing.T) {
+	// Act.
+	keys, err := GenerateOneTimePreKeys(5, 3)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Len(t, keys, 3)
+	for i, k := range keys {
+		require.EqualValues(t, 5+i, k.ID)
+		require.Len(t, k.KeyPair.PublicKey(), 32)
+	}
+}
+
+func TestPreKeyBundle_Verify(t *testing.T) {
+	// Arrange.
+	r := newResponder(t)
+	b := NewPreKeyBundle(r.ik, r.spk, nil)
+
+	// Act and assert.
+	require.NoError(t, b.Verify())
+
+	b.SignedPreKey = r.opks[0].KeyPair.PublicKey()
+	require.NotNil(t, b.Verify())
+
+	b.IdentityKey = b.IdentityKey[:10]
+	require.NotNil(t, b.Verify())
+}
+
+func TestInitiateRespond(t *testing.T) {
+	for name, withOPK := range map[string]bool{
+		"with one-time prekey":    true,
+		"without one-time prekey": false,
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Arrange.
+			r := newResponder(t)
+			aliceIK, err := GenerateIdentityKey()
+			require.NoError(t, err)
+
+			var opk *OneTimePreKey
+			if withOPK {
+				opk = &r.opks[1]
+			}
+
+			// Act.
+			ires, m, err := Initiate(aliceIK, NewPreKeyBundle(r.ik, r.spk, opk))
+			require.NoError(t, err)
+
+			rres, err := Respond(r.ik, r.spk, opk, m)
+			require.NoError(t, err)
+
+			// Assert.
+			require.Equal(t, withOPK, m.HasOneTimePreKey)
+			require.Len(t, ires.SharedKey, 32)
+			require.Equal(t, ires.SharedKey, rres.SharedKey)
+			require.Equal(t, ires.AssociatedData, rres.AssociatedData)
+			require.Equal(t, r.spk.KeyPair.PublicKey(), ires.RemoteKey)
+			require.Equal(t, r.spk.KeyPair, rres.KeyPair)
+
+			// The results are suitable for a Double Ratchet session.
+			alice, err := doubleratchet.NewWithRemoteKey([]byte("alice"), ires.SharedKey, ires.RemoteKey, nil)
+			require.NoError(t, err)
+
+			bob, err := doubleratchet.New([]byte("bob"), rres.SharedKey, rres.KeyPair, nil)
+			require.NoError(t, err)
+
+			msg, err := alice.RatchetEncrypt([]byte("Hi Bob!"), ires.AssociatedData)
+			require.NoError(t, err)
+
+			d, err := bob.RatchetDecrypt(msg, rres.AssociatedData)
+			require.NoError(t, err)
+			require.Equal(t, []byte("Hi Bob!"), d)
+		})
+	}
+}
+
+func TestInitiate_InvalidSignature(t *testing.T) {
+	// Arrange.
+	var (
+		r           = newResponder(t)
+		aliceIK, _  = GenerateIdentityKey()
+		b           = NewPreKeyBundle(r.ik, r.spk, nil)
+		otherIK, _  = GenerateIdentityKey()
+		otherSPK, _ = GenerateSignedPreKey(1, otherIK)
+	)
+	b.SignedPreKeySignature = otherSPK.Signature
+
+	// Act.
+	_, _, err := Initiate(aliceIK, b)
+
+	// Assert.
+	require.NotNil(t, err)
+}
+
+func TestRespond_Mismatch(t *testing.T) {
+	// Arrange.
+	r := newResponder(t)
+	aliceIK, err := GenerateIdentityKey()
+	require.NoError(t, err)
+
+	_, m, err := Initiate(aliceIK, NewPreKeyBundle(r.ik, r.spk, &r.opks[0]))
+	require.NoError(t, err)
+
+	t.Run("missing one-time prekey", func(t *testing.T) {
+		_, err := Respond(r.ik, r.spk, nil, m)
+		require.NotNil(t, err)
+	})
+
+	t.Run("wrong one-time prekey", func(t *testing.T) {
+		_, err := Respond(r.ik, r.spk, &r.opks[1], m)
+		require.NotNil(t, err)
+	})
+
+	t.Run("wrong signed prekey", func(t *testing.T) {
+		spk, err := GenerateSignedPreKey(2, r.ik)
+		require.NoError(t, err)
+
+		_, err = Respond(r.ik, spk, &r.opks[0], m)
+		require.NotNil(t, err)
+	})
+}
+
+func TestWithInfo(t *testing.T) {
+	// Arrange.
+	r := newResponder(t)
+	aliceIK, err := GenerateIdentityKey()
+	require.NoError(t, err)
+
+	// Act.
+	ires, m, err := Initiate(aliceIK, NewPreKeyBundle(r.ik, r.spk, nil), WithInfo([]byte("app")))
+	require.NoError(t, err)
+
+	rres, err := Respond(r.ik, r.spk, nil, m)
+	require.NoError(t, err)
+
+	// Assert.
+	require.NotEqual(t, ires.SharedKey, rres.SharedKey)
+
+	_, _, err = Initiate(aliceIK, NewPreKeyBundle(r.ik, r.spk, nil), WithInfo(nil))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,79 @@
+package doubleratchet
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"github.com/cloudflare/circl/dh/x448"
+)
+
+// x448KDF derives keys and encrypts messages for X448Crypto. It's DefaultCrypto with SHA-512
+// and its own info strings, so the keys never collide with the ones of the Curve25519 suites.
+var x448KDF = DefaultCrypto{
+	kdfRKInfo:          "doubleratchet X448 root chain",
+	encryptionKeysInfo: "doubleratchet X448 message keys",
+	hash:               HashSHA512,
+}
+
+// X448Crypto is an implementation of Crypto with X448 key pairs. KDF_RK and KDF_CK are HKDF
+// and HMAC with SHA-512, ENCRYPT is AES-256-CTR with HMAC-SHA-512.
+type X448Crypto struct{}
+
+// Suite returns CryptoSuiteX448.
+func (c X448Crypto) Suite() CryptoSuite {
+	return CryptoSuiteX448
+}
+
+// GenerateDH creates a new X448 key pair.
+func (c X448Crypto) GenerateDH() (DHPair, error) {
+	var privKey, pubKey x448.Key
+	if _, err := io.ReadFull(rand.Reader, privKey[:]); err != nil {
+		return dhPair{}, fmt.Errorf("couldn't generate privKey: %w", err)
+	}
+	x448.KeyGen(&pubKey, &privKey)
+	return dhPair{
+		privateKey: privKey[:],
+		publicKey:  pubKey[:],
+	}, nil
+}
+
+// DH returns the output from the X448 function between the private key from the DH key pair dhPair
+// and the DH public key dbPub. Low-order public keys are rejected.
+func (c X448Crypto) DH(dhPair DHPair, dhPub Key) (Key, error) {
+	if len(dhPair.PrivateKey()) != x448.Size {
+		return nil, fmt.Errorf("%w: private key length %d", ErrInvalidKey, len(dhPair.PrivateKey()))
+	}
+	if len(dhPub) != x448.Size {
+		return nil, fmt.Errorf("%w: public key length %d", ErrInvalidKey, len(dhPub))
+	}
+
+	var privKey, pubKey, shared x448.Key
+	copy(privKey[:], dhPair.PrivateKey())
+	copy(pubKey[:], dhPub)
+	if !x448.Shared(&shared, &privKey, &pubKey) {
+		return nil, fmt.Errorf("%w: low-order public key", ErrInvalidKey)
+	}
+	return shared[:], nil
+}
+
+// KdfRK returns a triple (32-byte root key, 32-byte chain key, 32-byte header key) derived
+// with HKDF-SHA-512.
+func (c X448Crypto) KdfRK(rk, dhOut Key) (Key, Key, Key) {
+	return x448KDF.KdfRK(rk, dhOut)
+}
+
+// KdfCK returns a pair (32-byte chain key, 32-byte message key) derived with HMAC-SHA-512.
+func (c X448Crypto) KdfCK(ck Key) (Key, Key) {
+	return x448KDF.KdfCK(ck)
+}
+
+// Encrypt returns the AES-256-CTR ciphertext authenticated with HMAC-SHA-512.
+func (c X448Crypto) Encrypt(mk Key, plaintext, ad []byte) ([]byte, error) {
+	return x448KDF.Encrypt(mk, plaintext, ad)
+}
+
+// Decrypt returns the AEAD decryption of ciphertext with message key mk.
+func (c X448Crypto) Decrypt(mk Key, ciphertext, ad []byte) ([]byte, error) {
+	return x448KDF.Decrypt(mk, ciphertext, ad)
+}
@@ -0,0 +1,121 @@
+package doubleratchet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestX448Crypto_DH(t *testing.T) {
+	// Arrange.
+	// Test vectors from RFC 7748, section 6.2.
+	var (
+		alicePriv = mustHex(t, "9a8f4925d1519f5775cf46b04b5800d4ee9ee8bae8bc5565d498c28dd9c9baf574a9419744897391006382a6f127ab1d9ac2d8c0a598726b")
+		bobPub    = mustHex(t, "3eb7a829b0cd20f5bcfc0b599b6feccf6da4627107bdb0d4f345b43027d8b972fc3e34fb4232a13ca706dcb57aec3dae07bdc1c67bf33609")
+	)
+
+	// Act.
+	shared, err := X448Crypto{}.DH(dhPair{privateKey: alicePriv}, bobPub)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, "07fff4181ac6cc95ec1c16a94a0f74d12da232ce40a77552281d282bb60c0b56fd2464c335543936521c24403085d59a449a5037514a879d", shared.String())
+}
+
+func TestX448Crypto_DH_InvalidKey(t *testing.T) {
+	// Arrange.
+	pair, err := X448Crypto{}.GenerateDH()
+	require.NoError(t, err)
+
+	for _, pub := range []Key{make(Key, 56), make(Key, 32)} {
+		// Act.
+		_, err := X448Crypto{}.DH(pair, pub)
+
+		// Assert.
+		require.True(t, errors.Is(err, ErrInvalidKey), err)
+	}
+}
+
+func TestX448Crypto_GenerateDH(t *testing.T) {
+	// Act.
+	alice, err := X448Crypto{}.GenerateDH()
+	require.NoError(t, err)
+	bob, err := X448Crypto{}.GenerateDH()
+	require.NoError(t, err)
+
+	// Assert.
+	require.Len(t, alice.PrivateKey(), 56)
+	require.Len(t, alice.PublicKey(), 56)
+
+	s1, err := X448Crypto{}.DH(alice, bob.PublicKey())
+	require.NoError(t, err)
+	s2, err := X448Crypto{}.DH(bob, alice.PublicKey())
+	require.NoError(t, err)
+	require.Equal(t, s1, s2)
+}
+
+func TestX448Crypto_Session(t *testing.T) {
+	// Arrange.
+	c := X448Crypto{}
+	bobPair, err := c.GenerateDH()
+	require.NoError(t, err)
+	bob, err := New([]byte("bob"), sk, bobPair, nil, WithCrypto(c))
+	require.NoError(t, err)
+	alice, err := NewWithRemoteKey([]byte("alice"), sk, bobPair.PublicKey(), nil, WithCrypto(c))
+	require.NoError(t, err)
+
+	// Act.
+	m1, err := alice.RatchetEncrypt([]byte("1"), nil)
+	require.NoError(t, err)
+	m2, err := alice.RatchetEncrypt([]byte("2"), nil)
+	require.NoError(t, err)
+
+	// Assert.
+	require.Len(t, m1.Header.DH, 56)
+
+	d, err := bob.RatchetDecrypt(m2, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), d)
+
+	reply, err := bob.RatchetEncrypt([]byte("3"), nil)
+	require.NoError(t, err)
+	decoded, err := reply.Header.Encode().Decode()
+	require.NoError(t, err)
+	d, err = alice.RatchetDecrypt(Message{Header: decoded, Ciphertext: reply.Ciphertext}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), d)
+
+	d, err = bob.RatchetDecrypt(m1, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), d)
+
+	_, err = bob.RatchetDecrypt(Message{Header: MessageHeader{DH: bobPair.PublicKey()[:32]}, Ciphertext: m1.Ciphertext}, nil)
+	require.True(t, errors.Is(err, ErrMalformedHeader), err)
+}
+
+func TestX448Crypto_SessionHE(t *testing.T) {
+	// Arrange.
+	c := X448Crypto{}
+	bobPair, err := c.GenerateDH()
+	require.NoError(t, err)
+	bob, err := NewHE([]byte("bob"), sk, sharedHka, sharedNhkb, bobPair, nil, WithCrypto(c))
+	require.NoError(t, err)
+	alice, err := NewHEWithRemoteKey([]byte("alice"), sk, sharedHka, sharedNhkb, bobPair.PublicKey(), nil, WithCrypto(c))
+	require.NoError(t, err)
+
+	// Act.
+	m, err := alice.RatchetEncrypt([]byte("Hi Bob!"), nil)
+	require.NoError(t, err)
+	d, err := bob.RatchetDecrypt(m, nil)
+
+	// Assert.
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi Bob!"), d)
+
+	reply, err := bob.RatchetEncrypt([]byte("Hi Alice!"), nil)
+	require.NoError(t, err)
+	d, err = alice.RatchetDecrypt(reply, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi Alice!"), d)
+}